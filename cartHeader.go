@@ -0,0 +1,199 @@
+package segmago
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// CartInfo holds what the "TMR SEGA" header (and, for
+// homebrew, the SDSC header) says about a cart
+type CartInfo struct {
+	// HeaderAddr is where "TMR SEGA" was found
+	HeaderAddr int
+
+	ProductCode int
+	Version     byte
+
+	// RegionCode is 3/4 for SMS japan/export,
+	// 5/6/7 for GG japan/export/international
+	RegionCode byte
+
+	// ROMSize is the size the header claims, in bytes
+	ROMSize int
+
+	Checksum         uint16
+	ComputedChecksum uint16
+	// ChecksumOK is what the export BIOS checks before booting
+	ChecksumOK bool
+
+	HasSDSC     bool
+	SDSCVersion string
+	ReleaseDate string // YYYY-MM-DD
+	Author      string
+	Name        string
+	Description string
+}
+
+var cartRegionNames = map[byte]string{
+	3: "SMS Japan",
+	4: "SMS Export",
+	5: "GG Japan",
+	6: "GG Export",
+	7: "GG International",
+}
+
+// RegionName gives a readable name for the RegionCode
+func (c CartInfo) RegionName() string {
+	if name, ok := cartRegionNames[c.RegionCode]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown (%d)", c.RegionCode)
+}
+
+// IsGameGear says if the header claims a Game Gear cart
+func (c CartInfo) IsGameGear() bool {
+	return c.RegionCode >= 5 && c.RegionCode <= 7
+}
+
+// IsJapanese says if the header claims a japanese cart
+func (c CartInfo) IsJapanese() bool {
+	return c.RegionCode == 3 || c.RegionCode == 5
+}
+
+// Title is the best name we have for the cart, or
+// "" if the header doesn't have one
+func (c CartInfo) Title() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	if c.ProductCode != 0 {
+		return fmt.Sprintf("product %d v%d", c.ProductCode, c.Version)
+	}
+	return ""
+}
+
+// the ROM size codes in the low nibble of the last header byte
+var cartROMSizes = map[byte]int{
+	0x0a: 8 * 1024,
+	0x0b: 16 * 1024,
+	0x0c: 32 * 1024,
+	0x0d: 48 * 1024,
+	0x0e: 64 * 1024,
+	0x0f: 128 * 1024,
+	0x00: 256 * 1024,
+	0x01: 512 * 1024,
+	0x02: 1024 * 1024,
+}
+
+// stripCopierHeader removes the 512 byte header that
+// some dumps (made with old copier devices) start with
+func stripCopierHeader(cart []byte) []byte {
+	if len(cart)&0x3fff == 512 {
+		return cart[512:]
+	}
+	return cart
+}
+
+// findCartHeader returns where the "TMR SEGA" header
+// starts, or 0 if there isn't one
+func findCartHeader(cart []byte) int {
+	hdrLocs := []int{0x1ff0, 0x3ff0, 0x7ff0}
+	for _, addr := range hdrLocs {
+		if len(cart) < addr+16 {
+			continue
+		}
+		magic := cart[addr : addr+8]
+		if bytes.Equal(magic, []byte("TMR SEGA")) {
+			return addr
+		}
+	}
+	return 0
+}
+
+// ParseCartHeader decodes a cart's header, returning an error if it
+// doesn't have one. A bad checksum isn't an error (see ChecksumOK),
+// as plenty of japanese and GG games don't bother with it.
+func ParseCartHeader(cart []byte) (CartInfo, error) {
+	cart = stripCopierHeader(cart)
+
+	info := CartInfo{}
+	hdrAddr := findCartHeader(cart)
+	if hdrAddr == 0 {
+		return info, fmt.Errorf("no TMR SEGA header found")
+	}
+	hdr := cart[hdrAddr : hdrAddr+16]
+
+	info.HeaderAddr = hdrAddr
+	info.Checksum = uint16(hdr[0x0a]) | uint16(hdr[0x0b])<<8
+	info.ProductCode = int(fromBCD(hdr[0x0c])) +
+		int(fromBCD(hdr[0x0d]))*100 +
+		int(hdr[0x0e]>>4)*10000
+	info.Version = hdr[0x0e] & 0x0f
+	info.RegionCode = hdr[0x0f] >> 4
+	info.ROMSize = cartROMSizes[hdr[0x0f]&0x0f]
+
+	if info.ROMSize > 0 && info.ROMSize <= len(cart) {
+		info.ComputedChecksum = cartChecksum(cart, info.ROMSize)
+		info.ChecksumOK = info.ComputedChecksum == info.Checksum
+	}
+
+	if hdrAddr == 0x7ff0 {
+		parseSDSCHeader(cart, &info)
+	}
+
+	return info, nil
+}
+
+// cartChecksum sums the bytes like the BIOS does: everything
+// in the declared size except the 16 header bytes at 0x7ff0
+// (or the last 16 bytes, for carts under 32KB)
+func cartChecksum(cart []byte, size int) uint16 {
+	sum := uint16(0)
+	end := size
+	if size < 0x8000 {
+		end = size - 16
+	}
+	for i := 0; i < end; i++ {
+		if i >= 0x7ff0 && i < 0x8000 {
+			continue
+		}
+		sum += uint16(cart[i])
+	}
+	return sum
+}
+
+// parseSDSCHeader reads the homebrew header that
+// sits just before "TMR SEGA", if it's there
+func parseSDSCHeader(cart []byte, info *CartInfo) {
+	sdsc := cart[0x7fe0:0x7ff0]
+	if string(sdsc[:4]) != "SDSC" {
+		return
+	}
+	info.HasSDSC = true
+	info.SDSCVersion = fmt.Sprintf("%d.%02d", fromBCD(sdsc[4]), fromBCD(sdsc[5]))
+
+	day, month := fromBCD(sdsc[6]), fromBCD(sdsc[7])
+	year := int(fromBCD(sdsc[9]))*100 + int(fromBCD(sdsc[8]))
+	if day != 0 && month != 0 {
+		info.ReleaseDate = fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+	}
+
+	strAt := func(ptrAddr int) string {
+		ptr := int(cart[ptrAddr]) | int(cart[ptrAddr+1])<<8
+		if ptr == 0xffff || ptr >= len(cart) {
+			return ""
+		}
+		end := bytes.IndexByte(cart[ptr:], 0)
+		if end < 0 {
+			return ""
+		}
+		return string(cart[ptr : ptr+end])
+	}
+	info.Author = strAt(0x7fea)
+	info.Name = strAt(0x7fec)
+	info.Description = strAt(0x7fee)
+}
+
+func fromBCD(b byte) byte {
+	return (b>>4)*10 + b&0x0f
+}
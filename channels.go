@@ -0,0 +1,110 @@
+package segmago
+
+import "fmt"
+
+// The audio channels that can be muted and watched: 0-3 are the
+// PSG's tones and noise, 4-12 the FM unit's 9 channels (in rhythm
+// mode, the last three are the bass drum, hi-hat/snare and
+// tom/cymbal).
+const (
+	NumPSGChannels   = 4
+	NumFMChannels    = 9
+	NumAudioChannels = NumPSGChannels + NumFMChannels
+)
+
+// how many of each channel's latest samples Scope gives
+const scopeLen = 512
+
+// AudioChannels mutes, solos and watches the sound chips' channels.
+// It belongs to the frontend, not the emulated console, so it lives
+// on through snapshot loads and resets.
+type AudioChannels struct {
+	muted [NumAudioChannels]bool
+	solo  [NumAudioChannels]bool
+	heard [NumAudioChannels]bool
+
+	scopes   [NumAudioChannels][scopeLen]float32
+	scopePos [NumAudioChannels]int
+
+	// hasFM is hooked up by whatever's making the sound
+	hasFM func() bool
+}
+
+func newAudioChannels() *AudioChannels {
+	a := &AudioChannels{}
+	a.update()
+	return a
+}
+
+// AudioChannelName gives a channel's name, e.g. "tone 0" or "fm 3"
+func AudioChannelName(ch int) string {
+	switch {
+	case ch < 3:
+		return fmt.Sprint("tone ", ch)
+	case ch == 3:
+		return "noise"
+	default:
+		return fmt.Sprint("fm ", ch-NumPSGChannels+1)
+	}
+}
+
+// Len is how many channels there are right now: all of
+// them with an FM unit, otherwise just the PSG's
+func (a *AudioChannels) Len() int {
+	if a.hasFM != nil && a.hasFM() {
+		return NumAudioChannels
+	}
+	return NumPSGChannels
+}
+
+// SetMute mutes or unmutes a channel
+func (a *AudioChannels) SetMute(ch int, mute bool) {
+	a.muted[ch] = mute
+	a.update()
+}
+
+// SetSolo solos a channel. While any channel is
+// soloed, only the soloed ones are heard.
+func (a *AudioChannels) SetSolo(ch int, solo bool) {
+	a.solo[ch] = solo
+	a.update()
+}
+
+func (a *AudioChannels) Muted(ch int) bool  { return a.muted[ch] }
+func (a *AudioChannels) Soloed(ch int) bool { return a.solo[ch] }
+
+// Heard says if a channel makes it into the mix
+func (a *AudioChannels) Heard(ch int) bool {
+	return a == nil || a.heard[ch]
+}
+
+func (a *AudioChannels) update() {
+	anySolo := false
+	for _, solo := range a.solo {
+		anySolo = anySolo || solo
+	}
+	for ch := range a.heard {
+		if anySolo {
+			a.heard[ch] = a.solo[ch]
+		} else {
+			a.heard[ch] = !a.muted[ch]
+		}
+	}
+}
+
+// Scope gives a channel's latest output, oldest first, one value
+// (from -1 to 1) per output sample. Muted channels still show up.
+func (a *AudioChannels) Scope(ch int) []float32 {
+	out := make([]float32, 0, scopeLen)
+	pos := a.scopePos[ch]
+	out = append(out, a.scopes[ch][pos:]...)
+	return append(out, a.scopes[ch][:pos]...)
+}
+
+func (a *AudioChannels) tap(ch int, val float32) {
+	if a == nil {
+		return
+	}
+	a.scopes[ch][a.scopePos[ch]] = val
+	a.scopePos[ch] = (a.scopePos[ch] + 1) % scopeLen
+}
@@ -0,0 +1,33 @@
+package segmago
+
+import "testing"
+
+func TestAudioChannelsLen(t *testing.T) {
+	cart := make([]byte, 0x8000)
+	tests := []struct {
+		name string
+		emu  Emulator
+		want int
+	}{
+		{"export sms", NewEmulatorSMSWithOptions(cart, nil, Options{Region: RegionExport}), NumPSGChannels},
+		{"japanese sms", NewEmulatorSMSWithOptions(cart, nil, Options{Region: RegionJapan}), NumAudioChannels},
+		{"gg", NewEmulatorGGWithOptions(cart, nil, Options{Region: RegionJapan}), NumPSGChannels},
+		{"sg-1000", NewEmulatorSG1000WithOptions(cart, Options{Region: RegionJapan}), NumPSGChannels},
+	}
+	for _, tt := range tests {
+		chans := tt.emu.AudioChannels()
+		if got := chans.Len(); got != tt.want {
+			t.Errorf("%s: Len() = %d, want %d", tt.name, got, tt.want)
+		}
+
+		// the channels are hooked up from the start, not just after a reset
+		emu := tt.emu.(*emuState)
+		if emu.SN76489.channels != chans || emu.YM2413.channels != chans {
+			t.Errorf("%s: the sound chips aren't using AudioChannels", tt.name)
+		}
+		tt.emu.HardReset()
+		if tt.emu.AudioChannels() != chans || chans.Len() != tt.want {
+			t.Errorf("%s: channels changed on a hard reset", tt.name)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"github.com/theinternetftw/segmago/disasm"
+
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const usage = `usage: ./segmago-disasm [options] ROM_FILENAME
+
+Disassembles rom banks. Unless -org is given, bank 0 is shown at
+0x0000, bank 1 at 0x4000, and all others at 0x8000 (the slots the
+sega mapper usually puts them in).
+
+options:
+`
+
+const bankSize = 16 * 1024
+
+func main() {
+
+	symFilename := flag.String("sym", "", "WLA-DX or no$sms symbol file (default: ROM_BASENAME.sym if it exists)")
+	bankNum := flag.Int("bank", -1, "only dump this bank (default: all banks)")
+	orgStr := flag.String("org", "", "address (hex) to show the bank at")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	romFilename := flag.Arg(0)
+
+	rom, err := ioutil.ReadFile(romFilename)
+	dieIf(err)
+
+	// strip a header that is only sometimes seen...
+	if len(rom)&0x3fff == 512 {
+		rom = rom[512:]
+	}
+
+	if *symFilename == "" {
+		guess := strings.TrimSuffix(romFilename, ext(romFilename)) + ".sym"
+		if _, err := os.Stat(guess); err == nil {
+			*symFilename = guess
+		}
+	}
+	var syms *disasm.Symbols
+	if *symFilename != "" {
+		syms, err = disasm.LoadSymbolFile(*symFilename)
+		dieIf(err)
+	}
+
+	org := -1
+	if *orgStr != "" {
+		o, err := strconv.ParseUint(strings.TrimPrefix(*orgStr, "0x"), 16, 16)
+		dieIf(err)
+		org = int(o)
+	}
+
+	numBanks := (len(rom) + bankSize - 1) / bankSize
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	for bank := 0; bank < numBanks; bank++ {
+		if *bankNum >= 0 && bank != *bankNum {
+			continue
+		}
+		bankOrg := org
+		if bankOrg < 0 {
+			bankOrg = defaultOrg(bank)
+		}
+		dumpBank(out, rom, bank, uint16(bankOrg), syms)
+	}
+}
+
+func ext(filename string) string {
+	if i := strings.LastIndexByte(filename, '.'); i >= 0 {
+		return filename[i:]
+	}
+	return ""
+}
+
+func defaultOrg(bank int) int {
+	if bank < 2 {
+		return bank * bankSize
+	}
+	return 2 * bankSize
+}
+
+func dumpBank(out *bufio.Writer, rom []byte, bank int, org uint16, syms *disasm.Symbols) {
+
+	bankData := rom[bank*bankSize:]
+	if len(bankData) > bankSize {
+		bankData = bankData[:bankSize]
+	}
+
+	// reads past the end of the bank just see zeroes
+	read := func(addr uint16) byte {
+		offset := int(addr - org)
+		if offset < len(bankData) {
+			return bankData[offset]
+		}
+		return 0
+	}
+	lookup := func(addr uint16) (string, bool) {
+		refBank := -1
+		if addr >= org && int(addr-org) < len(bankData) {
+			refBank = bank
+		}
+		return syms.Lookup(refBank, addr)
+	}
+
+	fmt.Fprintf(out, "; bank %02X at 0x%04X\n", bank, org)
+
+	for offset := 0; offset < len(bankData); {
+		addr := org + uint16(offset)
+		if label, ok := syms.Lookup(bank, addr); ok {
+			fmt.Fprintf(out, "%s:\n", label)
+		}
+
+		inst := disasm.Decode(read, addr)
+
+		cycles := strconv.Itoa(inst.Cycles)
+		if inst.CyclesNotTaken != inst.Cycles {
+			cycles += "/" + strconv.Itoa(inst.CyclesNotTaken)
+		}
+		undoc := ""
+		if inst.Undocumented {
+			undoc = " *"
+		}
+		fmt.Fprintf(out, "%02X:%04X  %-12s  %-24s ; %s%s\n",
+			bank, addr, inst.HexBytes(), inst.Format(lookup), cycles, undoc)
+
+		offset += int(inst.Len)
+	}
+	fmt.Fprintln(out)
+}
+
+func dieIf(err error) {
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"github.com/theinternetftw/segmago"
+
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const usage = `usage: ./segmago-headless [options] ROM_FILENAME
+
+Runs a rom without a window or audio device, then writes out the results.
+
+input script format: one "FRAME BUTTON..." line per change, where the
+listed buttons are held from that frame until the next line. Buttons
+are up, down, left, right, a, b, start, fire, and the mega drive pad's
+c, x, y, z and mode, with a "p2:" prefix for the second pad (e.g.
+"120 right a p2:up"), plus the console's pause and reset buttons.
+"aim:X,Y" points the light phaser at that pixel, and "paddle:N" turns
+the paddle (0-255). Lines starting with # are ignored.
+
+with -debug, the debugger's "help" command lists what it can do, and
+"screen FILE" writes the current frame to a png. "quit" stops early
+(still writing any requested output files).
+
+options:
+`
+
+func main() {
+
+	numFrames := flag.Int("frames", 600, "number of frames to run")
+	biosFilename := flag.String("bios", "", "bios file to boot with")
+	inputFilename := flag.String("input", "", "scripted input file")
+	pngFilename := flag.String("png", "", "write the final frame to this png file")
+	wavFilename := flag.String("wav", "", "write all audio to this wav file")
+	sampleRate := flag.Int("samplerate", 44100, "audio sample rate")
+	snapFilename := flag.String("snapshot", "", "write a snapshot of the final state to this file")
+	isGG := flag.Bool("gg", false, "force game gear mode (default: based on the cart header, or the .gg extension)")
+	debugMode := flag.Bool("debug", false, "start stopped in the debugger, reading commands from stdin")
+	stereoMode := segmago.StereoOff
+	flag.Var(&stereoMode, "3d", "how pngs show 3-D glasses games: off, left, right, anaglyph or sidebyside")
+	opts := segmago.Options{}
+	flag.Var(&opts.TV, "tv", "tv standard: auto, ntsc or pal")
+	flag.Var(&opts.Region, "region", "console region: auto, japan or export")
+	flag.Var(&opts.VDP, "vdp", "vdp version: auto, sms1 or sms2")
+	flag.Var(&opts.Mapper, "mapper", "cart mapper: auto, sega, codemasters, korean, msx, 4pak, janggun, nemesis or eeprom")
+	flag.Var(&opts.Peripherals, "peripherals", "comma separated: none, phaser, paddle, sportspad, glasses")
+	flag.Var(&opts.Port1, "port1", "controller in port 1: auto, joypad, phaser, paddle, sportspad, md3, md6 or none")
+	flag.Var(&opts.Port2, "port2", "controller in port 2: auto, joypad, phaser, paddle, sportspad, md3, md6 or none")
+	flag.BoolVar(&opts.GGSMSMode, "ggsms", false, "run a GG cart in SMS mode")
+	flag.Var(&opts.Slot, "slot", "slot the cart is in when booting a bios: cart, card or expansion")
+	flag.IntVar(&opts.CartRAMSize, "cartram", 0, "cart RAM size in bytes (0 for auto)")
+	flag.BoolVar(&opts.IgnoreROMDB, "nodb", false, "don't apply settings from the built-in rom db")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	cartFilename := flag.Arg(0)
+
+	cart, err := ioutil.ReadFile(cartFilename)
+	dieIf(err)
+
+	bios := []byte{}
+	if *biosFilename != "" {
+		bios, err = ioutil.ReadFile(*biosFilename)
+		dieIf(err)
+	}
+
+	var script []inputChange
+	if *inputFilename != "" {
+		script, err = readInputScript(*inputFilename)
+		dieIf(err)
+	}
+
+	// the header knows best, the extension is for headerless carts
+	hasGGExt := strings.HasSuffix(cartFilename, ".gg")
+	smsHeaderInGG := false
+	if cartInfo, err := segmago.ParseCartHeader(cart); err == nil {
+		smsHeaderInGG = hasGGExt && !cartInfo.IsGameGear()
+		*isGG = *isGG || cartInfo.IsGameGear()
+	} else {
+		*isGG = *isGG || hasGGExt
+	}
+
+	dbGGSMSMode := false
+	if profile, ok := segmago.LookupROM(cart); ok && !opts.IgnoreROMDB {
+		dbGGSMSMode = profile.GGSMSMode
+	}
+	if smsHeaderInGG && !*isGG && !opts.GGSMSMode && !dbGGSMSMode {
+		fmt.Println("info: .gg file with an SMS header, running it on an SMS (-ggsms for the GG's SMS mode, -gg for a GG game)")
+	}
+	*isGG = *isGG || opts.GGSMSMode || dbGGSMSMode
+
+	var emu segmago.Emulator
+	if *isGG {
+		emu = segmago.NewEmulatorGGWithOptions(cart, bios, opts)
+	} else if strings.HasSuffix(cartFilename, ".sg") {
+		emu = segmago.NewEmulatorSG1000WithOptions(cart, opts)
+	} else if strings.HasSuffix(cartFilename, ".sc") {
+		emu = segmago.NewEmulatorSC3000WithOptions(cart, opts)
+	} else {
+		emu = segmago.NewEmulatorSMSWithOptions(cart, bios, opts)
+	}
+
+	emu.SetSampleRate(*sampleRate)
+
+	var audio []byte
+	var lastFrame segmago.FrameResult
+	var faultErr error
+
+	var dbg *segmago.Debugger
+	stdin := bufio.NewScanner(os.Stdin)
+	if *debugMode {
+		dbg = emu.Debugger()
+		dbg.Break()
+	}
+
+	input := segmago.Input{PhaserX: -1, PhaserY: -1}
+	for frame := 0; frame < *numFrames; {
+		if dbg != nil && dbg.Stopped() {
+			if quit := runDebugREPL(dbg, stdin, emu, stereoMode); quit {
+				break
+			}
+		}
+		for len(script) > 0 && script[0].frame <= frame {
+			input = script[0].input
+			script = script[1:]
+		}
+		lastFrame = emu.RunFrame(input)
+		audio = append(audio, lastFrame.Audio...)
+		if lastFrame.Err != nil {
+			faultErr = lastFrame.Err
+			fmt.Printf("fault on frame %d: %v\n", frame, faultErr)
+			if fault, ok := faultErr.(*segmago.EmuFault); ok && fault.Internal {
+				fmt.Println(fault.Stack)
+			}
+			break
+		}
+		// frames cut short by the debugger don't count
+		if dbg == nil || !dbg.Stopped() {
+			frame++
+		}
+	}
+
+	if *pngFilename != "" {
+		dieIf(writePNG(*pngFilename, emu, stereoMode))
+	}
+	if *wavFilename != "" {
+		dieIf(writeWAV(*wavFilename, audio, *sampleRate))
+	}
+	if *snapFilename != "" {
+		dieIf(ioutil.WriteFile(*snapFilename, emu.MakeSnapshot(), os.FileMode(0644)))
+	}
+
+	if faultErr != nil {
+		os.Exit(2)
+	}
+}
+
+// runDebugREPL reads debugger commands from stdin until the
+// emulator resumes, returning true if the user wants to quit
+func runDebugREPL(dbg *segmago.Debugger, stdin *bufio.Scanner, emu segmago.Emulator, stereoMode segmago.StereoMode) bool {
+	fmt.Println("debugger:", dbg.StopReason())
+	fmt.Print(dbg.ExecCommand("regs"))
+	for dbg.Stopped() {
+		fmt.Print("dbg> ")
+		if !stdin.Scan() {
+			return true
+		}
+		args := strings.Fields(stdin.Text())
+		switch {
+		case len(args) > 0 && (args[0] == "q" || args[0] == "quit"):
+			return true
+		case len(args) == 2 && args[0] == "screen":
+			if err := writePNG(args[1], emu, stereoMode); err != nil {
+				fmt.Println("error:", err)
+			}
+		default:
+			fmt.Print(dbg.ExecCommand(stdin.Text()))
+		}
+	}
+	return false
+}
+
+type inputChange struct {
+	frame int
+	input segmago.Input
+}
+
+func readInputScript(filename string) ([]inputChange, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	script := []inputChange{}
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		frame, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad frame number %q", filename, lineNum, fields[0])
+		}
+		change := inputChange{frame: frame}
+		change.input.PhaserX, change.input.PhaserY = -1, -1
+		for _, button := range fields[1:] {
+			if strings.HasPrefix(button, "paddle:") {
+				_, err := fmt.Sscanf(button[7:], "%d", &change.input.Joypad1.Paddle)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: bad paddle %q", filename, lineNum, button)
+				}
+				continue
+			}
+			if strings.HasPrefix(button, "aim:") {
+				_, err := fmt.Sscanf(button[4:], "%d,%d", &change.input.PhaserX, &change.input.PhaserY)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: bad aim %q", filename, lineNum, button)
+				}
+				continue
+			}
+			switch strings.ToLower(button) {
+			case "pause":
+				change.input.Pause = true
+				continue
+			case "reset":
+				change.input.Reset = true
+				continue
+			}
+			pad := &change.input.Joypad1
+			if strings.HasPrefix(button, "p2:") {
+				pad = &change.input.Joypad2
+				button = button[3:]
+			}
+			if !setButton(pad, button) {
+				return nil, fmt.Errorf("%s:%d: unknown button %q", filename, lineNum, button)
+			}
+		}
+		if len(script) > 0 && script[len(script)-1].frame > frame {
+			return nil, fmt.Errorf("%s:%d: frame numbers must not decrease", filename, lineNum)
+		}
+		script = append(script, change)
+	}
+	return script, scanner.Err()
+}
+
+func setButton(pad *segmago.Joypad, button string) bool {
+	switch strings.ToLower(button) {
+	case "up":
+		pad.Up = true
+	case "down":
+		pad.Down = true
+	case "left":
+		pad.Left = true
+	case "right":
+		pad.Right = true
+	case "a":
+		pad.A = true
+	case "b":
+		pad.B = true
+	case "start":
+		pad.Start = true
+	case "fire":
+		pad.Fire = true
+	case "c":
+		pad.C = true
+	case "x":
+		pad.X = true
+	case "y":
+		pad.Y = true
+	case "z":
+		pad.Z = true
+	case "mode":
+		pad.Mode = true
+	default:
+		return false
+	}
+	return true
+}
+
+func writePNG(filename string, emu segmago.Emulator, stereoMode segmago.StereoMode) error {
+	pix := emu.Framebuffer()
+	if left, right, ok := emu.Glasses3DFrames(); ok && stereoMode != segmago.StereoOff {
+		pix = segmago.StereoFramebuffer(stereoMode, left, right)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, len(pix)/(240*4), 240))
+	copy(img.Pix, pix)
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, buf.Bytes(), os.FileMode(0644))
+}
+
+// writeWAV expects the 16bit * 2ch format the emulator produces
+func writeWAV(filename string, samples []byte, sampleRate int) error {
+	const numChannels = 2
+	const bitsPerSample = 16
+
+	buf := &bytes.Buffer{}
+	w := func(v interface{}) { binary.Write(buf, binary.LittleEndian, v) }
+
+	buf.WriteString("RIFF")
+	w(uint32(36 + len(samples)))
+	buf.WriteString("WAVE")
+
+	buf.WriteString("fmt ")
+	w(uint32(16))
+	w(uint16(1)) // PCM
+	w(uint16(numChannels))
+	w(uint32(sampleRate))
+	w(uint32(sampleRate * numChannels * bitsPerSample / 8))
+	w(uint16(numChannels * bitsPerSample / 8))
+	w(uint16(bitsPerSample))
+
+	buf.WriteString("data")
+	w(uint32(len(samples)))
+	buf.Write(samples)
+
+	return ioutil.WriteFile(filename, buf.Bytes(), os.FileMode(0644))
+}
+
+func dieIf(err error) {
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
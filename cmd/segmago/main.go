@@ -1,15 +1,20 @@
 package main
 
 import (
+	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/theinternetftw/glimmer"
 	"github.com/theinternetftw/segmago"
+	"github.com/theinternetftw/segmago/disasm"
 	"github.com/theinternetftw/segmago/profiling"
 
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 )
@@ -18,12 +23,38 @@ func main() {
 
 	defer profiling.Start().Stop()
 
-	numArgs := len(os.Args)
-	assert(numArgs == 2 || numArgs == 3, "usage: ./segmago ROM_FILENAME [BIOS_FILENAME]")
-	cartFilename := os.Args[1]
+	gdbAddr := flag.String("gdb", "", "serve the gdb remote protocol on this addr (e.g. localhost:2159)")
+	linkListen := flag.String("linklisten", "", "wait for another segmago to link GGs with, on host:port or unix:/path")
+	linkDial := flag.String("linkdial", "", "link GGs with the segmago listening on host:port or unix:/path")
+	sampleRate := flag.Int("samplerate", 44100, "audio sample rate")
+	forceGG := flag.Bool("gg", false, "force game gear mode (default: based on the cart header, or the .gg extension)")
+	stereoMode := segmago.StereoOff
+	flag.Var(&stereoMode, "3d", "how to show 3-D glasses games: off, left, right, anaglyph or sidebyside")
+	opts := segmago.Options{}
+	flag.Var(&opts.TV, "tv", "tv standard: auto, ntsc or pal")
+	flag.Var(&opts.Region, "region", "console region: auto, japan or export")
+	flag.Var(&opts.VDP, "vdp", "vdp version: auto, sms1 or sms2")
+	flag.Var(&opts.Mapper, "mapper", "cart mapper: auto, sega, codemasters, korean, msx, 4pak, janggun, nemesis or eeprom")
+	flag.Var(&opts.Peripherals, "peripherals", "comma separated: none, phaser, paddle, sportspad, glasses")
+	flag.Var(&opts.Port1, "port1", "controller in port 1: auto, joypad, phaser, paddle, sportspad, md3, md6 or none")
+	flag.Var(&opts.Port2, "port2", "controller in port 2: auto, joypad, phaser, paddle, sportspad, md3, md6 or none")
+	flag.BoolVar(&opts.GGSMSMode, "ggsms", false, "run a GG cart in SMS mode")
+	flag.Var(&opts.Slot, "slot", "slot the cart is in when booting a bios: cart, card or expansion")
+	flag.IntVar(&opts.CartRAMSize, "cartram", 0, "cart RAM size in bytes (0 for auto)")
+	flag.BoolVar(&opts.IgnoreROMDB, "nodb", false, "don't apply settings from the built-in rom db")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: ./segmago [options] ROM_FILENAME [BIOS_FILENAME]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	numArgs := flag.NArg()
+	assert(numArgs == 1 || numArgs == 2, "usage: ./segmago [options] ROM_FILENAME [BIOS_FILENAME]")
+	cartFilename := flag.Arg(0)
 
 	// TODO: config file instead
 	devMode := fileExists("devmode")
+	opts.DevMode = devMode
 
 	var cart []byte
 	if cartFilename != "null" {
@@ -34,9 +65,9 @@ func main() {
 
 	bios := []byte{}
 	biosFilename := ""
-	if numArgs > 2 {
+	if numArgs > 1 {
 		var err error
-		biosFilename = os.Args[2]
+		biosFilename = flag.Arg(1)
 		bios, err = ioutil.ReadFile(biosFilename)
 		dieIf(err)
 	}
@@ -50,14 +81,83 @@ func main() {
 		strings.HasSuffix(cartFilename, ".vgz") ||
 		fileMagic == "Vgm "
 
+	windowTitle := "segmago - " + filepath.Base(cartFilename)
+
+	// the header knows best, the extension is for headerless carts
+	hasGGExt := strings.HasSuffix(cartFilename, ".gg")
+	isGG := *forceGG
+	smsHeaderInGG := false
+	if cartInfo, err := segmago.ParseCartHeader(cart); err == nil {
+		smsHeaderInGG = hasGGExt && !cartInfo.IsGameGear()
+		isGG = isGG || cartInfo.IsGameGear()
+		if title := cartInfo.Title(); title != "" {
+			windowTitle = "segmago - " + title
+		}
+		if !cartInfo.ChecksumOK {
+			fmt.Println("info: cart checksum mismatch")
+		}
+	} else {
+		isGG = isGG || hasGGExt
+	}
+
+	dbGGSMSMode := false
+	if profile, ok := segmago.LookupROM(cart); ok && !opts.IgnoreROMDB {
+		fmt.Println("rom db:", profile.Name)
+		if profile.Peripherals != 0 {
+			fmt.Println("rom db: this game wants:", profile.Peripherals)
+		}
+		dbGGSMSMode = profile.GGSMSMode
+	}
+
+	if smsHeaderInGG && !isGG && !opts.GGSMSMode && !dbGGSMSMode {
+		fmt.Println("info: .gg file with an SMS header, running it on an SMS (-ggsms for the GG's SMS mode, -gg for a GG game)")
+	}
+	isGG = isGG || opts.GGSMSMode || dbGGSMSMode
+
 	var emu segmago.Emulator
 	if isVGM {
 		emu = segmago.NewVgmPlayer(cart, devMode)
-	} else if strings.HasSuffix(cartFilename, ".gg") {
-		bios = []byte{} // no bios in gg yet
-		emu = segmago.NewEmulatorGG(cart, bios, devMode)
+	} else if strings.HasSuffix(cartFilename, ".sg") {
+		emu = segmago.NewEmulatorSG1000WithOptions(cart, opts)
+	} else if strings.HasSuffix(cartFilename, ".sc") {
+		emu = segmago.NewEmulatorSC3000WithOptions(cart, opts)
+	} else if isGG {
+		emu = segmago.NewEmulatorGGWithOptions(cart, bios, opts)
 	} else {
-		emu = segmago.NewEmulatorSMS(cart, bios, devMode)
+		emu = segmago.NewEmulatorSMSWithOptions(cart, bios, opts)
+	}
+
+	symFilename := strings.TrimSuffix(cartFilename, filepath.Ext(cartFilename)) + ".sym"
+	if fileExists(symFilename) {
+		if syms, err := disasm.LoadSymbolFile(symFilename); err == nil {
+			emu.SetSymbols(syms)
+			fmt.Println("loaded symbols!")
+		} else {
+			fmt.Println("could not load symbols", err)
+		}
+	}
+
+	if *linkListen != "" {
+		fmt.Println("waiting for the other GG on", *linkListen)
+		link, err := segmago.ListenLink(*linkListen)
+		dieIf(err)
+		emu.SetLink(link)
+		fmt.Println("linked!")
+	} else if *linkDial != "" {
+		link, err := segmago.DialLink(*linkDial)
+		dieIf(err)
+		emu.SetLink(link)
+		fmt.Println("linked!")
+	}
+
+	var gdbServer *segmago.GDBServer
+	if *gdbAddr != "" {
+		dbg := emu.Debugger()
+		assert(dbg != nil, "this kind of file can't be debugged")
+		var err error
+		gdbServer, err = dbg.ServeGDB(*gdbAddr)
+		dieIf(err)
+		fmt.Println("gdb server listening on", gdbServer.Addr())
 	}
 
 	gameName := cartFilename
@@ -65,27 +165,48 @@ func main() {
 		gameName = biosFilename
 	}
 
-	screenW := 256
+	screenW := stereoMode.Width()
 	screenH := 240
 
 	glimmer.InitDisplayLoop(glimmer.InitDisplayLoopOptions{
-		WindowTitle:  "segmago",
+		WindowTitle:  windowTitle,
 		WindowWidth:  screenW * 2,
 		WindowHeight: screenH * 2,
 		RenderWidth:  screenW,
 		RenderHeight: screenH,
 		InitCallback: func(sharedState *glimmer.WindowState) {
-			startEmu(gameName, sharedState, emu)
+			hasKeyboard := strings.HasSuffix(cartFilename, ".sc")
+			startEmu(gameName, sharedState, emu, gdbServer, hasKeyboard, stereoMode, *sampleRate)
 		},
+		UpdateCallback: updateMouse,
 	})
 }
 
+// mouseState is the mouse as of the window's last update.
+// Like the keys, it's only touched under the InputMutex.
+type mouseState struct {
+	X, Y int
+	Left bool
+}
+
+var mouse mouseState
+
+// updateMouse runs on the window's update loop, after
+// glimmer has taken its own snapshot of the keys
+func updateMouse(window *glimmer.WindowState) {
+	x, y := ebiten.CursorPosition()
+	left := ebiten.IsMouseButtonPressed(ebiten.MouseButtonLeft)
+	window.InputMutex.Lock()
+	mouse = mouseState{X: x, Y: y, Left: left}
+	window.InputMutex.Unlock()
+}
+
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
 	return !os.IsNotExist(err)
 }
 
-func startEmu(filename string, window *glimmer.WindowState, emu segmago.Emulator) {
+func startEmu(filename string, window *glimmer.WindowState, emu segmago.Emulator, gdbServer *segmago.GDBServer, hasKeyboard bool, stereoMode segmago.StereoMode, sampleRate int) {
 
 	snapshotPrefix := filename + ".snapshot"
 
@@ -112,11 +233,12 @@ func startEmu(filename string, window *glimmer.WindowState, emu segmago.Emulator
 
 	audio, audioErr := glimmer.OpenAudioBuffer(glimmer.OpenAudioBufferOptions{
 		OutputBufDuration: 25 * time.Millisecond,
-		SamplesPerSecond:  44100,
+		SamplesPerSecond:  sampleRate,
 		BitsPerSample:     16,
 		ChannelCount:      2,
 	})
 	dieIf(audioErr)
+	emu.SetSampleRate(sampleRate)
 	workingAudioBuffer := make([]byte, audio.GetPrevCallbackReadLen())
 	audioToGen := audio.GetPrevCallbackReadLen()
 
@@ -126,9 +248,17 @@ func startEmu(filename string, window *glimmer.WindowState, emu segmago.Emulator
 
 	newInput := segmago.Input{}
 
+	var lastMouseX, lastMouseY int
+	var softResetDown, hardResetDown bool
+	var softResetWasDown, hardResetWasDown bool
+	var channelKeysDown, channelKeysWereDown [4]bool
+	selectedChannel := 0
+
 	lastSaveTime := time.Now()
 	lastInputPollTime := time.Now()
 
+	stdin := bufio.NewScanner(os.Stdin)
+
 	for {
 		now := time.Now()
 
@@ -153,6 +283,62 @@ func startEmu(filename string, window *glimmer.WindowState, emu segmago.Emulator
 				newInput.Joypad1.A = cid(glimmer.KeyCodeJ)
 				newInput.Joypad1.B = cid(glimmer.KeyCodeK)
 				newInput.Joypad1.Start = cid(glimmer.KeyCodeY)
+
+				// the rest of a mega drive pad
+				newInput.Joypad1.C = cid(glimmer.KeyCodeL)
+				newInput.Joypad1.X = cid(glimmer.KeyCodeU)
+				newInput.Joypad1.Y = cid(glimmer.KeyCodeI)
+				newInput.Joypad1.Z = cid(glimmer.KeyCodeO)
+				newInput.Joypad1.Mode = cid(glimmer.KeyCodeT)
+
+				// the mouse is the light phaser, paddle or trackball
+				newInput.PhaserX, newInput.PhaserY = -1, -1
+				newInput.Joypad1.Fire = false
+				newInput.Joypad1.Paddle = 0
+				newInput.Joypad1.TrackballX, newInput.Joypad1.TrackballY = 0, 0
+				switch emu.Controller(0) {
+				case segmago.ControllerPhaser:
+					newInput.PhaserX, newInput.PhaserY = mouse.X, mouse.Y
+					newInput.Joypad1.Fire = mouse.Left
+				case segmago.ControllerPaddle:
+					newInput.Joypad1.Paddle = byte(clamp(mouse.X, 0, 255))
+					newInput.Joypad1.Fire = mouse.Left
+				case segmago.ControllerSportsPad:
+					newInput.Joypad1.TrackballX = mouse.X - lastMouseX
+					newInput.Joypad1.TrackballY = mouse.Y - lastMouseY
+					newInput.Joypad1.Fire = mouse.Left
+				}
+				lastMouseX, lastMouseY = mouse.X, mouse.Y
+
+				if !hasKeyboard {
+					newInput.Pause = cid(glimmer.KeyCodeEnter)
+					newInput.Reset = cid(glimmer.KeyCodeBackspace)
+				}
+				softResetDown = cid(glimmer.KeyCodeF5)
+				hardResetDown = cid(glimmer.KeyCodeF6)
+
+				// pick a sound channel, then mute or solo it
+				channelKeysDown = [4]bool{
+					cid(glimmer.KeyCodeF7), cid(glimmer.KeyCodeF8),
+					cid(glimmer.KeyCodeF9), cid(glimmer.KeyCodeF10),
+				}
+
+				if hasKeyboard {
+					newInput.Keys[segmago.KeyUp] = cid(glimmer.KeyCodeArrowUp)
+					newInput.Keys[segmago.KeyDown] = cid(glimmer.KeyCodeArrowDown)
+					newInput.Keys[segmago.KeyLeft] = cid(glimmer.KeyCodeArrowLeft)
+					newInput.Keys[segmago.KeyRight] = cid(glimmer.KeyCodeArrowRight)
+					newInput.Keys[segmago.KeyShift] = cid(glimmer.KeyCodeShiftLeft) || cid(glimmer.KeyCodeShiftRight)
+					newInput.Keys[segmago.KeyCtrl] = cid(glimmer.KeyCodeControlLeft) || cid(glimmer.KeyCodeControlRight)
+					newInput.Keys[segmago.KeyGraph] = cid(glimmer.KeyCodeAltLeft) || cid(glimmer.KeyCodeAltRight)
+					newInput.Keys[segmago.KeyFunc] = cid(glimmer.KeyCodeTab)
+					newInput.Keys[segmago.KeyEngDiers] = cid(glimmer.KeyCodeEnd)
+					newInput.Keys[segmago.KeyHomeClr] = cid(glimmer.KeyCodeHome)
+					newInput.Keys[segmago.KeyInsDel] = cid(glimmer.KeyCodeInsert)
+					newInput.Keys[segmago.KeyBreak] = cid(glimmer.KeyCodePause)
+					newInput.Keys[segmago.KeyPi] = cid(glimmer.KeyCodePageUp)
+					newInput.Keys[segmago.KeyYen] = cid(glimmer.KeyCodePageDown)
+				}
 			}
 			window.InputMutex.Unlock()
 
@@ -160,12 +346,50 @@ func startEmu(filename string, window *glimmer.WindowState, emu segmago.Emulator
 
 			emu.SetInput(newInput)
 
+			if softResetDown && !softResetWasDown {
+				fmt.Println("soft reset!")
+				emu.SoftReset()
+			}
+			if hardResetDown && !hardResetWasDown {
+				fmt.Println("hard reset!")
+				emu.HardReset()
+			}
+			softResetWasDown, hardResetWasDown = softResetDown, hardResetDown
+
+			if chans := emu.AudioChannels(); chans != nil {
+				pressed := func(i int) bool { return channelKeysDown[i] && !channelKeysWereDown[i] }
+				numChannels := chans.Len()
+				switch {
+				case pressed(0):
+					selectedChannel = (selectedChannel + numChannels - 1) % numChannels
+				case pressed(1):
+					selectedChannel = (selectedChannel + 1) % numChannels
+				case pressed(2):
+					chans.SetMute(selectedChannel, !chans.Muted(selectedChannel))
+				case pressed(3):
+					chans.SetSolo(selectedChannel, !chans.Soloed(selectedChannel))
+				}
+				if channelKeysDown != channelKeysWereDown && channelKeysDown != [4]bool{} {
+					fmt.Println("sound channel:", describeChannel(chans, selectedChannel))
+				}
+			}
+			channelKeysWereDown = channelKeysDown
+
 			for r := '0'; r <= '9'; r++ {
 				if newInput.Keys[r] {
 					numDown = r
 					break
 				}
 			}
+			if emu.InDevMode() && newInput.Keys['\\'] {
+				if dbg := emu.Debugger(); dbg != nil {
+					dbg.Break()
+				}
+			}
+			// typing on a keyboard shouldn't trigger snapshots
+			if hasKeyboard {
+				numDown = 'x'
+			}
 			if newInput.Keys['m'] {
 				snapshotMode = 'm'
 			} else if newInput.Keys['l'] {
@@ -201,7 +425,35 @@ func startEmu(filename string, window *glimmer.WindowState, emu segmago.Emulator
 			}
 		}
 
-		emu.Step()
+		if err := emu.StepErr(); err != nil {
+			// keep the faulted emu's last snapshot around for inspection
+			faultSnapFilename := snapshotPrefix + "-fault"
+			if writeErr := ioutil.WriteFile(faultSnapFilename, emu.MakeSnapshot(), os.FileMode(0644)); writeErr != nil {
+				fmt.Println("failed to write fault snapshot:", writeErr)
+			} else {
+				fmt.Println("wrote fault snapshot to", faultSnapFilename)
+			}
+			if fault, ok := err.(*segmago.EmuFault); ok && fault.Internal {
+				fmt.Println(fault.Stack)
+			}
+			emu = segmago.NewErrEmu(err.Error())
+		}
+
+		if gdbServer != nil {
+			gdbServer.Poll()
+		}
+
+		if gdbServer != nil || emu.InDevMode() {
+			if dbg := emu.AttachedDebugger(); dbg != nil && dbg.Stopped() {
+				if gdbServer != nil && gdbServer.Connected() {
+					// gdb will resume us, don't spin too hard meanwhile
+					time.Sleep(time.Millisecond)
+					continue
+				} else if emu.InDevMode() {
+					runDebugREPL(dbg, stdin)
+				}
+			}
+		}
 
 		if emu.GetSoundBufferUsed() >= audioToGen {
 			if cap(workingAudioBuffer) < audioToGen {
@@ -229,8 +481,17 @@ func startEmu(filename string, window *glimmer.WindowState, emu segmago.Emulator
 		}
 
 		if emu.FlipRequested() {
+			pix := emu.Framebuffer()
+			if stereoMode != segmago.StereoOff {
+				// games without the glasses show the same frame to both eyes
+				left, right, ok := emu.Glasses3DFrames()
+				if !ok {
+					left, right = pix, pix
+				}
+				pix = segmago.StereoFramebuffer(stereoMode, left, right)
+			}
 			window.RenderMutex.Lock()
-			copy(window.Pix, emu.Framebuffer())
+			copy(window.Pix, pix)
 			window.RenderMutex.Unlock()
 
 			audio.WaitForPlaybackIfAhead()
@@ -242,6 +503,44 @@ func startEmu(filename string, window *glimmer.WindowState, emu segmago.Emulator
 	}
 }
 
+// runDebugREPL reads debugger commands from stdin until the emulator resumes
+func runDebugREPL(dbg *segmago.Debugger, stdin *bufio.Scanner) {
+	fmt.Println("debugger:", dbg.StopReason())
+	fmt.Print(dbg.ExecCommand("regs"))
+	for dbg.Stopped() {
+		fmt.Print("dbg> ")
+		if !stdin.Scan() {
+			dbg.Continue()
+			return
+		}
+		line := strings.TrimSpace(stdin.Text())
+		if line == "q" || line == "quit" {
+			os.Exit(0)
+		}
+		fmt.Print(dbg.ExecCommand(line))
+	}
+}
+
+func describeChannel(chans *segmago.AudioChannels, ch int) string {
+	desc := segmago.AudioChannelName(ch)
+	if chans.Soloed(ch) {
+		desc += " (solo)"
+	} else if chans.Muted(ch) {
+		desc += " (muted)"
+	}
+	return desc
+}
+
+func clamp(i, min, max int) int {
+	if i < min {
+		return min
+	}
+	if i > max {
+		return max
+	}
+	return i
+}
+
 func dieIf(err error) {
 	if err != nil {
 		fmt.Println(err)
@@ -90,6 +90,24 @@ func (t *dbgTerminal) writeChar(char rune) {
 	}
 }
 
+// plotScope draws samples (-1 to 1) as a line of dots,
+// squeezed into the w*h box at pixel x, y
+func (t *dbgTerminal) plotScope(x, y, w, h int, samples []float32, bright byte) {
+	if len(samples) == 0 {
+		return
+	}
+	mid := float32(h-1) / 2
+	for i := 0; i < w; i++ {
+		val := samples[i*len(samples)/w]
+		py := y + int(mid-val*mid+0.5)
+		if py < y || py >= y+h || py >= t.h || x+i >= t.w {
+			continue
+		}
+		px := t.screen[(py*t.w+x+i)*4:]
+		px[0], px[1], px[2], px[3] = 0, bright, 0, 0xff
+	}
+}
+
 var dbgFont = map[rune][7 * 7]byte{
 	'0': {
 		1, 1, 1, 1, 1, 1, 1,
@@ -0,0 +1,322 @@
+package segmago
+
+import (
+	"fmt"
+
+	"github.com/theinternetftw/segmago/disasm"
+)
+
+// BreakKind is the type of event a Breakpoint stops on
+type BreakKind int
+
+// The kinds of breakpoints
+const (
+	BreakPC BreakKind = iota
+	BreakMemRead
+	BreakMemWrite
+	BreakPortIn
+	BreakPortOut
+	BreakVDPReg
+)
+
+var breakKindNames = []string{"pc", "read", "write", "in", "out", "vdpreg"}
+
+func (k BreakKind) String() string {
+	if int(k) < len(breakKindNames) {
+		return breakKindNames[k]
+	}
+	return fmt.Sprintf("BreakKind(%d)", int(k))
+}
+
+// Breakpoint is a single breakpoint or watchpoint. Start and End
+// are an inclusive range of addrs, ports, or VDP reg numbers.
+type Breakpoint struct {
+	ID      int
+	Kind    BreakKind
+	Bank    int // BreakPC only, -1 for any bank
+	Start   uint16
+	End     uint16
+	Enabled bool
+}
+
+func (bp *Breakpoint) matches(addr uint16) bool {
+	return bp.Enabled && addr >= bp.Start && addr <= bp.End
+}
+
+func (bp *Breakpoint) String() string {
+	numFmt := "%04x"
+	if bp.Kind == BreakPortIn || bp.Kind == BreakPortOut || bp.Kind == BreakVDPReg {
+		numFmt = "%02x"
+	}
+	where := fmt.Sprintf(numFmt, bp.Start)
+	if bp.End != bp.Start {
+		where += fmt.Sprintf("-"+numFmt, bp.End)
+	}
+	if bp.Kind == BreakPC && bp.Bank >= 0 {
+		where = fmt.Sprintf("%02x:%s", bp.Bank, where)
+	}
+	state := ""
+	if !bp.Enabled {
+		state = " (disabled)"
+	}
+	return fmt.Sprintf("%d: %s %s%s", bp.ID, bp.Kind, where, state)
+}
+
+// Debugger adds breakpoints, watchpoints and stepping to an
+// emulator. While the debugger is stopped, Step and RunFrame
+// do nothing, so frontends should check Stopped and drive the
+// debugger (e.g. with ExecCommand) until it resumes.
+type Debugger struct {
+	emu *emuState
+
+	breakpoints []*Breakpoint
+	nextID      int
+
+	stopped    bool
+	stopReason string
+
+	// the watchpoint behind the last stop, if any
+	hitWatch     *Breakpoint
+	hitWatchAddr uint16
+
+	// set on resume, so we don't re-hit the
+	// PC breakpoint we're currently stopped on
+	skipPCCheck bool
+
+	// PC of the instruction being stepped
+	stepPC uint16
+
+	stepsLeft int
+
+	steppingOver bool
+	stepOverPC   uint16
+	stepOverSP   uint16
+
+	steppingOut bool
+	stepOutSP   uint16
+	lastWasRet  bool
+}
+
+// Debugger returns the emulator's debugger, attaching one if needed
+func (emu *emuState) Debugger() *Debugger {
+	if emu.dbg == nil {
+		d := &Debugger{nextID: 1}
+		d.attach(emu)
+	}
+	return emu.dbg
+}
+
+// AttachedDebugger returns the emulator's debugger, or nil if none is attached
+func (emu *emuState) AttachedDebugger() *Debugger {
+	return emu.dbg
+}
+
+func (d *Debugger) attach(emu *emuState) {
+	d.emu = emu
+	emu.dbg = d
+}
+
+// Stopped returns if the debugger is holding the emulator
+func (d *Debugger) Stopped() bool { return d.stopped }
+
+// StopReason describes why the debugger last stopped
+func (d *Debugger) StopReason() string { return d.stopReason }
+
+// Break stops the emulator before the next instruction
+func (d *Debugger) Break() { d.stop("break requested") }
+
+// Continue resumes running
+func (d *Debugger) Continue() { d.resume() }
+
+// StepInto resumes for n instructions
+func (d *Debugger) StepInto(n int) {
+	if n < 1 {
+		n = 1
+	}
+	d.resume()
+	d.stepsLeft = n
+}
+
+// StepOver steps, but runs calls, rsts, and repeating
+// block ops to completion
+func (d *Debugger) StepOver() {
+	z := &d.emu.CPU
+	inst := disasm.Decode(z.peek, z.PC)
+	switch inst.Mnemonic {
+	case "CALL", "RST", "HALT", "LDIR", "LDDR", "CPIR", "CPDR", "INIR", "INDR", "OTIR", "OTDR":
+		d.resume()
+		d.steppingOver = true
+		d.stepOverPC = z.PC + inst.Len
+		d.stepOverSP = z.SP
+	default:
+		d.StepInto(1)
+	}
+}
+
+// StepOut runs until the current function returns
+func (d *Debugger) StepOut() {
+	d.resume()
+	d.steppingOut = true
+	d.stepOutSP = d.emu.CPU.SP
+}
+
+// AddBreakpoint adds a breakpoint. For BreakPC, bank selects the
+// cart rom bank (-1 for any), and is ignored for other kinds.
+func (d *Debugger) AddBreakpoint(kind BreakKind, bank int, start, end uint16) *Breakpoint {
+	if end < start {
+		end = start
+	}
+	if kind != BreakPC {
+		bank = -1
+	}
+	bp := &Breakpoint{
+		ID:      d.nextID,
+		Kind:    kind,
+		Bank:    bank,
+		Start:   start,
+		End:     end,
+		Enabled: true,
+	}
+	d.nextID++
+	d.breakpoints = append(d.breakpoints, bp)
+	return bp
+}
+
+// RemoveBreakpoint removes a breakpoint, returning false if id isn't found
+func (d *Debugger) RemoveBreakpoint(id int) bool {
+	for i, bp := range d.breakpoints {
+		if bp.ID == id {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Breakpoint returns the breakpoint with the given id, or nil
+func (d *Debugger) Breakpoint(id int) *Breakpoint {
+	for _, bp := range d.breakpoints {
+		if bp.ID == id {
+			return bp
+		}
+	}
+	return nil
+}
+
+// Breakpoints returns all current breakpoints
+func (d *Debugger) Breakpoints() []*Breakpoint {
+	return append([]*Breakpoint{}, d.breakpoints...)
+}
+
+// ReadMem reads mem as the cpu sees it, without tripping watchpoints
+func (d *Debugger) ReadMem(addr uint16) byte {
+	return d.emu.peek(addr)
+}
+
+// WriteMem writes mem as the cpu would (so mapper regs work),
+// without tripping watchpoints
+func (d *Debugger) WriteMem(addr uint16, val byte) {
+	d.emu.dbg = nil
+	d.emu.write(addr, val)
+	d.emu.dbg = d
+}
+
+func (d *Debugger) stop(reason string) {
+	d.stopped = true
+	d.stopReason = reason
+	d.hitWatch = nil
+	d.stepsLeft = 0
+	d.steppingOver = false
+	d.steppingOut = false
+}
+
+func (d *Debugger) resume() {
+	d.stopped = false
+	d.stopReason = ""
+	d.skipPCCheck = true
+	d.stepsLeft = 0
+	d.steppingOver = false
+	d.steppingOut = false
+}
+
+// beforeStep returns false if the step shouldn't run
+func (d *Debugger) beforeStep() bool {
+	if d.stopped {
+		return false
+	}
+	z := &d.emu.CPU
+	if d.skipPCCheck {
+		d.skipPCCheck = false
+	} else if !z.IsHalted {
+		if d.steppingOver && z.PC == d.stepOverPC && z.SP >= d.stepOverSP {
+			d.stop("step over complete")
+			return false
+		}
+		bank := d.emu.Mem.romBankForAddr(z.PC)
+		for _, bp := range d.breakpoints {
+			if bp.Kind == BreakPC && bp.matches(z.PC) && (bp.Bank < 0 || bp.Bank == bank) {
+				d.stop(fmt.Sprintf("breakpoint %d at %s", bp.ID, d.addrString(z.PC)))
+				return false
+			}
+		}
+	}
+	d.stepPC = z.PC
+	if d.steppingOut {
+		mnemonic := disasm.Decode(z.peek, z.PC).Mnemonic
+		d.lastWasRet = mnemonic == "RET" || mnemonic == "RETI" || mnemonic == "RETN"
+	}
+	return true
+}
+
+func (d *Debugger) afterStep() {
+	if d.stopped {
+		// a watchpoint hit mid-step
+		return
+	}
+	if d.steppingOut && d.lastWasRet && d.emu.CPU.SP > d.stepOutSP {
+		d.stop("step out complete")
+		return
+	}
+	if d.stepsLeft > 0 {
+		d.stepsLeft--
+		if d.stepsLeft == 0 {
+			d.stop("step complete")
+		}
+	}
+}
+
+func (d *Debugger) onAccess(kind BreakKind, addr uint16, val byte) {
+	for _, bp := range d.breakpoints {
+		if bp.Kind == kind && bp.matches(addr) {
+			where := fmt.Sprintf("port %02x", addr)
+			if kind == BreakMemRead || kind == BreakMemWrite {
+				where = d.addrString(addr)
+			}
+			d.stop(fmt.Sprintf("watchpoint %d: %s %s val %02x at PC %s",
+				bp.ID, kind, where, val, d.addrString(d.stepPC)))
+			d.hitWatch, d.hitWatchAddr = bp, addr
+			return
+		}
+	}
+}
+
+func (emu *emuState) onVDPRegWrite(regNum, val byte) {
+	if emu.dbg == nil {
+		return
+	}
+	for _, bp := range emu.dbg.breakpoints {
+		if bp.Kind == BreakVDPReg && bp.matches(uint16(regNum)) {
+			emu.dbg.stop(fmt.Sprintf("watchpoint %d: vdp reg %d = %02x at PC %s",
+				bp.ID, regNum, val, emu.dbg.addrString(emu.dbg.stepPC)))
+			return
+		}
+	}
+}
+
+func (d *Debugger) addrString(addr uint16) string {
+	str := fmt.Sprintf("%04x", addr)
+	if label, ok := d.emu.lookupSymbol(addr); ok {
+		str += " (" + label + ")"
+	}
+	return str
+}
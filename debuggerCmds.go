@@ -0,0 +1,299 @@
+package segmago
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/theinternetftw/segmago/disasm"
+)
+
+const debuggerHelp = `debugger commands:
+  c, continue                resume running
+  s, step [N]                step N instructions (default 1)
+  n, next                    step over calls, rsts and block repeats
+  finish, out                run until the current function returns
+  b, break ADDR              break when PC reaches ADDR
+  watch r|w|rw ADDR[-END]    break on mem reads and/or writes
+  port in|out|io PORT[-END]  break on io port access
+  vdpreg [REG[-END]]         break on vdp register writes (default: any)
+  l, list                    list breakpoints
+  d, delete ID               remove a breakpoint
+  enable ID, disable ID      toggle a breakpoint
+  r, regs                    show cpu state
+  dis [ADDR] [N]             disassemble N instructions (default: PC, 10)
+  x, mem ADDR [N]            dump N bytes of mem (default: 64)
+  banks                      show the current rom paging
+
+ADDR is hex (e.g. c000, $c000, 0xc000), a label from the symbol
+file, or for breakpoints, BANK:ADDR to only break in that rom bank.
+`
+
+// ExecCommand runs a single debugger command line, returning its
+// output. Check Stopped afterwards to see if the emulator resumed.
+func (d *Debugger) ExecCommand(line string) string {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return ""
+	}
+	out, err := d.execCommand(args[0], args[1:])
+	if err != nil {
+		return "error: " + err.Error() + "\n"
+	}
+	return out
+}
+
+func (d *Debugger) execCommand(cmd string, args []string) (string, error) {
+	z := &d.emu.CPU
+
+	switch cmd {
+	case "h", "help", "?":
+		return debuggerHelp, nil
+
+	case "c", "continue":
+		d.Continue()
+		return "", nil
+
+	case "s", "step":
+		n := 1
+		if len(args) > 0 {
+			var err error
+			if n, err = strconv.Atoi(args[0]); err != nil {
+				return "", fmt.Errorf("bad step count %q", args[0])
+			}
+		}
+		d.StepInto(n)
+		return "", nil
+
+	case "n", "next":
+		d.StepOver()
+		return "", nil
+
+	case "finish", "out":
+		d.StepOut()
+		return "", nil
+
+	case "b", "break":
+		if len(args) != 1 {
+			return "", fmt.Errorf("usage: break ADDR")
+		}
+		bank, addr, err := d.parseAddr(args[0], true)
+		if err != nil {
+			return "", err
+		}
+		bp := d.AddBreakpoint(BreakPC, bank, addr, addr)
+		return fmt.Sprintf("added %v\n", bp), nil
+
+	case "watch":
+		if len(args) != 2 {
+			return "", fmt.Errorf("usage: watch r|w|rw ADDR[-END]")
+		}
+		start, end, err := d.parseRange(args[1])
+		if err != nil {
+			return "", err
+		}
+		kinds := map[string][]BreakKind{
+			"r":  {BreakMemRead},
+			"w":  {BreakMemWrite},
+			"rw": {BreakMemRead, BreakMemWrite},
+		}
+		return d.addBreakpoints(kinds[args[0]], start, end, "usage: watch r|w|rw ADDR[-END]")
+
+	case "port":
+		if len(args) != 2 {
+			return "", fmt.Errorf("usage: port in|out|io PORT[-END]")
+		}
+		start, end, err := d.parseRange(args[1])
+		if err != nil {
+			return "", err
+		}
+		if end > 0xff {
+			return "", fmt.Errorf("ports only go up to ff")
+		}
+		kinds := map[string][]BreakKind{
+			"in":  {BreakPortIn},
+			"out": {BreakPortOut},
+			"io":  {BreakPortIn, BreakPortOut},
+		}
+		return d.addBreakpoints(kinds[args[0]], start, end, "usage: port in|out|io PORT[-END]")
+
+	case "vdpreg":
+		start, end := uint16(0), uint16(0x0f)
+		if len(args) > 0 {
+			var err error
+			if start, end, err = d.parseRange(args[0]); err != nil {
+				return "", err
+			}
+		}
+		bp := d.AddBreakpoint(BreakVDPReg, -1, start, end)
+		return fmt.Sprintf("added %v\n", bp), nil
+
+	case "l", "list":
+		if len(d.breakpoints) == 0 {
+			return "no breakpoints\n", nil
+		}
+		out := ""
+		for _, bp := range d.breakpoints {
+			out += bp.String() + "\n"
+		}
+		return out, nil
+
+	case "d", "delete", "enable", "disable":
+		if len(args) != 1 {
+			return "", fmt.Errorf("usage: %s ID", cmd)
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return "", fmt.Errorf("bad breakpoint id %q", args[0])
+		}
+		bp := d.Breakpoint(id)
+		if bp == nil {
+			return "", fmt.Errorf("no breakpoint %d", id)
+		}
+		switch cmd {
+		case "enable":
+			bp.Enabled = true
+		case "disable":
+			bp.Enabled = false
+		default:
+			d.RemoveBreakpoint(id)
+		}
+		return "", nil
+
+	case "r", "regs":
+		return z.debugStatusLine() + "\n", nil
+
+	case "dis":
+		addr, n := z.PC, 10
+		if len(args) > 0 {
+			var err error
+			if _, addr, err = d.parseAddr(args[0], false); err != nil {
+				return "", err
+			}
+		}
+		if len(args) > 1 {
+			var err error
+			if n, err = strconv.Atoi(args[1]); err != nil {
+				return "", fmt.Errorf("bad count %q", args[1])
+			}
+		}
+		out := ""
+		for i := 0; i < n; i++ {
+			if label, ok := d.emu.lookupSymbol(addr); ok {
+				out += label + ":\n"
+			}
+			inst := disasm.Decode(z.peek, addr)
+			marker := "  "
+			if addr == z.PC {
+				marker = "> "
+			}
+			out += fmt.Sprintf("%s%04x  %-12s  %s\n", marker, addr, inst.HexBytes(), inst.Format(d.emu.lookupSymbol))
+			addr += inst.Len
+		}
+		return out, nil
+
+	case "x", "mem":
+		if len(args) < 1 {
+			return "", fmt.Errorf("usage: mem ADDR [N]")
+		}
+		_, addr, err := d.parseAddr(args[0], false)
+		if err != nil {
+			return "", err
+		}
+		n := 64
+		if len(args) > 1 {
+			if n, err = strconv.Atoi(args[1]); err != nil {
+				return "", fmt.Errorf("bad count %q", args[1])
+			}
+		}
+		out := ""
+		for i := 0; i < n; i++ {
+			if i%16 == 0 {
+				if i > 0 {
+					out += "\n"
+				}
+				out += fmt.Sprintf("%04x:", addr+uint16(i))
+			}
+			out += fmt.Sprintf(" %02x", d.emu.peek(addr+uint16(i)))
+		}
+		return out + "\n", nil
+
+	case "banks":
+		m := &d.emu.Mem
+		s := m.selectedMem
+		name := map[int]string{0: "bios", 1: "cart", 2: "none"}[m.marshallSelectedMem()]
+		if m.GGBIOSEnabled {
+			name = "gg bios over cart"
+		}
+		return fmt.Sprintf("mem: %s (port 3e: %02x), mapper: %s\n", name, d.emu.MemControlReg, s.Mapper.describe()), nil
+	}
+
+	return "", fmt.Errorf("unknown command %q (try help)", cmd)
+}
+
+func (d *Debugger) addBreakpoints(kinds []BreakKind, start, end uint16, usage string) (string, error) {
+	if len(kinds) == 0 {
+		return "", fmt.Errorf("%s", usage)
+	}
+	out := ""
+	for _, kind := range kinds {
+		bp := d.AddBreakpoint(kind, -1, start, end)
+		out += fmt.Sprintf("added %v\n", bp)
+	}
+	return out, nil
+}
+
+// parseAddr parses hex, a label, or (if allowBank) BANK:ADDR
+func (d *Debugger) parseAddr(s string, allowBank bool) (int, uint16, error) {
+	if bank, addr, ok := d.emu.symbols.Find(s); ok {
+		if !allowBank {
+			bank = -1
+		}
+		return bank, addr, nil
+	}
+	bank := -1
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		if !allowBank {
+			return 0, 0, fmt.Errorf("bank not allowed here: %q", s)
+		}
+		b, err := strconv.ParseUint(s[:i], 16, 16)
+		if err != nil {
+			return 0, 0, fmt.Errorf("bad bank %q", s[:i])
+		}
+		bank = int(b)
+		s = s[i+1:]
+	}
+	addr, err := parseHex16(s)
+	if err != nil {
+		return 0, 0, err
+	}
+	return bank, addr, nil
+}
+
+func (d *Debugger) parseRange(s string) (uint16, uint16, error) {
+	parts := strings.SplitN(s, "-", 2)
+	_, start, err := d.parseAddr(parts[0], false)
+	if err != nil {
+		return 0, 0, err
+	}
+	end := start
+	if len(parts) > 1 {
+		if _, end, err = d.parseAddr(parts[1], false); err != nil {
+			return 0, 0, err
+		}
+	}
+	if end < start {
+		return 0, 0, fmt.Errorf("bad range %q", s)
+	}
+	return start, end, nil
+}
+
+func parseHex16(s string) (uint16, error) {
+	s = strings.TrimPrefix(s, "$")
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	val, err := strconv.ParseUint(s, 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("bad address %q", s)
+	}
+	return uint16(val), nil
+}
@@ -0,0 +1,559 @@
+// Package disasm decodes z80 instructions, including the
+// CB/DD/ED/FD/DDCB/FDCB prefixed sets, for display.
+package disasm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Inst is a single decoded instruction
+type Inst struct {
+	Addr     uint16
+	Len      uint16
+	Bytes    []byte
+	Mnemonic string
+	Operands []string
+
+	// Cycles is the cost if a branch is taken,
+	// CyclesNotTaken is the same as Cycles for non-branches
+	Cycles         int
+	CyclesNotTaken int
+
+	Undocumented bool
+
+	// Ref is an address the instruction refers to, e.g. a
+	// jump target, an (nn) operand, or a 16-bit immediate
+	Ref    uint16
+	HasRef bool
+
+	refOperand int
+	refFmt     string
+}
+
+// String formats the instruction without labels
+func (inst Inst) String() string {
+	return inst.Format(nil)
+}
+
+// Format formats the instruction, using lookup (if not nil)
+// to replace the referenced address with a label
+func (inst Inst) Format(lookup func(addr uint16) (string, bool)) string {
+	ops := inst.Operands
+	if inst.HasRef && lookup != nil {
+		if label, ok := lookup(inst.Ref); ok {
+			ops = append([]string{}, ops...)
+			ops[inst.refOperand] = fmt.Sprintf(inst.refFmt, label)
+		}
+	}
+	if len(ops) == 0 {
+		return inst.Mnemonic
+	}
+	return inst.Mnemonic + " " + strings.Join(ops, ",")
+}
+
+// HexBytes returns the instruction bytes as hex, e.g. "DD 21 00 C0"
+func (inst Inst) HexBytes() string {
+	parts := make([]string, len(inst.Bytes))
+	for i, b := range inst.Bytes {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, " ")
+}
+
+var (
+	regNames  = [8]string{"B", "C", "D", "E", "H", "L", "(HL)", "A"}
+	rpNames   = [4]string{"BC", "DE", "HL", "SP"}
+	rp2Names  = [4]string{"BC", "DE", "HL", "AF"}
+	ccNames   = [8]string{"NZ", "Z", "NC", "C", "PO", "PE", "P", "M"}
+	aluNames  = [8]string{"ADD", "ADC", "SUB", "SBC", "AND", "XOR", "OR", "CP"}
+	aluHasA   = [8]bool{true, true, false, true, false, false, false, false}
+	rotNames  = [8]string{"RLC", "RRC", "RL", "RR", "SLA", "SRA", "SLL", "SRL"}
+	accNames  = [8]string{"RLCA", "RRCA", "RLA", "RRA", "DAA", "CPL", "SCF", "CCF"}
+	imNames   = [8]string{"0", "0/1", "1", "2", "0", "0/1", "1", "2"}
+	blockOps  = [4][4]string{{"LDI", "CPI", "INI", "OUTI"}, {"LDD", "CPD", "IND", "OUTD"}, {"LDIR", "CPIR", "INIR", "OTIR"}, {"LDDR", "CPDR", "INDR", "OTDR"}}
+	indexRegs = map[byte]string{0xdd: "IX", 0xfd: "IY"}
+)
+
+type decoder struct {
+	read func(addr uint16) byte
+	inst Inst
+
+	// when decoding DD/FD ops
+	indexReg string
+	disp     int8
+}
+
+func (d *decoder) fetch() byte {
+	b := d.read(d.inst.Addr + d.inst.Len)
+	d.inst.Bytes = append(d.inst.Bytes, b)
+	d.inst.Len++
+	return b
+}
+
+func (d *decoder) fetch16() uint16 {
+	lo := d.fetch()
+	hi := d.fetch()
+	return uint16(lo) | uint16(hi)<<8
+}
+
+func (d *decoder) set(cycles int, mnemonic string, operands ...string) {
+	d.inst.Mnemonic = mnemonic
+	d.inst.Operands = operands
+	d.inst.Cycles = cycles
+	d.inst.CyclesNotTaken = cycles
+}
+
+func (d *decoder) branch(taken, notTaken int, mnemonic string, operands ...string) {
+	d.set(taken, mnemonic, operands...)
+	d.inst.CyclesNotTaken = notTaken
+}
+
+// ref marks operand opIdx as the address addr, formatted with fmtStr
+func (d *decoder) ref(opIdx int, fmtStr string, addr uint16) {
+	d.inst.Ref = addr
+	d.inst.HasRef = true
+	d.inst.refOperand = opIdx
+	d.inst.refFmt = fmtStr
+	d.inst.Operands[opIdx] = fmt.Sprintf(fmtStr, hex16(addr))
+}
+
+func hex8(b byte) string    { return fmt.Sprintf("$%02X", b) }
+func hex16(w uint16) string { return fmt.Sprintf("$%04X", w) }
+
+// Decode decodes the instruction at addr, using read to fetch bytes
+func Decode(read func(addr uint16) byte, addr uint16) Inst {
+	d := decoder{read: read, inst: Inst{Addr: addr}}
+
+	opcode := d.fetch()
+	switch opcode {
+	case 0xcb:
+		d.decodeCB()
+	case 0xed:
+		d.decodeED()
+	case 0xdd, 0xfd:
+		d.decodeIndex(opcode)
+	default:
+		d.decodeMain(opcode)
+	}
+	return d.inst
+}
+
+// reg returns the name of register r, substituting index
+// regs (and fetching the displacement) when needed
+func (d *decoder) reg(r byte) string {
+	if d.indexReg == "" {
+		return regNames[r]
+	}
+	switch r {
+	case 4:
+		return d.indexReg + "H"
+	case 5:
+		return d.indexReg + "L"
+	case 6:
+		return d.indexedHL()
+	}
+	return regNames[r]
+}
+
+func (d *decoder) indexedHL() string {
+	if d.disp < 0 {
+		return fmt.Sprintf("(%s-%s)", d.indexReg, hex8(byte(-int(d.disp))))
+	}
+	return fmt.Sprintf("(%s+%s)", d.indexReg, hex8(byte(d.disp)))
+}
+
+func (d *decoder) rp(p byte) string {
+	if p == 2 && d.indexReg != "" {
+		return d.indexReg
+	}
+	return rpNames[p]
+}
+
+func (d *decoder) rp2(p byte) string {
+	if p == 2 && d.indexReg != "" {
+		return d.indexReg
+	}
+	return rp2Names[p]
+}
+
+func (d *decoder) hl() string {
+	if d.indexReg != "" {
+		return d.indexReg
+	}
+	return "HL"
+}
+
+func (d *decoder) relTarget() uint16 {
+	disp := int8(d.fetch())
+	return d.inst.Addr + d.inst.Len + uint16(int16(disp))
+}
+
+func (d *decoder) decodeMain(opcode byte) {
+	x, y, z := opcode>>6, opcode>>3&7, opcode&7
+	p, q := y>>1, y&1
+
+	switch x {
+	case 0:
+		switch z {
+		case 0:
+			switch y {
+			case 0:
+				d.set(4, "NOP")
+			case 1:
+				d.set(4, "EX", "AF", "AF'")
+			case 2:
+				d.branch(13, 8, "DJNZ", "")
+				d.ref(0, "%s", d.relTarget())
+			case 3:
+				d.set(12, "JR", "")
+				d.ref(0, "%s", d.relTarget())
+			default:
+				d.branch(12, 7, "JR", ccNames[y-4], "")
+				d.ref(1, "%s", d.relTarget())
+			}
+		case 1:
+			if q == 0 {
+				d.set(10, "LD", d.rp(p), "")
+				d.ref(1, "%s", d.fetch16())
+			} else {
+				d.set(11, "ADD", d.hl(), d.rp(p))
+			}
+		case 2:
+			switch {
+			case q == 0 && p == 0:
+				d.set(7, "LD", "(BC)", "A")
+			case q == 0 && p == 1:
+				d.set(7, "LD", "(DE)", "A")
+			case q == 0 && p == 2:
+				d.set(16, "LD", "", d.hl())
+				d.ref(0, "(%s)", d.fetch16())
+			case q == 0 && p == 3:
+				d.set(13, "LD", "", "A")
+				d.ref(0, "(%s)", d.fetch16())
+			case q == 1 && p == 0:
+				d.set(7, "LD", "A", "(BC)")
+			case q == 1 && p == 1:
+				d.set(7, "LD", "A", "(DE)")
+			case q == 1 && p == 2:
+				d.set(16, "LD", d.hl(), "")
+				d.ref(1, "(%s)", d.fetch16())
+			case q == 1 && p == 3:
+				d.set(13, "LD", "A", "")
+				d.ref(1, "(%s)", d.fetch16())
+			}
+		case 3:
+			if q == 0 {
+				d.set(6, "INC", d.rp(p))
+			} else {
+				d.set(6, "DEC", d.rp(p))
+			}
+		case 4:
+			d.set(cyclesRorHL(y, 4, 11), "INC", d.reg(y))
+		case 5:
+			d.set(cyclesRorHL(y, 4, 11), "DEC", d.reg(y))
+		case 6:
+			r := d.reg(y)
+			d.set(cyclesRorHL(y, 7, 10), "LD", r, hex8(d.fetch()))
+		case 7:
+			d.set(4, accNames[y])
+		}
+
+	case 1:
+		if y == 6 && z == 6 {
+			d.set(4, "HALT")
+		} else if d.indexReg != "" && (y == 6 || z == 6) {
+			// with (ix+d), the other reg is never substituted
+			if y == 6 {
+				d.set(7, "LD", d.reg(6), regNames[z])
+			} else {
+				d.set(7, "LD", regNames[y], d.reg(6))
+			}
+		} else {
+			d.set(cyclesRorHL(y, 4, 7)+cyclesRorHL(z, 0, 3), "LD", d.reg(y), d.reg(z))
+		}
+
+	case 2:
+		d.alu(y, d.reg(z), cyclesRorHL(z, 4, 7))
+
+	case 3:
+		switch z {
+		case 0:
+			d.branch(11, 5, "RET", ccNames[y])
+		case 1:
+			if q == 0 {
+				d.set(10, "POP", d.rp2(p))
+			} else {
+				switch p {
+				case 0:
+					d.set(10, "RET")
+				case 1:
+					d.set(4, "EXX")
+				case 2:
+					d.set(4, "JP", "("+d.hl()+")")
+				case 3:
+					d.set(6, "LD", "SP", d.hl())
+				}
+			}
+		case 2:
+			d.set(10, "JP", ccNames[y], "")
+			d.ref(1, "%s", d.fetch16())
+		case 3:
+			switch y {
+			case 0:
+				d.set(10, "JP", "")
+				d.ref(0, "%s", d.fetch16())
+			case 2:
+				d.set(11, "OUT", "("+hex8(d.fetch())+")", "A")
+			case 3:
+				d.set(11, "IN", "A", "("+hex8(d.fetch())+")")
+			case 4:
+				d.set(19, "EX", "(SP)", d.hl())
+			case 5:
+				d.set(4, "EX", "DE", "HL")
+			case 6:
+				d.set(4, "DI")
+			case 7:
+				d.set(4, "EI")
+			}
+		case 4:
+			d.branch(17, 10, "CALL", ccNames[y], "")
+			d.ref(1, "%s", d.fetch16())
+		case 5:
+			if q == 0 {
+				d.set(11, "PUSH", d.rp2(p))
+			} else {
+				// p != 0 are prefixes, handled before we get here
+				d.set(17, "CALL", "")
+				d.ref(0, "%s", d.fetch16())
+			}
+		case 6:
+			d.alu(y, hex8(d.fetch()), 7)
+		case 7:
+			d.set(11, "RST", "")
+			d.ref(0, "%s", uint16(y)*8)
+			d.inst.Operands[0] = hex8(y * 8)
+		}
+	}
+}
+
+func cyclesRorHL(r byte, regCycles, hlCycles int) int {
+	if r == 6 {
+		return hlCycles
+	}
+	return regCycles
+}
+
+func (d *decoder) alu(y byte, operand string, cycles int) {
+	if aluHasA[y] {
+		d.set(cycles, aluNames[y], "A", operand)
+	} else {
+		d.set(cycles, aluNames[y], operand)
+	}
+}
+
+func (d *decoder) decodeCB() {
+	opcode := d.fetch()
+	x, y, z := opcode>>6, opcode>>3&7, opcode&7
+
+	switch x {
+	case 0:
+		d.set(cyclesRorHL(z, 8, 15), rotNames[y], regNames[z])
+		d.inst.Undocumented = y == 6
+	case 1:
+		d.set(cyclesRorHL(z, 8, 12), "BIT", fmt.Sprint(y), regNames[z])
+	case 2:
+		d.set(cyclesRorHL(z, 8, 15), "RES", fmt.Sprint(y), regNames[z])
+	case 3:
+		d.set(cyclesRorHL(z, 8, 15), "SET", fmt.Sprint(y), regNames[z])
+	}
+}
+
+func (d *decoder) decodeED() {
+	opcode := d.fetch()
+	x, y, z := opcode>>6, opcode>>3&7, opcode&7
+	p, q := y>>1, y&1
+
+	if x == 1 {
+		switch z {
+		case 0:
+			if y == 6 {
+				d.set(12, "IN", "F", "(C)")
+				d.inst.Undocumented = true
+			} else {
+				d.set(12, "IN", regNames[y], "(C)")
+			}
+		case 1:
+			if y == 6 {
+				d.set(12, "OUT", "(C)", "0")
+				d.inst.Undocumented = true
+			} else {
+				d.set(12, "OUT", "(C)", regNames[y])
+			}
+		case 2:
+			if q == 0 {
+				d.set(15, "SBC", "HL", rpNames[p])
+			} else {
+				d.set(15, "ADC", "HL", rpNames[p])
+			}
+		case 3:
+			if q == 0 {
+				d.set(20, "LD", "", rpNames[p])
+				d.ref(0, "(%s)", d.fetch16())
+			} else {
+				d.set(20, "LD", rpNames[p], "")
+				d.ref(1, "(%s)", d.fetch16())
+			}
+			d.inst.Undocumented = p == 2
+		case 4:
+			d.set(8, "NEG")
+			d.inst.Undocumented = y != 0
+		case 5:
+			if y == 1 {
+				d.set(14, "RETI")
+			} else {
+				d.set(14, "RETN")
+				d.inst.Undocumented = y != 0
+			}
+		case 6:
+			d.set(8, "IM", imNames[y])
+			d.inst.Undocumented = y&4 > 0 || y == 1
+		case 7:
+			switch y {
+			case 0:
+				d.set(9, "LD", "I", "A")
+			case 1:
+				d.set(9, "LD", "R", "A")
+			case 2:
+				d.set(9, "LD", "A", "I")
+			case 3:
+				d.set(9, "LD", "A", "R")
+			case 4:
+				d.set(18, "RRD")
+			case 5:
+				d.set(18, "RLD")
+			default:
+				d.set(8, "NOP")
+				d.inst.Undocumented = true
+			}
+		}
+		return
+	}
+
+	if x == 2 && y >= 4 && z <= 3 {
+		name := blockOps[y-4][z]
+		if y >= 6 {
+			d.branch(21, 16, name)
+		} else {
+			d.set(16, name)
+		}
+		return
+	}
+
+	d.set(8, "NOP")
+	d.inst.Undocumented = true
+}
+
+// usesHL reports if a non-prefixed opcode is changed by a DD/FD prefix
+func usesHL(opcode byte) bool {
+	x, y, z := opcode>>6, opcode>>3&7, opcode&7
+	switch x {
+	case 0:
+		switch z {
+		case 1, 3:
+			return y>>1 == 2 || z == 1 && y&1 == 1 // ld/inc/dec hl, add hl,rp
+		case 2:
+			return y>>1 == 2
+		case 4, 5, 6:
+			return y == 4 || y == 5 || y == 6
+		}
+		return false
+	case 1:
+		if y == 6 && z == 6 {
+			return false
+		}
+		return y == 4 || y == 5 || y == 6 || z == 4 || z == 5 || z == 6
+	case 2:
+		return z == 4 || z == 5 || z == 6
+	}
+	switch opcode {
+	case 0xcb, 0xe1, 0xe3, 0xe5, 0xe9, 0xf9:
+		return true
+	}
+	return false
+}
+
+func (d *decoder) decodeIndex(prefix byte) {
+	opcode := d.read(d.inst.Addr + 1)
+	if !usesHL(opcode) {
+		// the prefix acts as a lone 4-cycle nop
+		d.set(4, "DB", hex8(prefix))
+		d.inst.Undocumented = true
+		return
+	}
+
+	d.indexReg = indexRegs[prefix]
+	d.fetch()
+
+	if opcode == 0xcb {
+		d.decodeIndexCB()
+		return
+	}
+
+	x, y, z := opcode>>6, opcode>>3&7, opcode&7
+	usesDisp := (x == 0 && y == 6 && z >= 4 && z <= 6) ||
+		(x == 1 && (y == 6 || z == 6)) ||
+		(x == 2 && z == 6)
+	if usesDisp {
+		d.disp = int8(d.fetch())
+	}
+
+	d.decodeMain(opcode)
+
+	switch {
+	case usesDisp && x == 0 && z == 6:
+		d.inst.Cycles = 19 // ld (ix+d), n
+	case usesDisp && x == 0:
+		d.inst.Cycles = 23 // inc/dec (ix+d)
+	case usesDisp:
+		d.inst.Cycles = 19
+	case opcode == 0xe3:
+		d.inst.Cycles = 23
+	default:
+		d.inst.Cycles += 4
+	}
+	d.inst.CyclesNotTaken = d.inst.Cycles
+
+	if !usesDisp && (x == 1 || x == 2 || (x == 0 && z >= 4)) {
+		// ixh/ixl ops
+		d.inst.Undocumented = true
+	}
+}
+
+func (d *decoder) decodeIndexCB() {
+	d.disp = int8(d.fetch())
+	opcode := d.fetch()
+	x, y, z := opcode>>6, opcode>>3&7, opcode&7
+
+	target := d.indexedHL()
+	switch x {
+	case 0:
+		d.set(23, rotNames[y], target)
+	case 1:
+		d.set(20, "BIT", fmt.Sprint(y), target)
+		d.inst.Undocumented = z != 6
+		return
+	case 2:
+		d.set(23, "RES", fmt.Sprint(y), target)
+	case 3:
+		d.set(23, "SET", fmt.Sprint(y), target)
+	}
+	if z != 6 {
+		// result also copied to a reg, e.g. "LD B,RLC (IX+d)"
+		d.inst.Operands = []string{regNames[z], d.inst.Mnemonic + " " + strings.Join(d.inst.Operands, ",")}
+		d.inst.Mnemonic = "LD"
+		d.inst.Undocumented = true
+	} else if x == 0 && y == 6 {
+		d.inst.Undocumented = true
+	}
+}
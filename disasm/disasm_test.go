@@ -0,0 +1,189 @@
+package disasm
+
+import (
+	"strings"
+	"testing"
+)
+
+func decodeBytes(b []byte) Inst {
+	return Decode(func(addr uint16) byte {
+		if i := int(addr) - 0x100; i < len(b) {
+			return b[i]
+		}
+		return 0
+	}, 0x100)
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		bytes          []byte
+		text           string
+		cycles         int
+		cyclesNotTaken int
+		undocumented   bool
+	}{
+		// unprefixed
+		{[]byte{0x00}, "NOP", 4, 4, false},
+		{[]byte{0x3e, 0x42}, "LD A,$42", 7, 7, false},
+		{[]byte{0x21, 0x34, 0x12}, "LD HL,$1234", 10, 10, false},
+		{[]byte{0x32, 0x00, 0xc0}, "LD ($C000),A", 13, 13, false},
+		{[]byte{0x7e}, "LD A,(HL)", 7, 7, false},
+		{[]byte{0xdb, 0xdc}, "IN A,($DC)", 11, 11, false},
+		{[]byte{0xc3, 0x00, 0x80}, "JP $8000", 10, 10, false},
+		{[]byte{0x20, 0xfe}, "JR NZ,$0100", 12, 7, false},
+		{[]byte{0x10, 0xfe}, "DJNZ $0100", 13, 8, false},
+		{[]byte{0xcd, 0x00, 0x80}, "CALL $8000", 17, 17, false},
+		{[]byte{0xc4, 0x00, 0x80}, "CALL NZ,$8000", 17, 10, false},
+		{[]byte{0xc9}, "RET", 10, 10, false},
+		{[]byte{0xc0}, "RET NZ", 11, 5, false},
+
+		// CB
+		{[]byte{0xcb, 0x47}, "BIT 0,A", 8, 8, false},
+		{[]byte{0xcb, 0x46}, "BIT 0,(HL)", 12, 12, false},
+		{[]byte{0xcb, 0x06}, "RLC (HL)", 15, 15, false},
+		{[]byte{0xcb, 0xfe}, "SET 7,(HL)", 15, 15, false},
+		{[]byte{0xcb, 0x30}, "SLL B", 8, 8, true},
+
+		// ED
+		{[]byte{0xed, 0xb0}, "LDIR", 21, 16, false},
+		{[]byte{0xed, 0x56}, "IM 1", 8, 8, false},
+		{[]byte{0xed, 0x44}, "NEG", 8, 8, false},
+		{[]byte{0xed, 0x4b, 0x34, 0x12}, "LD BC,($1234)", 20, 20, false},
+		{[]byte{0xed, 0x78}, "IN A,(C)", 12, 12, false},
+		{[]byte{0xed, 0x4d}, "RETI", 14, 14, false},
+		{[]byte{0xed, 0x00}, "NOP", 8, 8, true},
+
+		// DD/FD
+		{[]byte{0xdd, 0x21, 0x00, 0xc0}, "LD IX,$C000", 14, 14, false},
+		{[]byte{0xdd, 0x7e, 0x05}, "LD A,(IX+$05)", 19, 19, false},
+		{[]byte{0xfd, 0x77, 0xfe}, "LD (IY-$02),A", 19, 19, false},
+		{[]byte{0xfd, 0x36, 0x01, 0x99}, "LD (IY+$01),$99", 19, 19, false},
+		{[]byte{0xdd, 0xe9}, "JP (IX)", 8, 8, false},
+		{[]byte{0xdd, 0x24}, "INC IXH", 8, 8, true},
+		{[]byte{0xdd}, "DB $DD", 4, 4, true}, // before a NOP it does nothing
+
+		// DDCB/FDCB
+		{[]byte{0xdd, 0xcb, 0x05, 0x46}, "BIT 0,(IX+$05)", 20, 20, false},
+		{[]byte{0xfd, 0xcb, 0xfe, 0x06}, "RLC (IY-$02)", 23, 23, false},
+		{[]byte{0xdd, 0xcb, 0x05, 0xc6}, "SET 0,(IX+$05)", 23, 23, false},
+		{[]byte{0xdd, 0xcb, 0x05, 0xc0}, "LD B,SET 0,(IX+$05)", 23, 23, true},
+	}
+	for _, tt := range tests {
+		inst := decodeBytes(tt.bytes)
+		if int(inst.Len) != len(tt.bytes) {
+			t.Errorf("% x: Len = %d, want %d", tt.bytes, inst.Len, len(tt.bytes))
+		}
+		if got := inst.String(); got != tt.text {
+			t.Errorf("% x: decoded as %q, want %q", tt.bytes, got, tt.text)
+		}
+		if inst.Cycles != tt.cycles || inst.CyclesNotTaken != tt.cyclesNotTaken {
+			t.Errorf("% x: cycles %d/%d, want %d/%d", tt.bytes, inst.Cycles, inst.CyclesNotTaken, tt.cycles, tt.cyclesNotTaken)
+		}
+		if inst.Undocumented != tt.undocumented {
+			t.Errorf("% x: Undocumented = %v, want %v", tt.bytes, inst.Undocumented, tt.undocumented)
+		}
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	labels := map[uint16]string{0x8000: "main", 0xc000: "score"}
+	lookup := func(addr uint16) (string, bool) {
+		label, ok := labels[addr]
+		return label, ok
+	}
+	tests := []struct {
+		bytes []byte
+		text  string
+	}{
+		{[]byte{0xc3, 0x00, 0x80}, "JP main"},
+		{[]byte{0xc4, 0x00, 0x80}, "CALL NZ,main"},
+		{[]byte{0x32, 0x00, 0xc0}, "LD (score),A"},
+		{[]byte{0xed, 0x4b, 0x00, 0xc0}, "LD BC,(score)"},
+		{[]byte{0x21, 0x34, 0x12}, "LD HL,$1234"}, // no label
+	}
+	for _, tt := range tests {
+		inst := decodeBytes(tt.bytes)
+		if got := inst.Format(lookup); got != tt.text {
+			t.Errorf("% x: formatted as %q, want %q", tt.bytes, got, tt.text)
+		}
+		if inst.Format(nil) != inst.String() {
+			t.Errorf("% x: Format(nil) isn't String()", tt.bytes)
+		}
+	}
+}
+
+type symCheck struct {
+	bank  int
+	addr  uint16
+	label string // "" for none
+}
+
+func checkSymbols(t *testing.T, syms *Symbols, wantLen int, checks []symCheck) {
+	t.Helper()
+	if syms.Len() != wantLen {
+		t.Errorf("loaded %d labels, want %d", syms.Len(), wantLen)
+	}
+	for _, c := range checks {
+		label, ok := syms.Lookup(c.bank, c.addr)
+		if label != c.label || ok != (c.label != "") {
+			t.Errorf("Lookup(%d, %04x) = %q, %v, want %q", c.bank, c.addr, label, ok, c.label)
+		}
+	}
+}
+
+func TestLoadSymbolFileWLADX(t *testing.T) {
+	syms, err := LoadSymbolFile("testdata/wladx.sym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSymbols(t, syms, 6, []symCheck{
+		{0, 0x0000, "boot"},
+		{0, 0x0038, "irq_handler"},
+		{2, 0x8000, "level_data"},
+		{3, 0x8000, "music_data"},
+		{4, 0x8000, ""}, // banked rom needs the right bank
+		{-1, 0xc000, "ram_start"},
+		{5, 0xc000, "ram_start"}, // ram is in every bank
+		{-1, 0x0010, ""},         // definitions aren't labels
+	})
+	if bank, addr, ok := syms.Find("level_data"); !ok || bank != 2 || addr != 0x8000 {
+		t.Errorf("Find(level_data) = %d, %04x, %v", bank, addr, ok)
+	}
+	if _, _, ok := syms.Find("PALETTE_SIZE"); ok {
+		t.Error("found a definition as a label")
+	}
+}
+
+func TestLoadSymbolFileNoSMS(t *testing.T) {
+	syms, err := LoadSymbolFile("testdata/nosms.sym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSymbols(t, syms, 4, []symCheck{
+		{-1, 0x0000, "reset_vector"}, // later labels win
+		{0, 0x0000, "reset_vector"},  // unbanked labels fit any bank
+		{7, 0x0038, "irq"},
+		{1, 0x4000, "bank1_start"},
+		{2, 0x4000, ""},
+		{-1, 0xdff0, "stack_top"},
+	})
+	if bank, addr, ok := syms.Find("reset"); !ok || bank != -1 || addr != 0 {
+		t.Errorf("Find(reset) = %d, %04x, %v", bank, addr, ok)
+	}
+}
+
+func TestParseSymbolsErrors(t *testing.T) {
+	for _, in := range []string{
+		"0000\n",
+		"zz:0000 label\n",
+		"00:wxyz label\n",
+		"[labels]\n12345 label\n",
+	} {
+		if _, err := ParseSymbols(strings.NewReader(in)); err == nil {
+			t.Errorf("%q parsed without an error", in)
+		}
+	}
+	if _, err := LoadSymbolFile("testdata/missing.sym"); err == nil {
+		t.Error("loading a missing file didn't give an error")
+	}
+}
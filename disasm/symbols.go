@@ -0,0 +1,142 @@
+package disasm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type bankAddr struct {
+	bank int
+	addr uint16
+}
+
+// Symbols maps banked addresses to labels
+type Symbols struct {
+	byBankAddr map[bankAddr]string
+	byAddr     map[uint16]string
+	byLabel    map[string]bankAddr
+}
+
+// NewSymbols returns an empty symbol table
+func NewSymbols() *Symbols {
+	return &Symbols{
+		byBankAddr: map[bankAddr]string{},
+		byAddr:     map[uint16]string{},
+		byLabel:    map[string]bankAddr{},
+	}
+}
+
+// Add adds a label. Later labels for the same address replace earlier ones.
+func (s *Symbols) Add(bank int, addr uint16, label string) {
+	s.byBankAddr[bankAddr{bank, addr}] = label
+	s.byAddr[addr] = label
+	s.byLabel[label] = bankAddr{bank, addr}
+}
+
+// Find returns the bank (-1 if none given) and address of a label
+func (s *Symbols) Find(label string) (int, uint16, bool) {
+	if s == nil {
+		return 0, 0, false
+	}
+	ba, ok := s.byLabel[label]
+	return ba.bank, ba.addr, ok
+}
+
+// Lookup finds the label for addr in the given bank. Pass
+// bank < 0 if the bank is unknown or doesn't matter (e.g. RAM).
+func (s *Symbols) Lookup(bank int, addr uint16) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	if bank >= 0 {
+		if label, ok := s.byBankAddr[bankAddr{bank, addr}]; ok {
+			return label, true
+		}
+		if label, ok := s.byBankAddr[bankAddr{-1, addr}]; ok {
+			return label, true
+		}
+		if addr < 0xc000 {
+			return "", false
+		}
+	}
+	label, ok := s.byAddr[addr]
+	return label, ok
+}
+
+// Len returns the number of labels
+func (s *Symbols) Len() int {
+	return len(s.byBankAddr)
+}
+
+// LoadSymbolFile reads a WLA-DX or no$sms style symbol file
+func LoadSymbolFile(filename string) (*Symbols, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseSymbols(f)
+}
+
+// ParseSymbols reads WLA-DX (.sym, "[labels]" section
+// with "BB:AAAA name" lines) or no$sms style ("BB:AAAA name"
+// or "AAAA name" lines, no sections) symbols.
+func ParseSymbols(r io.Reader) (*Symbols, error) {
+	syms := NewSymbols()
+
+	inLabels := true
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			inLabels = line == "[labels]"
+			continue
+		}
+		if !inLabels {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("symbols line %d: expected address and label", lineNum)
+		}
+		bank, addr, err := parseSymAddr(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("symbols line %d: %v", lineNum, err)
+		}
+		syms.Add(bank, addr, fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return syms, nil
+}
+
+func parseSymAddr(s string) (int, uint16, error) {
+	bank := -1
+	addrStr := s
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		b, err := strconv.ParseUint(s[:i], 16, 16)
+		if err != nil {
+			return 0, 0, fmt.Errorf("bad bank %q", s[:i])
+		}
+		bank = int(b)
+		addrStr = s[i+1:]
+	}
+	addr, err := strconv.ParseUint(addrStr, 16, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad address %q", addrStr)
+	}
+	return bank, uint16(addr), nil
+}
@@ -0,0 +1,205 @@
+package segmago
+
+import "fmt"
+
+// a few GG carts save to a 93C46 serial eeprom: 64 16-bit
+// words, kept in the first 128 bytes of CartRAM so saving
+// works like it does for battery ram
+const eepromSize = 128
+
+type eepromPhase int
+
+const (
+	eepromIdle    eepromPhase = iota // waiting for a start bit
+	eepromCmd                        // shifting in opcode and address
+	eepromReading                    // shifting out data
+	eepromWriting                    // shifting in data
+	eepromDone                       // waiting for CS to drop
+)
+
+// eeprom93c46 is the chip itself. The game bit-bangs it
+// through a single port: CS, CLK and DI in, DO out.
+type eeprom93c46 struct {
+	CS  bool
+	CLK bool
+	DI  bool
+	DO  bool
+
+	WriteEnabled bool
+
+	Phase   eepromPhase
+	Bits    uint16
+	NumBits int
+	Opcode  byte
+	Addr    byte
+	AllAddr bool // for WRAL
+}
+
+func (e *eeprom93c46) reset() {
+	e.Phase = eepromIdle
+	e.Bits, e.NumBits = 0, 0
+	e.DO = true // ready
+}
+
+// readPort gives DO back on bit 0, where DI went in
+func (e *eeprom93c46) readPort() byte {
+	return byteFromBools(false, false, false, false, false, e.CS, e.CLK, e.DO)
+}
+
+// writePort takes bit 0 as DI, bit 1 as CLK and bit 2 as CS
+func (e *eeprom93c46) writePort(s *storage, val byte) {
+	cs, clk, di := val&0x04 != 0, val&0x02 != 0, val&0x01 != 0
+	switch {
+	case !cs:
+		// dropping CS ends whatever was going on
+		e.reset()
+	case !e.CS:
+		e.reset()
+	case clk && !e.CLK:
+		e.clockIn(s, di)
+	}
+	e.CS, e.CLK, e.DI = cs, clk, di
+}
+
+func (e *eeprom93c46) clockIn(s *storage, di bool) {
+	bit := uint16(0)
+	if di {
+		bit = 1
+	}
+	switch e.Phase {
+	case eepromIdle:
+		if di {
+			e.Phase = eepromCmd
+			e.Bits, e.NumBits = 0, 0
+		}
+	case eepromCmd:
+		e.Bits = e.Bits<<1 | bit
+		e.NumBits++
+		if e.NumBits == 8 {
+			e.Opcode = byte(e.Bits>>6) & 3
+			e.Addr = byte(e.Bits) & 0x3f
+			e.runCmd(s)
+		}
+	case eepromReading:
+		// a dummy 0 came out with the last address bit,
+		// then the word MSB first, then on to the next word
+		e.DO = e.word(s, e.Addr)&(0x8000>>uint(e.NumBits)) != 0
+		e.NumBits++
+		if e.NumBits == 16 {
+			e.Addr = (e.Addr + 1) & 0x3f
+			e.NumBits = 0
+		}
+	case eepromWriting:
+		e.Bits = e.Bits<<1 | bit
+		e.NumBits++
+		if e.NumBits == 16 {
+			if e.AllAddr {
+				for i := byte(0); i < 64; i++ {
+					e.setWord(s, i, e.Bits)
+				}
+			} else {
+				e.setWord(s, e.Addr, e.Bits)
+			}
+			e.Phase = eepromDone
+			e.DO = true // writes finish instantly
+		}
+	}
+}
+
+func (e *eeprom93c46) runCmd(s *storage) {
+	e.Bits, e.NumBits = 0, 0
+	e.AllAddr = false
+	e.Phase = eepromDone
+	switch e.Opcode {
+	case 2: // READ
+		e.Phase = eepromReading
+		e.DO = false
+	case 1: // WRITE
+		e.Phase = eepromWriting
+	case 3: // ERASE
+		e.setWord(s, e.Addr, 0xffff)
+	case 0:
+		switch e.Addr >> 4 {
+		case 0: // EWDS
+			e.WriteEnabled = false
+		case 1: // WRAL
+			e.Phase = eepromWriting
+			e.AllAddr = true
+		case 2: // ERAL
+			for i := byte(0); i < 64; i++ {
+				e.setWord(s, i, 0xffff)
+			}
+		case 3: // EWEN
+			e.WriteEnabled = true
+		}
+	}
+}
+
+func (e *eeprom93c46) word(s *storage, addr byte) uint16 {
+	return uint16(s.CartRAM[addr*2]) | uint16(s.CartRAM[addr*2+1])<<8
+}
+
+func (e *eeprom93c46) setWord(s *storage, addr byte, val uint16) {
+	if !e.WriteEnabled {
+		return
+	}
+	s.writeCartRAM(uint32(addr)*2, byte(val))
+	s.writeCartRAM(uint32(addr)*2+1, byte(val>>8))
+}
+
+// eepromMapper is the sega mapper plus the eeprom, which
+// takes over the cart ram bits of 0xfffc: bit 7 resets
+// the eeprom, bit 3 maps its port over 0x8000-0xbfff
+type eepromMapper struct {
+	segaMapper
+
+	EEPROM        eeprom93c46
+	EEPROMEnabled bool
+}
+
+func (m *eepromMapper) Type() MapperType { return MapperSegaEEPROM }
+
+func (m *eepromMapper) reset(s *storage) {
+	m.segaMapper.reset(s)
+	m.EEPROM.reset()
+	s.useCartRAM(eepromSize)
+}
+
+func (m *eepromMapper) read(s *storage, addr uint16) byte {
+	if addr >= 0x8000 && m.EEPROMEnabled {
+		return m.EEPROM.readPort()
+	}
+	return m.segaMapper.read(s, addr)
+}
+
+func (m *eepromMapper) write(s *storage, addr uint16, val byte) {
+	if addr >= 0x8000 && m.EEPROMEnabled {
+		m.EEPROM.writePort(s, val)
+	}
+}
+
+func (m *eepromMapper) ctrlWrite(s *storage, addr uint16, val byte) {
+	if addr != 0xfffc {
+		m.segaMapper.ctrlWrite(s, addr, val)
+		return
+	}
+	if val&0x80 != 0 {
+		m.EEPROM.reset()
+	}
+	m.EEPROMEnabled = val&0x08 != 0
+}
+
+func (m *eepromMapper) romBankForAddr(s *storage, addr uint16) int {
+	if addr >= 0x8000 && m.EEPROMEnabled {
+		return -1
+	}
+	return m.segaMapper.romBankForAddr(s, addr)
+}
+
+func (m *eepromMapper) describe() string {
+	out := "eeprom " + m.segaMapper.describe()
+	if m.EEPROMEnabled {
+		out += fmt.Sprintf(" (eeprom at 8000, cs: %v, write enabled: %v)", m.EEPROM.CS, m.EEPROM.WriteEnabled)
+	}
+	return out
+}
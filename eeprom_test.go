@@ -0,0 +1,240 @@
+package segmago
+
+import "testing"
+
+// eepromDriver bit-bangs the eeprom the way a game does
+type eepromDriver struct {
+	e eeprom93c46
+	s storage
+}
+
+func newEEPROMDriver() *eepromDriver {
+	d := &eepromDriver{}
+	d.e.reset()
+	return d
+}
+
+func (d *eepromDriver) clock(di bool) {
+	val := byte(0x04)
+	if di {
+		val |= 0x01
+	}
+	d.e.writePort(&d.s, val)
+	d.e.writePort(&d.s, val|0x02)
+}
+
+func (d *eepromDriver) sendBits(val uint16, n int) {
+	for i := n - 1; i >= 0; i-- {
+		d.clock(val>>uint(i)&1 != 0)
+	}
+}
+
+// cmd selects the chip and sends a start bit, the opcode and the address
+func (d *eepromDriver) cmd(opcode, addr byte) {
+	d.e.writePort(&d.s, 0)
+	d.e.writePort(&d.s, 0x04)
+	d.clock(true)
+	d.sendBits(uint16(opcode)<<6|uint16(addr), 8)
+}
+
+func (d *eepromDriver) deselect() {
+	d.e.writePort(&d.s, 0)
+}
+
+func (d *eepromDriver) ewen() {
+	d.cmd(0, 0x30)
+	d.deselect()
+}
+
+func (d *eepromDriver) ewds() {
+	d.cmd(0, 0x00)
+	d.deselect()
+}
+
+func (d *eepromDriver) write(addr byte, val uint16) {
+	d.cmd(1, addr)
+	d.sendBits(val, 16)
+	d.deselect()
+}
+
+func (d *eepromDriver) wral(val uint16) {
+	d.cmd(0, 0x10)
+	d.sendBits(val, 16)
+	d.deselect()
+}
+
+func (d *eepromDriver) erase(addr byte) {
+	d.cmd(3, addr)
+	d.deselect()
+}
+
+func (d *eepromDriver) eral() {
+	d.cmd(0, 0x20)
+	d.deselect()
+}
+
+func (d *eepromDriver) readWords(addr byte, n int) []uint16 {
+	d.cmd(2, addr)
+	if d.e.readPort()&0x01 != 0 {
+		return nil // no dummy 0
+	}
+	words := make([]uint16, n)
+	for i := range words {
+		for b := 0; b < 16; b++ {
+			d.clock(false)
+			words[i] = words[i]<<1 | uint16(d.e.readPort()&0x01)
+		}
+	}
+	d.deselect()
+	return words
+}
+
+func TestEEPROM(t *testing.T) {
+	tests := []struct {
+		name     string
+		run      func(d *eepromDriver)
+		addr     byte
+		want     []uint16
+		modified bool
+	}{
+		{
+			name: "write without ewen is ignored",
+			run:  func(d *eepromDriver) { d.write(3, 0x1234) },
+			addr: 3,
+			want: []uint16{0},
+		},
+		{
+			name:     "ewen, write, read",
+			run:      func(d *eepromDriver) { d.ewen(); d.write(3, 0x1234) },
+			addr:     3,
+			want:     []uint16{0x1234},
+			modified: true,
+		},
+		{
+			name: "read runs on to the next words",
+			run: func(d *eepromDriver) {
+				d.ewen()
+				d.write(10, 0xbeef)
+				d.write(11, 0x8001)
+				d.write(12, 0x0ff0)
+			},
+			addr:     10,
+			want:     []uint16{0xbeef, 0x8001, 0x0ff0},
+			modified: true,
+		},
+		{
+			name: "read wraps at the last word",
+			run: func(d *eepromDriver) {
+				d.ewen()
+				d.write(63, 0xaaaa)
+				d.write(0, 0x5555)
+			},
+			addr:     63,
+			want:     []uint16{0xaaaa, 0x5555},
+			modified: true,
+		},
+		{
+			name:     "erase",
+			run:      func(d *eepromDriver) { d.ewen(); d.write(5, 0x1234); d.erase(5) },
+			addr:     5,
+			want:     []uint16{0xffff},
+			modified: true,
+		},
+		{
+			name:     "eral",
+			run:      func(d *eepromDriver) { d.ewen(); d.write(5, 0x1234); d.eral() },
+			addr:     4,
+			want:     []uint16{0xffff, 0xffff, 0xffff},
+			modified: true,
+		},
+		{
+			name:     "wral",
+			run:      func(d *eepromDriver) { d.ewen(); d.wral(0xc3a5) },
+			addr:     0,
+			want:     []uint16{0xc3a5, 0xc3a5},
+			modified: true,
+		},
+		{
+			name: "ewds stops writes",
+			run: func(d *eepromDriver) {
+				d.ewen()
+				d.write(7, 0x1111)
+				d.ewds()
+				d.write(7, 0x2222)
+			},
+			addr:     7,
+			want:     []uint16{0x1111},
+			modified: true,
+		},
+		{
+			name: "dropping cs mid-write cancels it",
+			run: func(d *eepromDriver) {
+				d.ewen()
+				d.cmd(1, 8)
+				d.sendBits(0xffff, 8)
+				d.deselect()
+			},
+			addr: 8,
+			want: []uint16{0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newEEPROMDriver()
+			tt.run(d)
+			if d.s.CartRAMModified != tt.modified {
+				t.Errorf("CartRAMModified = %v, want %v", d.s.CartRAMModified, tt.modified)
+			}
+			got := d.readWords(tt.addr, len(tt.want))
+			if len(got) != len(tt.want) {
+				t.Fatalf("read gave %04x, want %04x", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("read gave %04x, want %04x", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestEEPROMCartRAM(t *testing.T) {
+	d := newEEPROMDriver()
+	d.ewen()
+	d.write(2, 0xabcd)
+	if d.s.CartRAM[4] != 0xcd || d.s.CartRAM[5] != 0xab {
+		t.Errorf("word 2 stored as % x, want cd ab", d.s.CartRAM[4:6])
+	}
+
+	// and a word already in CartRAM (i.e. from a .sav) reads back
+	d.s.CartRAM[126], d.s.CartRAM[127] = 0x34, 0x12
+	if got := d.readWords(63, 1); len(got) != 1 || got[0] != 0x1234 {
+		t.Errorf("word 63 read as %04x, want 1234", got)
+	}
+}
+
+func TestEEPROMMapperPort(t *testing.T) {
+	s := &storage{}
+	s.init(make([]byte, 0x8000))
+	s.setMapperType(MapperSegaEEPROM)
+	m := s.Mapper.Mapper.(*eepromMapper)
+	m.EEPROM.WriteEnabled = true
+	m.EEPROM.setWord(s, 0, 0x8000)
+
+	// bit 3 of 0xfffc maps the port in
+	s.ctrlMapper(0xfffc, 0x08)
+	write := func(val byte) { s.Mapper.write(s, 0x8000, val) }
+	write(0x04)
+	for _, bit := range []byte{1, 1, 0, 0, 0, 0, 0, 0, 0} { // start, READ, addr 0
+		write(0x04 | bit)
+		write(0x06 | bit)
+	}
+	if s.read(0x8000)&0x01 != 0 {
+		t.Fatal("no dummy 0 before the data")
+	}
+	write(0x04)
+	write(0x06)
+	if got := s.read(0x8000); got != 0x07 {
+		t.Errorf("port read as %02x, want CS, CLK and DO (the word's top bit) set", got)
+	}
+}
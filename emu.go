@@ -1,17 +1,32 @@
 package segmago
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/theinternetftw/segmago/disasm"
+)
 
 // Emulator exposes the public facing fns for an emulation session
 type Emulator interface {
 	Step()
+	StepErr() error
+	Fault() error
+
+	RunFrame(input Input) FrameResult
 
 	Framebuffer() []byte
 	FlipRequested() bool
 
 	SetInput(input Input)
+
+	// SoftReset resets the cpu and cart, keeping all ram
+	SoftReset()
+	// HardReset power cycles, keeping only cart ram
+	HardReset()
 	ReadSoundBuffer([]byte)
 	GetSoundBufferUsed() int
+	// SetSampleRate sets the audio's rate (the default is 44100hz)
+	SetSampleRate(samplesPerSecond int)
 
 	MakeSnapshot() []byte
 	LoadSnapshot([]byte) (Emulator, error)
@@ -24,6 +39,28 @@ type Emulator interface {
 
 	InDevMode() bool
 	SetDevMode(b bool)
+
+	SetSymbols(syms *disasm.Symbols)
+
+	// Glasses3DFrames gives each eye's last frame if the
+	// game uses the 3-D glasses (see StereoFramebuffer)
+	Glasses3DFrames() (left, right []byte, ok bool)
+
+	// SetLink plugs a GG link cable in (nil unplugs it)
+	SetLink(link LinkTransport)
+
+	// AudioChannels mutes and watches each sound
+	// channel, or is nil if there's no sound
+	AudioChannels() *AudioChannels
+
+	// Debugger returns nil if debugging isn't supported
+	Debugger() *Debugger
+	// AttachedDebugger is like Debugger, but returns
+	// nil rather than attaching a new one
+	AttachedDebugger() *Debugger
+
+	// Controller says what's plugged into port 0 or 1
+	Controller(port int) ControllerType
 }
 
 func (emu *emuState) MakeSnapshot() []byte {
@@ -34,21 +71,103 @@ func (emu *emuState) LoadSnapshot(snapBytes []byte) (Emulator, error) {
 	return emu.loadSnapshot(snapBytes)
 }
 
-// NewEmulatorSMS creates a Sega Master System emulation session
+// NewEmulatorSMS creates a Sega Master System emulation session,
+// with region and TV standard detected from the cart header
 func NewEmulatorSMS(cart, bios []byte, devMode bool) Emulator {
-	return newState(cart, bios, devMode)
+	return NewEmulatorSMSWithOptions(cart, bios, Options{DevMode: devMode})
+}
+
+// NewEmulatorSMSWithOptions creates a Sega Master System emulation
+// session for the given console (anything left on auto is detected)
+func NewEmulatorSMSWithOptions(cart, bios []byte, opts Options) Emulator {
+	state := newState(cart, bios, opts)
+	state.powerOn = func() *emuState {
+		return NewEmulatorSMSWithOptions(cart, bios, opts).(*emuState)
+	}
+	return state
 }
 
 // NewEmulatorGG creates a Game Gear emulation session
 func NewEmulatorGG(cart, bios []byte, devMode bool) Emulator {
-	state := newState(cart, bios, devMode)
-	state.IsGameGear = true
+	return NewEmulatorGGWithOptions(cart, bios, Options{DevMode: devMode})
+}
+
+// NewEmulatorGGWithOptions creates a Game Gear emulation session for
+// the given console. Only Region matters much: the GG's lcd is NTSC.
+// GGSMSMode (or the ROM db) runs the GG in its SMS compatibility mode.
+func NewEmulatorGGWithOptions(cart, bios []byte, opts Options) Emulator {
+	opts = opts.withROMProfile(stripCopierHeader(cart))
+	opts.IgnoreROMDB = true // already applied
+	state := newState(cart, bios, opts)
+	state.VDP.IsSMS1 = false // the GG has its own VDP, sms2-like
+	if opts.GGSMSMode {
+		state.IsGGSMSMode = true
+		state.VDP.IsGGSMSMode = true
+	} else {
+		state.IsGameGear = true
+		state.VDP.IsGameGear = true
+	}
+
+	// just the built in pad, and nowhere for glasses
+	state.plugIn(0, ControllerJoypad)
+	state.plugIn(1, ControllerNone)
+	state.Glasses.connected = false
+
+	// the GG's bios only covers the first 1KB, with the cart under it
+	state.Mem.selectedMem = &state.Mem.CartStorage
+	state.setMemControlReg(state.MemControlReg)
+
+	state.powerOn = func() *emuState {
+		return NewEmulatorGGWithOptions(cart, bios, opts).(*emuState)
+	}
 	return state
 }
 
-// GetCartRAM returns the current state of external RAM
+// NewEmulatorSG1000 creates a Sega SG-1000 emulation session
+func NewEmulatorSG1000(cart []byte, devMode bool) Emulator {
+	return NewEmulatorSG1000WithOptions(cart, Options{DevMode: devMode})
+}
+
+// NewEmulatorSG1000WithOptions creates a Sega SG-1000 emulation
+// session for the given console (anything left on auto is detected)
+func NewEmulatorSG1000WithOptions(cart []byte, opts Options) Emulator {
+	state := newState(cart, []byte{}, opts)
+	state.IsSG1000 = true
+	state.VDP.initTMS9918()
+	state.SN76489.setVariant(psgSN76489AN)
+	state.powerOn = func() *emuState {
+		return NewEmulatorSG1000WithOptions(cart, opts).(*emuState)
+	}
+	return state
+}
+
+// NewEmulatorSC3000 creates a Sega SC-3000 emulation session.
+// Its keyboard is read from Input.Keys (see KeyShift and friends
+// for the keys that aren't ascii chars).
+func NewEmulatorSC3000(cart []byte, devMode bool) Emulator {
+	return NewEmulatorSC3000WithOptions(cart, Options{DevMode: devMode})
+}
+
+// NewEmulatorSC3000WithOptions creates a Sega SC-3000 emulation
+// session for the given console (anything left on auto is detected)
+func NewEmulatorSC3000WithOptions(cart []byte, opts Options) Emulator {
+	state := newState(cart, []byte{}, opts)
+	state.IsSG1000 = true
+	state.IsSC3000 = true
+	state.VDP.initTMS9918()
+	state.SN76489.setVariant(psgSN76489AN)
+	state.powerOn = func() *emuState {
+		return NewEmulatorSC3000WithOptions(cart, opts).(*emuState)
+	}
+	return state
+}
+
+// GetCartRAM returns the current state of external RAM. It's
+// only as big as the cart's RAM (or as much as the game has
+// used, if the cart isn't in the rom db), so may be empty.
 func (emu *emuState) GetCartRAM() []byte {
-	return emu.Mem.CartStorage.CartRAM[:]
+	s := &emu.Mem.CartStorage
+	return s.CartRAM[:s.cartRAMLen()]
 }
 
 // CartRAMActive returns if local RAM has been modified, and resets it to false
@@ -60,24 +179,47 @@ func (emu *emuState) CartRAMModified() bool {
 
 // SetCartRAM attempts to set the RAM, returning error if size not correct
 func (emu *emuState) SetCartRAM(ram []byte) error {
-	if len(emu.Mem.CartStorage.CartRAM) == len(ram) {
-		copy(emu.Mem.CartStorage.CartRAM[:], ram)
-		return nil
+	s := &emu.Mem.CartStorage
+	if s.CartRAMSize > 0 && len(ram) != s.CartRAMSize {
+		return fmt.Errorf("ram size mismatch")
+	}
+	if len(ram) > len(s.CartRAM) {
+		return fmt.Errorf("ram too big")
 	}
 	// TODO: better checks (e.g. real format, cart checksum, etc.)
-	return fmt.Errorf("ram size mismatch")
+	copy(s.CartRAM[:], ram)
+	s.useCartRAM(len(ram))
+	return nil
+}
+
+// SetSymbols sets the labels used in debug output
+func (emu *emuState) SetSymbols(syms *disasm.Symbols) {
+	emu.symbols = syms
+	emu.CPU.Labeler = emu.lookupSymbol
+}
+
+func (emu *emuState) lookupSymbol(addr uint16) (string, bool) {
+	return emu.symbols.Lookup(emu.Mem.romBankForAddr(addr), addr)
 }
 
 func (emu *emuState) IsPAL() bool {
 	return emu.VDP.TVType == tvPAL
 }
 
-// ReadSoundBuffer returns a 44100hz * 16bit * 2ch sound buffer.
-// A pre-sized buffer must be provided and will be assumed to be filled.
+// ReadSoundBuffer returns a 16bit * 2ch sound buffer, at 44100hz
+// unless changed by SetSampleRate. A pre-sized buffer must be
+// provided and will be assumed to be filled.
 func (emu *emuState) ReadSoundBuffer(toFill []byte) {
 	emu.SN76489.readSoundBuffer(toFill)
 }
 
+// SetSampleRate sets the rate ReadSoundBuffer and RunFrame give audio at
+func (emu *emuState) SetSampleRate(samplesPerSecond int) {
+	emu.SN76489.setRates(emu.clocksPerSecond(), samplesPerSecond)
+}
+
+func (emu *emuState) AudioChannels() *AudioChannels { return emu.channels }
+
 func (emu *emuState) GetSoundBufferUsed() int {
 	return int(emu.SN76489.buffer.size())
 }
@@ -89,8 +231,27 @@ func (emu *emuState) Framebuffer() []byte {
 
 func (emu *emuState) SetInput(input Input) {
 	emu.Input = input
+
+	// the pause button's NMI is edge triggered. A GG
+	// in SMS mode wires its Start button there too.
+	pause := input.Pause || (emu.IsGGSMSMode && input.Joypad1.Start)
+	if pause && !emu.PauseWasPressed && !emu.IsGameGear {
+		emu.CPU.NMI = true
+	}
+	emu.PauseWasPressed = pause
+
+	emu.ResetPressed = input.Reset
+
+	for port := range emu.Ports {
+		if s, ok := emu.Ports[port].portDevice.(*sportsPad); ok {
+			s.addMovement(emu.portInput(port))
+		}
+	}
 }
 
+func (emu *emuState) SoftReset() { emu.softReset() }
+func (emu *emuState) HardReset() { emu.hardReset() }
+
 // FlipRequested indicates if a draw request is pending
 func (emu *emuState) FlipRequested() bool {
 	req := emu.VDP.FlipRequested
@@ -98,7 +259,22 @@ func (emu *emuState) FlipRequested() bool {
 	return req
 }
 
-// Step steps the emulator one instruction
+// Step steps the emulator one instruction. If the emulated
+// hardware faults, the emulator halts (see Fault and StepErr)
 func (emu *emuState) Step() {
-	emu.step()
+	emu.stepErr()
+}
+
+// StepErr steps the emulator one instruction, returning
+// an *EmuFault if the emulator is (or just became) halted
+func (emu *emuState) StepErr() error {
+	return emu.stepErr()
+}
+
+// Fault returns the *EmuFault that halted the emulator, if any
+func (emu *emuState) Fault() error {
+	if emu.LastFault == nil {
+		return nil
+	}
+	return emu.LastFault
 }
@@ -3,6 +3,8 @@ package segmago
 import (
 	"fmt"
 	"os"
+
+	"github.com/theinternetftw/segmago/disasm"
 )
 
 type errEmu struct {
@@ -38,9 +40,23 @@ func (e *errEmu) LoadSnapshot([]byte) (Emulator, error) {
 func (e *errEmu) ReadSoundBuffer(toFill []byte) {}
 func (e *errEmu) GetSoundBufferUsed() int       { return 0 }
 func (e *errEmu) SetInput(input Input)          {}
+func (e *errEmu) SoftReset()                    {}
+func (e *errEmu) HardReset()                    {}
+func (e *errEmu) SetSymbols(*disasm.Symbols)    {}
+func (e *errEmu) Debugger() *Debugger           { return nil }
+func (e *errEmu) AttachedDebugger() *Debugger   { return nil }
+func (e *errEmu) Controller(int) ControllerType { return ControllerNone }
 func (e *errEmu) Step()                         {}
+func (e *errEmu) StepErr() error                { return nil }
+func (e *errEmu) Fault() error                  { return nil }
 
 func (e *errEmu) Framebuffer() []byte { return e.screen[:] }
+func (e *errEmu) Glasses3DFrames() ([]byte, []byte, bool) {
+	return nil, nil, false
+}
+func (e *errEmu) SetLink(LinkTransport)         {}
+func (e *errEmu) SetSampleRate(int)             {}
+func (e *errEmu) AudioChannels() *AudioChannels { return nil }
 func (e *errEmu) FlipRequested() bool {
 	result := e.flipRequested
 	e.flipRequested = false
@@ -0,0 +1,76 @@
+package segmago
+
+import "fmt"
+
+// EmuFault describes an emulated-hardware error that
+// halted the emulator. Once faulted, an Emulator stays
+// halted, but can still be inspected or snapshotted.
+type EmuFault struct {
+	Msg string
+
+	// Internal is set when it was a bug in segmago itself
+	// (a nil deref, an index out of range, etc.) rather than
+	// the game doing something illegal. Stack says where.
+	Internal bool
+	Stack    string
+
+	// CPU context, zero for non-CPU sessions (e.g. VGMs)
+	PC, SP                 uint16
+	AF, BC, DE, HL, IX, IY uint16
+	Steps                  uint32
+	CPUStatus              string
+
+	// VDP context
+	VCounter         byte
+	ScreenX, ScreenY uint16
+}
+
+func (f *EmuFault) Error() string {
+	kind := "emu fault"
+	if f.Internal {
+		kind = "internal emu error"
+	}
+	if f.CPUStatus == "" {
+		return kind + ": " + f.Msg
+	}
+	return fmt.Sprintf("%s: %s\n%s\n[VDP ScreenX:%d ScreenY:%d VCounter:%02x]",
+		kind, f.Msg, f.CPUStatus, f.ScreenX, f.ScreenY, f.VCounter)
+}
+
+// emuErr is panicked by the internal error helpers
+// and turned into an EmuFault by stepErr
+type emuErr string
+
+func (e emuErr) Error() string { return string(e) }
+
+func (emu *emuState) makeFault(msg string) *EmuFault {
+	z := &emu.CPU
+	return &EmuFault{
+		Msg:       msg,
+		PC:        z.PC,
+		SP:        z.SP,
+		AF:        z.getAF(),
+		BC:        z.getBC(),
+		DE:        z.getDE(),
+		HL:        z.getHL(),
+		IX:        z.IX,
+		IY:        z.IY,
+		Steps:     z.Steps,
+		CPUStatus: z.safeDebugStatusLine(),
+		VCounter:  emu.VDP.VCounter,
+		ScreenX:   emu.VDP.ScreenX,
+		ScreenY:   emu.VDP.ScreenY,
+	}
+}
+
+// safeDebugStatusLine reads mem to build the status line,
+// so make sure a second fault there can't escape
+func (z *z80) safeDebugStatusLine() (line string) {
+	defer func() {
+		if r := recover(); r != nil {
+			line = fmt.Sprintf("[PC:%04x SP:%04x AF:%04x BC:%04x DE:%04x HL:%04x IX:%04x IY:%04x]",
+				z.PC, z.SP, z.getAF(), z.getBC(), z.getDE(), z.getHL(), z.IX, z.IY)
+		}
+	}()
+	return z.debugStatusLine()
+}
@@ -0,0 +1,54 @@
+package segmago
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStepErrFaults(t *testing.T) {
+	tests := []struct {
+		name      string
+		runCycles func(uint32)
+		internal  bool
+	}{
+		{"emulated hardware error", func(uint32) { errOut("bad thing") }, false},
+		{"runtime error", func(uint32) {
+			var ram []byte
+			ram[5] = 1
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			emu := NewEmulatorSMS(make([]byte, 0x8000), nil, false).(*emuState)
+			emu.CPU.RunCycles = tt.runCycles
+
+			err := emu.StepErr()
+			fault, ok := err.(*EmuFault)
+			if !ok {
+				t.Fatalf("StepErr gave %v, want an *EmuFault", err)
+			}
+			if fault.Internal != tt.internal {
+				t.Errorf("Internal = %v, want %v", fault.Internal, tt.internal)
+			}
+			if tt.internal && !strings.Contains(fault.Stack, "TestStepErrFaults") {
+				t.Errorf("stack doesn't show where it happened:\n%s", fault.Stack)
+			}
+			if !tt.internal && fault.Stack != "" {
+				t.Error("emulated hardware error came with a stack")
+			}
+			if emu.StepErr() != err {
+				t.Error("emulator didn't stay faulted")
+			}
+		})
+	}
+
+	// anything else isn't ours to recover
+	emu := NewEmulatorSMS(make([]byte, 0x8000), nil, false).(*emuState)
+	emu.CPU.RunCycles = func(uint32) { panic("not an error") }
+	defer func() {
+		if recover() == nil {
+			t.Error("a non-error panic was recovered")
+		}
+	}()
+	emu.StepErr()
+}
@@ -0,0 +1,73 @@
+package segmago
+
+// FrameResult holds everything produced by one RunFrame call
+type FrameResult struct {
+	// Framebuffer is a copy of the screen at the end of the frame
+	Framebuffer []byte
+	// Audio holds the samples generated during the frame,
+	// in the same 16bit * 2ch format as ReadSoundBuffer
+	Audio []byte
+	// Cycles is the number of CPU cycles the frame took
+	Cycles uint32
+	// Err is set if the emulator faulted (see StepErr)
+	Err error
+}
+
+// RunFrame sets the input, then steps until the VDP requests a
+// flip (or the debugger stops, in which case the frame is partial)
+func (emu *emuState) RunFrame(input Input) FrameResult {
+	emu.SetInput(input)
+
+	// the frame's samples skip the sound buffer, leaving
+	// anything already there for ReadSoundBuffer
+	emu.SN76489.startCapture()
+	emu.VDP.FlipRequested = false
+
+	startCycles := emu.Cycles
+	var err error
+	for !emu.VDP.FlipRequested {
+		if err = emu.stepErr(); err != nil {
+			break
+		}
+		if emu.dbg != nil && emu.dbg.stopped {
+			break
+		}
+	}
+	emu.VDP.FlipRequested = false
+
+	return FrameResult{
+		Framebuffer: append([]byte(nil), emu.Framebuffer()...),
+		Audio:       emu.SN76489.stopCapture(),
+		Cycles:      emu.Cycles - startCycles,
+		Err:         err,
+	}
+}
+
+// RunFrame for VGMs runs one frame's worth of cycles
+func (vp *vgmPlayer) RunFrame(input Input) FrameResult {
+	vp.SetInput(input)
+
+	vp.SN76489.startCapture()
+
+	startCycles := vp.Cycles
+	// paused or faulted players never reach a flip
+	for !vp.Paused && vp.LastFault == nil && !vp.FlipRequested() {
+		vp.Step()
+	}
+
+	return FrameResult{
+		Framebuffer: append([]byte(nil), vp.Framebuffer()...),
+		Audio:       vp.SN76489.stopCapture(),
+		Cycles:      uint32(vp.Cycles - startCycles),
+		Err:         vp.Fault(),
+	}
+}
+
+// RunFrame for errEmu just returns the error screen
+func (e *errEmu) RunFrame(input Input) FrameResult {
+	e.flipRequested = false
+	return FrameResult{
+		Framebuffer: append([]byte(nil), e.screen[:]...),
+		Audio:       []byte{},
+	}
+}
@@ -0,0 +1,51 @@
+package segmago
+
+import "testing"
+
+func TestRunFrameAudio(t *testing.T) {
+	// the top rate makes more than the sound buffer holds each frame
+	for _, rate := range []int{44100, 48000, 192000, 1000000} {
+		emu := NewEmulatorSMS(make([]byte, 0x8000), nil, false).(*emuState)
+		emu.SetSampleRate(rate)
+		emu.RunFrame(Input{})
+
+		for frame := 0; frame < 3; frame++ {
+			res := emu.RunFrame(Input{})
+			if res.Err != nil {
+				t.Fatal(res.Err)
+			}
+			// samples come out a PSG tick at a time
+			samplesPerClock := float64(rate) / float64(emu.clocksPerSecond())
+			slack := samplesPerClock*float64(emu.SN76489.variant.Divider) + 1
+			want := float64(res.Cycles) * samplesPerClock
+			got := float64(len(res.Audio) / 4)
+			if got < want-slack || got > want+slack {
+				t.Errorf("at %dHz, a %d cycle frame gave %v samples, want about %.1f", rate, res.Cycles, got, want)
+			}
+			if emu.SN76489.buffer.size() != 0 {
+				t.Errorf("at %dHz, RunFrame left %d bytes in the sound buffer", rate, emu.SN76489.buffer.size())
+			}
+		}
+	}
+}
+
+func TestRunFrameKeepsBufferedAudio(t *testing.T) {
+	emu := NewEmulatorSMS(make([]byte, 0x8000), nil, false).(*emuState)
+	for i := 0; i < 1000; i++ {
+		emu.Step()
+	}
+	buffered := emu.SN76489.buffer.size()
+	if buffered == 0 {
+		t.Fatal("stepping didn't buffer any audio")
+	}
+
+	emu.RunFrame(Input{})
+	if got := emu.SN76489.buffer.size(); got != buffered {
+		t.Fatalf("RunFrame left %d bytes in the sound buffer, want the %d already there", got, buffered)
+	}
+	toFill := make([]byte, buffered)
+	emu.ReadSoundBuffer(toFill)
+	if got := emu.SN76489.buffer.size(); got != 0 {
+		t.Fatalf("%d bytes left after reading them all", got)
+	}
+}
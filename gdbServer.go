@@ -0,0 +1,545 @@
+package segmago
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// GDBServer speaks the gdb remote serial protocol over tcp,
+// driving the emulator through its Debugger. The network side
+// runs in its own goroutines, but all emulator access happens
+// in Poll, so call it regularly from the loop that steps the
+// emulator (including while the debugger is stopped).
+type GDBServer struct {
+	dbg      *Debugger
+	listener net.Listener
+	events   chan gdbEvent
+
+	conn *gdbConn
+
+	// a c or s is in flight, so a stop reply is owed
+	running bool
+
+	// gdb's breakpoints, keyed by "type,addr,kind"
+	breakpoints map[string][]int
+}
+
+type gdbEvent struct {
+	conn   *gdbConn
+	packet string
+	opened bool
+	closed bool
+}
+
+type gdbConn struct {
+	net.Conn
+	mutex sync.Mutex
+	noAck bool
+}
+
+// the register order gdb's z80 target expects, 16 bits each
+const gdbNumRegs = 13
+
+// ServeGDB starts listening on addr (e.g. "localhost:2159") for
+// a gdb client. Only one client is served at a time, and a new
+// connection replaces the old one.
+func (d *Debugger) ServeGDB(addr string) (*GDBServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &GDBServer{
+		dbg:         d,
+		listener:    listener,
+		events:      make(chan gdbEvent, 64),
+		breakpoints: map[string][]int{},
+	}
+	go s.acceptLoop()
+	return s, nil
+}
+
+// Addr returns the address the server is listening on
+func (s *GDBServer) Addr() net.Addr { return s.listener.Addr() }
+
+// Connected returns if a gdb client is attached. While one is,
+// frontends should leave resuming the debugger to it.
+func (s *GDBServer) Connected() bool { return s.conn != nil }
+
+// Close stops listening and drops any client
+func (s *GDBServer) Close() error {
+	if s.conn != nil {
+		s.dropConn()
+	}
+	return s.listener.Close()
+}
+
+// Poll handles any pending gdb packets, and tells gdb
+// if the emulator stopped since the last Poll
+func (s *GDBServer) Poll() {
+	for polling := true; polling; {
+		select {
+		case ev := <-s.events:
+			s.handleEvent(ev)
+		default:
+			polling = false
+		}
+	}
+	if s.conn != nil && s.running {
+		if s.dbg.emu.LastFault != nil {
+			s.running = false
+			s.send("S0b") // SIGSEGV
+		} else if s.dbg.Stopped() {
+			s.running = false
+			s.send(s.stopReply())
+		}
+	}
+}
+
+func (s *GDBServer) acceptLoop() {
+	for {
+		netConn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		conn := &gdbConn{Conn: netConn}
+		s.events <- gdbEvent{conn: conn, opened: true}
+		go s.readLoop(conn)
+	}
+}
+
+// readLoop splits the byte stream into packets and acks them
+func (s *GDBServer) readLoop(conn *gdbConn) {
+	defer func() { s.events <- gdbEvent{conn: conn, closed: true} }()
+
+	r := bufio.NewReader(conn)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		switch b {
+		case 0x03:
+			s.events <- gdbEvent{conn: conn, packet: "\x03"}
+		case '$':
+			packet, err := r.ReadString('#')
+			if err != nil {
+				return
+			}
+			packet = packet[:len(packet)-1]
+			sum := make([]byte, 2)
+			if _, err := io.ReadFull(r, sum); err != nil {
+				return
+			}
+			conn.mutex.Lock()
+			noAck := conn.noAck
+			conn.mutex.Unlock()
+			if !noAck {
+				if want, err := strconv.ParseUint(string(sum), 16, 8); err != nil || byte(want) != gdbChecksum(packet) {
+					conn.write("-")
+					continue
+				}
+				conn.write("+")
+			}
+			s.events <- gdbEvent{conn: conn, packet: gdbUnescape(packet)}
+		}
+		// acks from gdb ('+'/'-') are ignored, we never resend
+	}
+}
+
+func (c *gdbConn) write(str string) {
+	c.mutex.Lock()
+	c.Write([]byte(str))
+	c.mutex.Unlock()
+}
+
+func (s *GDBServer) send(packet string) {
+	s.conn.write(fmt.Sprintf("$%s#%02x", packet, gdbChecksum(packet)))
+}
+
+func gdbChecksum(packet string) byte {
+	sum := byte(0)
+	for i := 0; i < len(packet); i++ {
+		sum += packet[i]
+	}
+	return sum
+}
+
+func gdbUnescape(packet string) string {
+	if !strings.Contains(packet, "}") {
+		return packet
+	}
+	out := []byte{}
+	for i := 0; i < len(packet); i++ {
+		if packet[i] == '}' && i+1 < len(packet) {
+			i++
+			out = append(out, packet[i]^0x20)
+		} else {
+			out = append(out, packet[i])
+		}
+	}
+	return string(out)
+}
+
+func (s *GDBServer) handleEvent(ev gdbEvent) {
+	switch {
+	case ev.opened:
+		if s.conn != nil {
+			s.dropConn()
+		}
+		s.conn = ev.conn
+		// gdb expects a stopped target on connect
+		s.dbg.stop("gdb attached")
+	case ev.closed:
+		if ev.conn == s.conn {
+			s.dropConn()
+		}
+	case ev.conn == s.conn:
+		if reply, ok := s.handlePacket(ev.packet); ok {
+			s.send(reply)
+		}
+	}
+}
+
+// dropConn forgets the client, removing its breakpoints and resuming
+func (s *GDBServer) dropConn() {
+	s.conn.Close()
+	s.conn = nil
+	s.running = false
+	for key := range s.breakpoints {
+		s.removeBreakpoint(key)
+	}
+	if s.dbg.Stopped() {
+		s.dbg.Continue()
+	}
+}
+
+// handlePacket returns the reply, if one should be sent now
+func (s *GDBServer) handlePacket(packet string) (string, bool) {
+	if packet == "\x03" {
+		if !s.dbg.Stopped() {
+			s.dbg.Break()
+		}
+		return "", false
+	}
+	if packet == "" {
+		return "", true
+	}
+
+	z := &s.dbg.emu.CPU
+	args := packet[1:]
+
+	switch packet[0] {
+	case '?':
+		return "S05", true
+
+	case 'g':
+		out := ""
+		for i := 0; i < gdbNumRegs; i++ {
+			out += gdbHex16(s.getReg(i))
+		}
+		return out, true
+
+	case 'G':
+		if len(args) < gdbNumRegs*4 {
+			return "E01", true
+		}
+		for i := 0; i < gdbNumRegs; i++ {
+			val, err := gdbParseHex16(args[i*4 : i*4+4])
+			if err != nil {
+				return "E01", true
+			}
+			s.setReg(i, val)
+		}
+		return "OK", true
+
+	case 'p':
+		regNum, err := strconv.ParseUint(args, 16, 8)
+		if err != nil || regNum >= gdbNumRegs {
+			return "E01", true
+		}
+		return gdbHex16(s.getReg(int(regNum))), true
+
+	case 'P':
+		parts := strings.SplitN(args, "=", 2)
+		if len(parts) != 2 {
+			return "E01", true
+		}
+		regNum, err := strconv.ParseUint(parts[0], 16, 8)
+		if err != nil || regNum >= gdbNumRegs {
+			return "E01", true
+		}
+		val, err := gdbParseHex16(parts[1])
+		if err != nil {
+			return "E01", true
+		}
+		s.setReg(int(regNum), val)
+		return "OK", true
+
+	case 'm':
+		addr, length, _, err := gdbParseMemArgs(args)
+		if err != nil {
+			return "E01", true
+		}
+		out := make([]byte, length)
+		for i := range out {
+			out[i] = s.dbg.ReadMem(addr + uint16(i))
+		}
+		return hex.EncodeToString(out), true
+
+	case 'M':
+		addr, length, data, err := gdbParseMemArgs(args)
+		if err != nil {
+			return "E01", true
+		}
+		bytes, err := hex.DecodeString(data)
+		if err != nil || len(bytes) != length {
+			return "E01", true
+		}
+		for i, b := range bytes {
+			s.dbg.WriteMem(addr+uint16(i), b)
+		}
+		return "OK", true
+
+	case 'c', 's':
+		if args != "" {
+			addr, err := strconv.ParseUint(args, 16, 16)
+			if err != nil {
+				return "E01", true
+			}
+			z.PC = uint16(addr)
+		}
+		if packet[0] == 'c' {
+			s.dbg.Continue()
+		} else {
+			s.dbg.StepInto(1)
+		}
+		s.running = true
+		return "", false
+
+	case 'Z', 'z':
+		return s.handleBreakpointPacket(packet[0] == 'Z', args), true
+
+	case 'D':
+		s.send("OK")
+		s.dropConn()
+		return "", false
+
+	case 'k':
+		s.dropConn()
+		return "", false
+
+	case 'H':
+		return "OK", true
+
+	case 'T':
+		return "OK", true
+
+	case 'q':
+		switch {
+		case strings.HasPrefix(args, "Supported"):
+			return "PacketSize=1000", true
+		case args == "Attached":
+			return "1", true
+		case args == "C":
+			return "QC1", true
+		case args == "fThreadInfo":
+			return "m1", true
+		case args == "sThreadInfo":
+			return "l", true
+		}
+
+	case 'Q':
+		if args == "StartNoAckMode" {
+			s.conn.mutex.Lock()
+			s.conn.noAck = true
+			s.conn.mutex.Unlock()
+			return "OK", true
+		}
+	}
+
+	// empty means unsupported
+	return "", true
+}
+
+func (s *GDBServer) handleBreakpointPacket(insert bool, args string) string {
+	parts := strings.Split(args, ",")
+	if len(parts) != 3 {
+		return "E01"
+	}
+	addr, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return "E01"
+	}
+	length, err := strconv.ParseUint(parts[2], 16, 16)
+	if err != nil {
+		return "E01"
+	}
+	key := args
+
+	if !insert {
+		s.removeBreakpoint(key)
+		return "OK"
+	}
+
+	var kinds []BreakKind
+	switch parts[0] {
+	case "0", "1":
+		kinds = []BreakKind{BreakPC}
+		length = 1
+	case "2":
+		kinds = []BreakKind{BreakMemWrite}
+	case "3":
+		kinds = []BreakKind{BreakMemRead}
+	case "4":
+		kinds = []BreakKind{BreakMemRead, BreakMemWrite}
+	default:
+		return ""
+	}
+	if length == 0 {
+		length = 1
+	}
+	start := uint16(addr)
+	end := uint16(addr + length - 1)
+	if end < start {
+		end = 0xffff
+	}
+
+	s.removeBreakpoint(key)
+	for _, kind := range kinds {
+		bp := s.dbg.AddBreakpoint(kind, -1, start, end)
+		s.breakpoints[key] = append(s.breakpoints[key], bp.ID)
+	}
+	return "OK"
+}
+
+func (s *GDBServer) removeBreakpoint(key string) {
+	for _, id := range s.breakpoints[key] {
+		s.dbg.RemoveBreakpoint(id)
+	}
+	delete(s.breakpoints, key)
+}
+
+func (s *GDBServer) stopReply() string {
+	bp := s.dbg.hitWatch
+	if bp == nil {
+		return "S05"
+	}
+	watchType := ""
+	for key, ids := range s.breakpoints {
+		for _, id := range ids {
+			if id == bp.ID {
+				watchType = map[string]string{"2": "watch", "3": "rwatch", "4": "awatch"}[key[:1]]
+			}
+		}
+	}
+	if watchType == "" {
+		return "S05"
+	}
+	return fmt.Sprintf("T05%s:%04x;", watchType, s.dbg.hitWatchAddr)
+}
+
+// registers in gdb's z80 order: af bc de hl sp pc ix iy af' bc' de' hl' ir
+func (s *GDBServer) getReg(regNum int) uint16 {
+	z := &s.dbg.emu.CPU
+	switch regNum {
+	case 0:
+		return z.getAF()
+	case 1:
+		return z.getBC()
+	case 2:
+		return z.getDE()
+	case 3:
+		return z.getHL()
+	case 4:
+		return z.SP
+	case 5:
+		return z.PC
+	case 6:
+		return z.IX
+	case 7:
+		return z.IY
+	case 8:
+		return z.getAFh()
+	case 9:
+		return z.getBCh()
+	case 10:
+		return z.getDEh()
+	case 11:
+		return z.getHLh()
+	case 12:
+		return uint16(z.I)<<8 | uint16(z.R)
+	}
+	return 0
+}
+
+func (s *GDBServer) setReg(regNum int, val uint16) {
+	z := &s.dbg.emu.CPU
+	switch regNum {
+	case 0:
+		z.setAF(val)
+	case 1:
+		z.setBC(val)
+	case 2:
+		z.setDE(val)
+	case 3:
+		z.setHL(val)
+	case 4:
+		z.setSP(val)
+	case 5:
+		z.setPC(val)
+	case 6:
+		z.setIX(val)
+	case 7:
+		z.setIY(val)
+	case 8:
+		z.setAFh(val)
+	case 9:
+		z.setBCh(val)
+	case 10:
+		z.setDEh(val)
+	case 11:
+		z.setHLh(val)
+	case 12:
+		z.I, z.R = byte(val>>8), byte(val)
+	}
+}
+
+// gdb sends and expects target-endian (little) register values
+func gdbHex16(val uint16) string {
+	return fmt.Sprintf("%02x%02x", byte(val), byte(val>>8))
+}
+
+func gdbParseHex16(str string) (uint16, error) {
+	b, err := hex.DecodeString(str)
+	if err != nil || len(b) != 2 {
+		return 0, fmt.Errorf("bad register value %q", str)
+	}
+	return uint16(b[1])<<8 | uint16(b[0]), nil
+}
+
+// gdbParseMemArgs parses "ADDR,LEN" or "ADDR,LEN:DATA"
+func gdbParseMemArgs(args string) (uint16, int, string, error) {
+	data := ""
+	if i := strings.IndexByte(args, ':'); i >= 0 {
+		args, data = args[:i], args[i+1:]
+	}
+	parts := strings.Split(args, ",")
+	if len(parts) != 2 {
+		return 0, 0, "", fmt.Errorf("bad mem args %q", args)
+	}
+	addr, err := strconv.ParseUint(parts[0], 16, 16)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	length, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil || length > 0x1000 {
+		return 0, 0, "", fmt.Errorf("bad mem length %q", parts[1])
+	}
+	return uint16(addr), int(length), data, nil
+}
@@ -0,0 +1,137 @@
+package segmago
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// gdbTestClient is just enough of gdb to talk to a GDBServer.
+// The test's goroutine keeps the emulator stepping and polling
+// while it waits for each reply, like a frontend's main loop.
+type gdbTestClient struct {
+	t       *testing.T
+	conn    net.Conn
+	emu     *emuState
+	server  *GDBServer
+	packets chan string
+}
+
+func newGDBTestClient(t *testing.T, emu *emuState, server *GDBServer) *gdbTestClient {
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &gdbTestClient{t: t, conn: conn, emu: emu, server: server, packets: make(chan string, 16)}
+	go c.readLoop()
+	return c
+}
+
+func (c *gdbTestClient) readLoop() {
+	r := bufio.NewReader(c.conn)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			close(c.packets)
+			return
+		}
+		if b != '$' {
+			continue // acks
+		}
+		packet, err := r.ReadString('#')
+		if err != nil {
+			close(c.packets)
+			return
+		}
+		r.Discard(2) // checksum
+		c.packets <- packet[:len(packet)-1]
+	}
+}
+
+// exchange sends a packet and runs the emulator until the reply comes
+func (c *gdbTestClient) exchange(packet string) string {
+	c.t.Helper()
+	fmt.Fprintf(c.conn, "$%s#%02x", packet, gdbChecksum(packet))
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.server.Poll()
+		if err := c.emu.StepErr(); err != nil {
+			c.t.Fatal(err)
+		}
+		select {
+		case reply, ok := <-c.packets:
+			if !ok {
+				c.t.Fatalf("connection closed waiting for a reply to %q", packet)
+			}
+			return reply
+		default:
+		}
+	}
+	c.t.Fatalf("no reply to %q", packet)
+	return ""
+}
+
+func (c *gdbTestClient) expect(packet, want string) {
+	c.t.Helper()
+	if got := c.exchange(packet); got != want {
+		c.t.Fatalf("%q gave %q, want %q", packet, got, want)
+	}
+}
+
+func TestGDBServer(t *testing.T) {
+	rom := make([]byte, 0x8000)
+	copy(rom, []byte{
+		0x3e, 0x42, // ld a,$42
+		0x32, 0x00, 0xc0, // ld ($c000),a
+		0x00,       // nop
+		0x18, 0xfe, // jr $
+	})
+	emu := NewEmulatorSMS(rom, nil, false).(*emuState)
+
+	server, err := emu.Debugger().ServeGDB("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	c := newGDBTestClient(t, emu, server)
+	defer c.conn.Close()
+
+	c.expect("?", "S05")
+	if !emu.dbg.Stopped() {
+		t.Fatal("connecting didn't stop the emulator")
+	}
+
+	// 13 little-endian regs: af bc de hl sp pc ...
+	regs := c.exchange("g")
+	if len(regs) != gdbNumRegs*4 {
+		t.Fatalf("g gave %d hex digits, want %d", len(regs), gdbNumRegs*4)
+	}
+	if sp, pc := regs[16:20], regs[20:24]; sp != "ecdf" || pc != "0000" {
+		t.Fatalf("g gave sp %s and pc %s, want ecdf and 0000", sp, pc)
+	}
+
+	c.expect("m0000,5", "3e423200c0")
+	c.expect("Mc100,2:beef", "OK")
+	c.expect("mc100,2", "beef")
+	if emu.Mem.RAM[0x100] != 0xbe || emu.Mem.RAM[0x101] != 0xef {
+		t.Fatalf("M wrote % x to ram", emu.Mem.RAM[0x100:0x102])
+	}
+
+	c.expect("Z0,5,1", "OK")
+	c.expect("c", "S05")
+	if pc := emu.CPU.PC; pc != 0x0005 {
+		t.Fatalf("stopped at pc %04x, want 0005", pc)
+	}
+	c.expect("p5", "0500")
+	c.expect("mc000,1", "42")
+
+	// a write watchpoint reports its address
+	c.expect("z0,5,1", "OK")
+	c.expect("Z2,c101,1", "OK")
+	c.expect("Mc000,3:3201c1", "OK") // ld ($c101),a
+	c.expect("P5=00c0", "OK")
+	c.expect("c", "T05watch:c101;")
+}
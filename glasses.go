@@ -0,0 +1,99 @@
+package segmago
+
+// glasses3D is the SegaScope 3-D glasses. Games flip the LCD
+// shutters every frame by writing to 0xfff8-0xfffb (bit 0 set
+// opens the right eye), so each frame is only meant for one eye.
+type glasses3D struct {
+	// connected says the glasses are plugged in, i.e. the game
+	// wants them (see PeripheralGlasses3D). Other games can write
+	// to 0xfff8-0xfffb just by using the top of ram. Like the
+	// rom, it comes from the session rather than the snapshot.
+	connected bool
+
+	// Active is set once the game has written to the glasses
+	Active bool
+
+	RightOpen    bool
+	FrameIsRight bool // the eye for the frame being drawn
+
+	frames [2][256 * 240 * 4]byte // left, right
+}
+
+func (g *glasses3D) write(val byte) {
+	if !g.connected {
+		return
+	}
+	g.Active = true
+	g.RightOpen = val&0x01 != 0
+}
+
+// scanline latches the eye at the top of the frame (games flip the
+// shutters in vblank), and keeps the frame once it's finished
+func (g *glasses3D) scanline(v *vdp, y uint16) {
+	if y == 0 {
+		g.FrameIsRight = g.RightOpen
+	}
+	if y == v.ModeHeight-1 {
+		eye := 0
+		if g.FrameIsRight {
+			eye = 1
+		}
+		copy(g.frames[eye][:], v.framebuffer[:])
+	}
+}
+
+// Glasses3DFrames gives the last frame drawn for each eye, if
+// the game has used the 3-D glasses (see StereoFramebuffer)
+func (emu *emuState) Glasses3DFrames() (left, right []byte, ok bool) {
+	g := &emu.Glasses
+	return g.frames[0][:], g.frames[1][:], g.Active
+}
+
+// StereoMode picks how the two eyes' frames are shown
+type StereoMode int
+
+const (
+	StereoOff StereoMode = iota
+	StereoLeft
+	StereoRight
+	StereoAnaglyph
+	StereoSideBySide
+)
+
+var stereoModeNames = []string{"off", "left", "right", "anaglyph", "sidebyside"}
+
+func (m StereoMode) String() string      { return enumName(stereoModeNames, int(m)) }
+func (m *StereoMode) Set(s string) error { return setEnum(stereoModeNames, (*int)(m), s) }
+
+// Width is the width of a StereoFramebuffer in this mode
+func (m StereoMode) Width() int {
+	if m == StereoSideBySide {
+		return 512
+	}
+	return 256
+}
+
+// StereoFramebuffer combines the frames from Glasses3DFrames into
+// one RGBA image, m.Width() pixels wide and 240 tall. Anaglyph is
+// the red/cyan kind, with red over the left eye.
+func StereoFramebuffer(m StereoMode, left, right []byte) []byte {
+	switch m {
+	case StereoRight:
+		return append([]byte(nil), right...)
+	case StereoAnaglyph:
+		out := append([]byte(nil), right...)
+		for i := 0; i < len(out); i += 4 {
+			out[i] = left[i]
+		}
+		return out
+	case StereoSideBySide:
+		out := make([]byte, 0, len(left)*2)
+		for i := 0; i < len(left); i += 256 * 4 {
+			out = append(out, left[i:i+256*4]...)
+			out = append(out, right[i:i+256*4]...)
+		}
+		return out
+	default:
+		return append([]byte(nil), left...)
+	}
+}
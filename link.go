@@ -0,0 +1,160 @@
+package segmago
+
+// The GG's EXT port is 7 pins (PC0-PC6) that can each be an input
+// or an output (port 0x01 is the data, port 0x02 the directions,
+// 1 for input, with bit 7 clear enabling an NMI when PC6 goes low).
+// PC4 and PC5 double as a UART's TXD and RXD: port 0x03 sends,
+// port 0x04 receives, and port 0x05 has the controls and flags.
+
+// LinkMessage is what goes down the link cable. It's either a
+// byte from the UART, or a change to the parallel pins.
+type LinkMessage struct {
+	IsSerial bool
+
+	// Data is the serial byte, or the pins (bits 0-6)
+	// the sender is driving low
+	Data byte
+}
+
+// LinkTransport connects two GGs (see NewLinkPipe, ListenLink and
+// DialLink). Both ends must keep messages in order. Recv must not
+// block: ok is false when nothing is waiting.
+type LinkTransport interface {
+	Send(msg LinkMessage) error
+	Recv() (msg LinkMessage, ok bool)
+	Close() error
+}
+
+// port 0x05
+const (
+	serialTXFull    = 0x01
+	serialRXFull    = 0x02
+	serialNMIEnable = 0x08
+	serialTXEnable  = 0x10
+	serialRXEnable  = 0x20
+)
+
+var serialBaudRates = [4]int{4800, 2400, 1200, 300}
+
+// SetLink plugs a link cable into the EXT port (nil unplugs it)
+func (emu *emuState) SetLink(link LinkTransport) {
+	emu.link = link
+	if link != nil && emu.IsGameGear {
+		// let the other side know where we are
+		emu.GameGearSentLowPins = emu.extLowPins()
+		emu.sendLinkMessage(LinkMessage{Data: emu.GameGearSentLowPins})
+	}
+}
+
+// crossLinkPins maps the other end's pins onto ours: the cable
+// swaps PC0/PC1 with PC2/PC3, and TXD with RXD
+func crossLinkPins(pins byte) byte {
+	return pins&0x40 | (pins&0x03)<<2 | (pins&0x0c)>>2 | (pins&0x10)<<1 | (pins&0x20)>>1
+}
+
+// extLowPins is the EXT pins we're driving low
+func (emu *emuState) extLowPins() byte {
+	return ^emu.GameGearExtDataReg &^ emu.GameGearExtDirReg & 0x7f
+}
+
+func (emu *emuState) readExtData() byte {
+	inputs := emu.GameGearExtDirReg & 0x7f
+	remote := ^emu.GameGearRemoteLowPins & inputs
+	return emu.GameGearExtDataReg&^inputs | remote
+}
+
+func (emu *emuState) writeExtData(val byte) {
+	emu.GameGearExtDataReg = val
+	emu.sendLinkPins()
+}
+
+func (emu *emuState) writeExtDir(val byte) {
+	emu.GameGearExtDirReg = val
+	emu.sendLinkPins()
+}
+
+func (emu *emuState) sendLinkPins() {
+	low := emu.extLowPins()
+	if low == emu.GameGearSentLowPins {
+		return
+	}
+	emu.GameGearSentLowPins = low
+	emu.sendLinkMessage(LinkMessage{Data: low})
+}
+
+func (emu *emuState) sendLinkMessage(msg LinkMessage) {
+	if emu.link == nil {
+		return
+	}
+	if err := emu.link.Send(msg); err != nil {
+		emu.devPrintln("link send error:", err)
+	}
+}
+
+func (emu *emuState) readSerialRecv() byte {
+	emu.GameGearSerialCtrlReg &^= serialRXFull
+	return emu.GameGearSerialRecvReg
+}
+
+func (emu *emuState) writeSerialSend(val byte) {
+	emu.GameGearSerialSendReg = val
+	if emu.GameGearSerialCtrlReg&serialTXEnable != 0 {
+		// start bit, 8 data bits, stop bit
+		baud := serialBaudRates[emu.GameGearSerialCtrlReg>>6]
+		emu.GameGearSerialTXCycles = uint32(emu.clocksPerSecond() / baud * 10)
+		emu.GameGearSerialCtrlReg |= serialTXFull
+	}
+}
+
+// runLink finishes sends and takes in whatever's arrived
+func (emu *emuState) runLink(numCycles uint32) {
+	if emu.GameGearSerialTXCycles > 0 {
+		if emu.GameGearSerialTXCycles <= numCycles {
+			emu.GameGearSerialTXCycles = 0
+			emu.GameGearSerialCtrlReg &^= serialTXFull
+			emu.sendLinkMessage(LinkMessage{IsSerial: true, Data: emu.GameGearSerialSendReg})
+		} else {
+			emu.GameGearSerialTXCycles -= numCycles
+		}
+	}
+
+	if emu.link == nil {
+		return
+	}
+	for {
+		msg, ok := emu.link.Recv()
+		if !ok {
+			break
+		}
+		if msg.IsSerial {
+			emu.receiveSerial(msg.Data)
+		} else {
+			emu.receivePins(msg.Data)
+		}
+	}
+}
+
+func (emu *emuState) receiveSerial(val byte) {
+	ctrl := &emu.GameGearSerialCtrlReg
+	if *ctrl&serialRXEnable == 0 {
+		return
+	}
+	// overruns just lose the old byte
+	emu.GameGearSerialRecvReg = val
+	*ctrl |= serialRXFull
+	if *ctrl&serialNMIEnable != 0 {
+		emu.CPU.NMI = true
+	}
+}
+
+func (emu *emuState) receivePins(low byte) {
+	oldLow := emu.GameGearRemoteLowPins
+	emu.GameGearRemoteLowPins = crossLinkPins(low)
+
+	pc6IsInput := emu.GameGearExtDirReg&0x40 != 0
+	nmiEnabled := emu.GameGearExtDirReg&0x80 == 0
+	pc6Fell := emu.GameGearRemoteLowPins&^oldLow&0x40 != 0
+	if pc6IsInput && nmiEnabled && pc6Fell {
+		emu.CPU.NMI = true
+	}
+}
@@ -0,0 +1,120 @@
+package segmago
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// linkPipe is one end of an in-process link cable
+type linkPipe struct {
+	in  <-chan LinkMessage
+	out chan<- LinkMessage
+}
+
+// NewLinkPipe makes a link cable between two emulators
+// running in the same process
+func NewLinkPipe() (LinkTransport, LinkTransport) {
+	a := make(chan LinkMessage, 256)
+	b := make(chan LinkMessage, 256)
+	return &linkPipe{in: a, out: b}, &linkPipe{in: b, out: a}
+}
+
+func (p *linkPipe) Send(msg LinkMessage) error {
+	select {
+	case p.out <- msg:
+		return nil
+	default:
+		return fmt.Errorf("link pipe full")
+	}
+}
+
+func (p *linkPipe) Recv() (LinkMessage, bool) {
+	select {
+	case msg := <-p.in:
+		return msg, true
+	default:
+		return LinkMessage{}, false
+	}
+}
+
+func (p *linkPipe) Close() error { return nil }
+
+// linkConn is a link cable over a socket. Each message
+// is two bytes: 1 for serial or 0 for pins, then the data.
+type linkConn struct {
+	conn net.Conn
+	in   chan LinkMessage
+}
+
+func newLinkConn(conn net.Conn) *linkConn {
+	l := &linkConn{conn: conn, in: make(chan LinkMessage, 256)}
+	go l.readLoop()
+	return l
+}
+
+func (l *linkConn) readLoop() {
+	buf := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(l.conn, buf); err != nil {
+			close(l.in)
+			return
+		}
+		l.in <- LinkMessage{IsSerial: buf[0] == 1, Data: buf[1]}
+	}
+}
+
+func (l *linkConn) Send(msg LinkMessage) error {
+	kind := byte(0)
+	if msg.IsSerial {
+		kind = 1
+	}
+	_, err := l.conn.Write([]byte{kind, msg.Data})
+	return err
+}
+
+func (l *linkConn) Recv() (LinkMessage, bool) {
+	select {
+	case msg, ok := <-l.in:
+		return msg, ok
+	default:
+		return LinkMessage{}, false
+	}
+}
+
+func (l *linkConn) Close() error { return l.conn.Close() }
+
+// linkNetwork splits "unix:/path" from a plain tcp "host:port"
+func linkNetwork(addr string) (string, string) {
+	if strings.HasPrefix(addr, "unix:") {
+		return "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	return "tcp", addr
+}
+
+// ListenLink waits for another segmago to DialLink addr, which
+// is either a tcp "host:port" or "unix:/path/to/socket"
+func ListenLink(addr string) (LinkTransport, error) {
+	network, addr := linkNetwork(addr)
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newLinkConn(conn), nil
+}
+
+// DialLink connects to a segmago waiting in ListenLink
+func DialLink(addr string) (LinkTransport, error) {
+	network, addr := linkNetwork(addr)
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newLinkConn(conn), nil
+}
@@ -0,0 +1,168 @@
+package segmago
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCrossLinkPins(t *testing.T) {
+	tests := []struct{ in, want byte }{
+		{0x01, 0x04}, // PC0 -> PC2
+		{0x02, 0x08}, // PC1 -> PC3
+		{0x04, 0x01},
+		{0x08, 0x02},
+		{0x10, 0x20}, // TXD -> RXD
+		{0x20, 0x10},
+		{0x40, 0x40}, // PC6 goes straight through
+		{0x7f, 0x7f},
+		{0x00, 0x00},
+	}
+	for _, tt := range tests {
+		if got := crossLinkPins(tt.in); got != tt.want {
+			t.Errorf("crossLinkPins(%02x) = %02x, want %02x", tt.in, got, tt.want)
+		}
+	}
+}
+
+// recvLink waits for a message, as sockets deliver them asynchronously
+func recvLink(t *testing.T, l LinkTransport) LinkMessage {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if msg, ok := l.Recv(); ok {
+			return msg
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("no link message arrived")
+	return LinkMessage{}
+}
+
+func testLinkTransport(t *testing.T, a, b LinkTransport) {
+	defer a.Close()
+	defer b.Close()
+
+	if _, ok := a.Recv(); ok {
+		t.Fatal("Recv gave a message before any were sent")
+	}
+
+	msgs := []LinkMessage{
+		{IsSerial: true, Data: 0x5a},
+		{Data: 0x21},
+		{IsSerial: true, Data: 0x00},
+		{Data: 0x7f},
+	}
+	for _, dir := range []struct {
+		name     string
+		from, to LinkTransport
+	}{{"a to b", a, b}, {"b to a", b, a}} {
+		for _, msg := range msgs {
+			if err := dir.from.Send(msg); err != nil {
+				t.Fatalf("%s: %v", dir.name, err)
+			}
+		}
+		for _, want := range msgs {
+			if got := recvLink(t, dir.to); got != want {
+				t.Fatalf("%s: got %+v, want %+v", dir.name, got, want)
+			}
+		}
+	}
+}
+
+func TestLinkPipe(t *testing.T) {
+	a, b := NewLinkPipe()
+	testLinkTransport(t, a, b)
+}
+
+func TestLinkSocket(t *testing.T) {
+	addr := "unix:" + filepath.Join(t.TempDir(), "link.sock")
+
+	listened := make(chan LinkTransport)
+	listenErr := make(chan error, 1)
+	go func() {
+		l, err := ListenLink(addr)
+		if err != nil {
+			listenErr <- err
+			return
+		}
+		listened <- l
+	}()
+
+	var b LinkTransport
+	var err error
+	for i := 0; i < 100; i++ {
+		if b, err = DialLink(addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case a := <-listened:
+		testLinkTransport(t, a, b)
+	case err := <-listenErr:
+		t.Fatal(err)
+	}
+}
+
+func TestLinkReceiveSerial(t *testing.T) {
+	emu := NewEmulatorGG(make([]byte, 0x8000), nil, false).(*emuState)
+
+	// ignored with the receiver off
+	emu.receiveSerial(0x12)
+	if emu.GameGearSerialCtrlReg&serialRXFull != 0 || emu.CPU.NMI {
+		t.Fatal("receiver took a byte while disabled")
+	}
+
+	emu.GameGearSerialCtrlReg = serialRXEnable
+	emu.receiveSerial(0x34)
+	if emu.GameGearSerialCtrlReg&serialRXFull == 0 {
+		t.Fatal("receiving didn't set RX full")
+	}
+	if emu.CPU.NMI {
+		t.Fatal("NMI raised while disabled")
+	}
+	if got := emu.readSerialRecv(); got != 0x34 {
+		t.Fatalf("read %02x, want 34", got)
+	}
+	if emu.GameGearSerialCtrlReg&serialRXFull != 0 {
+		t.Fatal("reading didn't clear RX full")
+	}
+
+	emu.GameGearSerialCtrlReg = serialRXEnable | serialNMIEnable
+	emu.receiveSerial(0x56)
+	if emu.GameGearSerialCtrlReg&serialRXFull == 0 || !emu.CPU.NMI {
+		t.Fatal("receiving didn't set RX full and raise the NMI")
+	}
+}
+
+func TestLinkBetweenEmulators(t *testing.T) {
+	a, b := NewLinkPipe()
+	emuA := NewEmulatorGG(make([]byte, 0x8000), nil, false).(*emuState)
+	emuB := NewEmulatorGG(make([]byte, 0x8000), nil, false).(*emuState)
+	emuA.SetLink(a)
+	emuB.SetLink(b)
+	emuA.runLink(0)
+	emuB.runLink(0)
+
+	// A drives PC0 low, which B sees on PC2
+	emuA.writeExtDir(0x7e)
+	emuA.writeExtData(0x00)
+	emuB.runLink(0)
+	if got := emuB.readExtData() & 0x04; got != 0 {
+		t.Fatal("B's PC2 didn't go low")
+	}
+
+	// a serial byte from B arrives at A once it's sent
+	emuA.GameGearSerialCtrlReg = serialRXEnable
+	emuB.GameGearSerialCtrlReg = serialTXEnable
+	emuB.writeSerialSend(0x99)
+	emuB.runLink(emuB.GameGearSerialTXCycles)
+	emuA.runLink(0)
+	if emuA.GameGearSerialCtrlReg&serialRXFull == 0 || emuA.readSerialRecv() != 0x99 {
+		t.Fatal("A didn't receive B's serial byte")
+	}
+}
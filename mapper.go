@@ -0,0 +1,472 @@
+package segmago
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Mapper is a cart's bank switching hardware. The storage
+// passes itself in, so mappers only hold their own regs
+// (which get saved in snapshots).
+type Mapper interface {
+	Type() MapperType
+
+	reset(s *storage)
+
+	// read and write cover 0x0000-0xbfff
+	read(s *storage, addr uint16) byte
+	write(s *storage, addr uint16, val byte)
+
+	// ctrlWrite sees writes to 0xe000-0xffff, which
+	// also land in system ram
+	ctrlWrite(s *storage, addr uint16, val byte)
+
+	// romBankForAddr returns the 16KB rom bank mapped
+	// at addr, or -1 if it's not rom
+	romBankForAddr(s *storage, addr uint16) int
+
+	// systemRAMOverlay says if cart ram is mapped over
+	// 0xc000-0xffff, and where in cart ram it starts
+	systemRAMOverlay() (offset uint32, ok bool)
+
+	// describe is for the debugger
+	describe() string
+}
+
+func newMapper(m MapperType) Mapper {
+	switch m {
+	case MapperCodemasters:
+		return &codemastersMapper{}
+	case MapperKorean:
+		return &koreanMapper{}
+	case MapperKoreanMSX:
+		return &msxMapper{}
+	case MapperNemesis:
+		return &msxMapper{IsNemesis: true}
+	case Mapper4PAK:
+		return &fourPakMapper{}
+	case MapperJanggun:
+		return &janggunMapper{}
+	case MapperSegaEEPROM:
+		return &eepromMapper{}
+	default:
+		return &segaMapper{}
+	}
+}
+
+// mapperBox lets the Mapper interface go through json
+// by tagging it with its type
+type mapperBox struct {
+	Mapper
+}
+
+type mapperBoxJSON struct {
+	Type  MapperType
+	State json.RawMessage
+}
+
+func (b mapperBox) MarshalJSON() ([]byte, error) {
+	state, err := json.Marshal(b.Mapper)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(mapperBoxJSON{Type: b.Mapper.Type(), State: state})
+}
+
+func (b *mapperBox) UnmarshalJSON(data []byte) error {
+	var boxed mapperBoxJSON
+	if err := json.Unmarshal(data, &boxed); err != nil {
+		return err
+	}
+	b.Mapper = newMapper(boxed.Type)
+	if b.Mapper.Type() != boxed.Type {
+		return fmt.Errorf("unknown mapper type %d", boxed.Type)
+	}
+	return json.Unmarshal(boxed.State, b.Mapper)
+}
+
+// 16KB and 8KB rom bank helpers, wrapping like
+// the missing high address lines would
+func (s *storage) numBanks(size int) uint32 {
+	n := len(s.rom) / size
+	if n == 0 {
+		return 1
+	}
+	return uint32(n)
+}
+func (s *storage) readBank16(bank uint32, addr uint16) byte {
+	bank %= s.numBanks(0x4000)
+	return s.romAt(bank*0x4000 + uint32(addr&0x3fff))
+}
+func (s *storage) readBank8(bank uint32, addr uint16) byte {
+	bank %= s.numBanks(0x2000)
+	return s.romAt(bank*0x2000 + uint32(addr&0x1fff))
+}
+
+// romAt mirrors roms smaller than a bank
+func (s *storage) romAt(offset uint32) byte {
+	return s.rom[offset%uint32(len(s.rom))]
+}
+
+// segaMapper is the standard mapper: regs at 0xfffc-0xffff,
+// with the first 1KB always mapped to bank 0
+type segaMapper struct {
+	Banks [3]uint32
+
+	CartRAMPagedIn bool
+	PageRAMBank    uint32
+
+	// the rest of the 0xfffc bits, which few carts use
+	CartRAMOverSystemRAM bool
+	ROMWriteEnable       bool
+	BankShift            byte
+}
+
+func (m *segaMapper) Type() MapperType { return MapperSega }
+
+func (m *segaMapper) reset(s *storage) {
+	m.Banks = [3]uint32{0, 1, 2}
+}
+
+// bank shift values 1-3 add 24, 16 or 8 to every bank number
+var segaBankShiftAdds = [4]uint32{0, 0x18, 0x10, 0x08}
+
+func (m *segaMapper) bank(slot int) uint32 {
+	return m.Banks[slot] + segaBankShiftAdds[m.BankShift]
+}
+
+func (m *segaMapper) read(s *storage, addr uint16) byte {
+	switch {
+	case addr < 0x400:
+		return s.romAt(uint32(addr))
+	case addr < 0x8000:
+		return s.readBank16(m.bank(int(addr>>14)), addr)
+	case m.CartRAMPagedIn:
+		return s.CartRAM[m.PageRAMBank*0x4000+uint32(addr-0x8000)]
+	default:
+		return s.readBank16(m.bank(2), addr)
+	}
+}
+
+func (m *segaMapper) write(s *storage, addr uint16, val byte) {
+	switch {
+	case addr >= 0x8000 && m.CartRAMPagedIn:
+		s.writeCartRAM(m.PageRAMBank*0x4000+uint32(addr-0x8000), val)
+	case m.ROMWriteEnable && addr >= 0x400:
+		// only dev carts have anything writable here
+		slot := int(addr >> 14)
+		s.writeROM(m.bank(slot)%s.numBanks(0x4000)*0x4000+uint32(addr&0x3fff), val)
+	}
+}
+
+func (m *segaMapper) ctrlWrite(s *storage, addr uint16, val byte) {
+	switch addr {
+	case 0xfffc:
+		m.ROMWriteEnable = val&0x80 != 0
+		m.CartRAMOverSystemRAM = val&0x10 != 0
+		m.CartRAMPagedIn = val&0x08 != 0
+		m.PageRAMBank = uint32((val & 0x04) >> 2)
+		m.BankShift = val & 0x03
+		if m.CartRAMPagedIn {
+			s.useCartRAM(int(m.PageRAMBank+1) * 0x4000)
+		}
+		if m.CartRAMOverSystemRAM {
+			s.useCartRAM(0x4000)
+		}
+	case 0xfffd, 0xfffe, 0xffff:
+		m.Banks[addr-0xfffd] = uint32(val)
+	}
+}
+
+func (m *segaMapper) systemRAMOverlay() (uint32, bool) {
+	return 0, m.CartRAMOverSystemRAM
+}
+
+func (m *segaMapper) romBankForAddr(s *storage, addr uint16) int {
+	switch {
+	case addr < 0x400:
+		return 0
+	case addr < 0x8000:
+		return int(m.bank(int(addr>>14)) % s.numBanks(0x4000))
+	case !m.CartRAMPagedIn:
+		return int(m.bank(2) % s.numBanks(0x4000))
+	}
+	return -1
+}
+
+func (m *segaMapper) describe() string {
+	out := fmt.Sprintf("sega, page0: %02x, page1: %02x, page2: %02x", m.Banks[0], m.Banks[1], m.Banks[2])
+	if m.CartRAMPagedIn {
+		out += fmt.Sprintf(" (cart ram bank %d paged in)", m.PageRAMBank)
+	}
+	if m.CartRAMOverSystemRAM {
+		out += " (cart ram over system ram)"
+	}
+	if m.BankShift != 0 {
+		out += fmt.Sprintf(" (bank shift %d)", m.BankShift)
+	}
+	return out
+}
+
+// codemastersMapper has its bank regs at the start of
+// each 16KB slot, with no fixed first 1KB. Setting bit 7
+// in the 0x4000 reg maps 8KB of cart ram at 0xa000.
+type codemastersMapper struct {
+	Banks [3]uint32
+
+	CartRAMEnabled bool
+}
+
+func (m *codemastersMapper) Type() MapperType { return MapperCodemasters }
+
+func (m *codemastersMapper) reset(s *storage) {
+	m.Banks = [3]uint32{0, 1, 2}
+}
+
+func (m *codemastersMapper) read(s *storage, addr uint16) byte {
+	if addr >= 0xa000 && m.CartRAMEnabled {
+		return s.CartRAM[addr-0xa000]
+	}
+	return s.readBank16(m.Banks[addr>>14], addr)
+}
+
+func (m *codemastersMapper) write(s *storage, addr uint16, val byte) {
+	switch {
+	case addr == 0x4000:
+		m.Banks[1] = uint32(val & 0x7f)
+		m.CartRAMEnabled = val&0x80 != 0
+		if m.CartRAMEnabled {
+			s.useCartRAM(0x2000)
+		}
+	case addr&0x3fff == 0:
+		m.Banks[addr>>14] = uint32(val)
+	case addr >= 0xa000 && m.CartRAMEnabled:
+		s.writeCartRAM(uint32(addr-0xa000), val)
+	}
+}
+
+func (m *codemastersMapper) ctrlWrite(s *storage, addr uint16, val byte) {}
+
+func (m *codemastersMapper) romBankForAddr(s *storage, addr uint16) int {
+	if addr >= 0xa000 && m.CartRAMEnabled {
+		return -1
+	}
+	return int(m.Banks[addr>>14] % s.numBanks(0x4000))
+}
+
+func (m *codemastersMapper) systemRAMOverlay() (uint32, bool) { return 0, false }
+
+func (m *codemastersMapper) describe() string {
+	out := fmt.Sprintf("codemasters, page0: %02x, page1: %02x, page2: %02x", m.Banks[0], m.Banks[1], m.Banks[2])
+	if m.CartRAMEnabled {
+		out += " (cart ram at a000)"
+	}
+	return out
+}
+
+// koreanMapper only switches 0x8000-0xbfff, via a reg at 0xa000
+type koreanMapper struct {
+	Bank2 uint32
+}
+
+func (m *koreanMapper) Type() MapperType { return MapperKorean }
+
+func (m *koreanMapper) reset(s *storage) { m.Bank2 = 2 }
+
+func (m *koreanMapper) read(s *storage, addr uint16) byte {
+	if addr < 0x8000 {
+		return s.readBank16(uint32(addr>>14), addr)
+	}
+	return s.readBank16(m.Bank2, addr)
+}
+
+func (m *koreanMapper) write(s *storage, addr uint16, val byte) {
+	if addr == 0xa000 {
+		m.Bank2 = uint32(val)
+	}
+}
+
+func (m *koreanMapper) systemRAMOverlay() (uint32, bool) { return 0, false }
+
+func (m *koreanMapper) ctrlWrite(s *storage, addr uint16, val byte) {}
+
+func (m *koreanMapper) romBankForAddr(s *storage, addr uint16) int {
+	if addr < 0x8000 {
+		return int(addr >> 14)
+	}
+	return int(m.Bank2 % s.numBanks(0x4000))
+}
+
+func (m *koreanMapper) describe() string {
+	return fmt.Sprintf("korean, page2: %02x", m.Bank2)
+}
+
+// msxMapper is for the korean MSX ports: 8KB pages from 0x4000
+// up, switched by regs at 0x0000-0x0003. Nemesis is the same,
+// except 0x0000-0x1fff shows the last 8KB bank of its rom.
+type msxMapper struct {
+	// for 0x4000, 0x6000, 0x8000, 0xa000
+	Banks [4]uint32
+
+	IsNemesis bool
+}
+
+func (m *msxMapper) Type() MapperType {
+	if m.IsNemesis {
+		return MapperNemesis
+	}
+	return MapperKoreanMSX
+}
+
+func (m *msxMapper) reset(s *storage) {
+	m.Banks = [4]uint32{}
+}
+
+func (m *msxMapper) read(s *storage, addr uint16) byte {
+	switch {
+	case addr < 0x2000 && m.IsNemesis:
+		return s.readBank8(0x0f, addr)
+	case addr < 0x4000:
+		return s.readBank8(uint32(addr>>13), addr)
+	default:
+		return s.readBank8(m.Banks[(addr-0x4000)>>13], addr)
+	}
+}
+
+// the regs don't go in address order
+var msxMapperRegPages = [4]int{2, 3, 0, 1}
+
+func (m *msxMapper) write(s *storage, addr uint16, val byte) {
+	if addr < 4 {
+		m.Banks[msxMapperRegPages[addr]] = uint32(val)
+	}
+}
+
+func (m *msxMapper) systemRAMOverlay() (uint32, bool) { return 0, false }
+
+func (m *msxMapper) ctrlWrite(s *storage, addr uint16, val byte) {}
+
+func (m *msxMapper) romBankForAddr(s *storage, addr uint16) int {
+	if addr < 0x4000 {
+		return 0
+	}
+	return int(m.Banks[(addr-0x4000)>>13]%s.numBanks(0x2000)) >> 1
+}
+
+func (m *msxMapper) describe() string {
+	return fmt.Sprintf("%s, 4000: %02x, 6000: %02x, 8000: %02x, a000: %02x",
+		m.Type(), m.Banks[0], m.Banks[1], m.Banks[2], m.Banks[3])
+}
+
+// fourPakMapper is for 4 PAK All Action. Its regs sit at the
+// end of each slot, and the top bits of the first one pick
+// which game's banks the last slot sees.
+type fourPakMapper struct {
+	Regs  [3]byte
+	Banks [3]uint32
+}
+
+func (m *fourPakMapper) Type() MapperType { return Mapper4PAK }
+
+func (m *fourPakMapper) reset(s *storage) {
+	m.Regs = [3]byte{0, 1, 2}
+	m.Banks = [3]uint32{0, 1, 2}
+}
+
+func (m *fourPakMapper) read(s *storage, addr uint16) byte {
+	return s.readBank16(m.Banks[addr>>14], addr)
+}
+
+func (m *fourPakMapper) write(s *storage, addr uint16, val byte) {
+	switch addr {
+	case 0x3ffe:
+		m.Regs[0] = val
+	case 0x7fff:
+		m.Regs[1] = val
+	case 0xbfff:
+		m.Regs[2] = val
+	default:
+		return
+	}
+	m.Banks[0] = uint32(m.Regs[0])
+	m.Banks[1] = uint32(m.Regs[1])
+	m.Banks[2] = uint32(m.Regs[0]&0x30) + uint32(m.Regs[2])
+}
+
+func (m *fourPakMapper) systemRAMOverlay() (uint32, bool) { return 0, false }
+
+func (m *fourPakMapper) ctrlWrite(s *storage, addr uint16, val byte) {}
+
+func (m *fourPakMapper) romBankForAddr(s *storage, addr uint16) int {
+	return int(m.Banks[addr>>14] % s.numBanks(0x4000))
+}
+
+func (m *fourPakMapper) describe() string {
+	return fmt.Sprintf("4 pak, page0: %02x, page1: %02x, page2: %02x", m.Banks[0], m.Banks[1], m.Banks[2])
+}
+
+// janggunMapper is for Janggun-ui Adeul: 8KB pages from 0x4000
+// up, set one at a time by writes to 0x4000/0x6000/0x8000/0xa000
+// or in pairs by 0xfffe/0xffff. Pairs set with bit 6 high read
+// back with their bits reversed.
+type janggunMapper struct {
+	// for 0x4000, 0x6000, 0x8000, 0xa000
+	Banks    [4]uint32
+	Reversed [4]bool
+}
+
+func (m *janggunMapper) Type() MapperType { return MapperJanggun }
+
+func (m *janggunMapper) reset(s *storage) {
+	m.Banks = [4]uint32{2, 3, 4, 5}
+	m.Reversed = [4]bool{}
+}
+
+func (m *janggunMapper) read(s *storage, addr uint16) byte {
+	if addr < 0x4000 {
+		return s.readBank8(uint32(addr>>13), addr)
+	}
+	page := (addr - 0x4000) >> 13
+	val := s.readBank8(m.Banks[page], addr)
+	if m.Reversed[page] {
+		val = reverseBits(val)
+	}
+	return val
+}
+
+func (m *janggunMapper) write(s *storage, addr uint16, val byte) {
+	switch addr {
+	case 0x4000, 0x6000, 0x8000, 0xa000:
+		m.Banks[(addr-0x4000)>>13] = uint32(val)
+	}
+}
+
+func (m *janggunMapper) systemRAMOverlay() (uint32, bool) { return 0, false }
+
+func (m *janggunMapper) ctrlWrite(s *storage, addr uint16, val byte) {
+	if addr == 0xfffe || addr == 0xffff {
+		page := (addr - 0xfffe) * 2
+		bank := uint32(val&0x3f) * 2
+		m.Banks[page], m.Banks[page+1] = bank, bank+1
+		m.Reversed[page] = val&0x40 != 0
+		m.Reversed[page+1] = val&0x40 != 0
+	}
+}
+
+func (m *janggunMapper) romBankForAddr(s *storage, addr uint16) int {
+	if addr < 0x4000 {
+		return 0
+	}
+	return int(m.Banks[(addr-0x4000)>>13]%s.numBanks(0x2000)) >> 1
+}
+
+func (m *janggunMapper) describe() string {
+	return fmt.Sprintf("janggun, 4000: %02x, 6000: %02x, 8000: %02x, a000: %02x, reversed: %v",
+		m.Banks[0], m.Banks[1], m.Banks[2], m.Banks[3], m.Reversed)
+}
+
+func reverseBits(b byte) byte {
+	b = b>>4 | b<<4
+	b = (b&0xcc)>>2 | (b&0x33)<<2
+	return (b&0xaa)>>1 | (b&0x55)<<1
+}
@@ -0,0 +1,334 @@
+package segmago
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// bankROM makes a rom where every byte is its bank's number
+func bankROM(numBanks, bankSize int) []byte {
+	rom := make([]byte, numBanks*bankSize)
+	for i := range rom {
+		rom[i] = byte(i / bankSize)
+	}
+	return rom
+}
+
+func newMapperTestStorage(rom []byte, m MapperType) *storage {
+	s := &storage{}
+	s.init(rom)
+	s.setMapperType(m)
+	return s
+}
+
+func TestMapperJSONRoundTrip(t *testing.T) {
+	for m := MapperSega; m <= MapperSegaEEPROM; m++ {
+		s := newMapperTestStorage(bankROM(32, 0x4000), m)
+		if s.Mapper.Type() != m {
+			t.Fatalf("made a %v mapper, wanted %v", s.Mapper.Type(), m)
+		}
+
+		// get some state into the regs
+		s.ctrlMapper(0xfffc, 0x08)
+		for _, addr := range []uint16{0x0000, 0x0001, 0x3ffe, 0x4000, 0x7fff, 0xa000, 0xbfff} {
+			s.Mapper.write(s, addr, 0x03)
+		}
+		s.ctrlMapper(0xfffe, 0x43)
+		s.ctrlMapper(0xffff, 0x05)
+
+		data, err := json.Marshal(s.Mapper)
+		if err != nil {
+			t.Fatalf("%v: %v", m, err)
+		}
+		var box mapperBox
+		if err := json.Unmarshal(data, &box); err != nil {
+			t.Fatalf("%v: %v", m, err)
+		}
+		if box.Type() != m {
+			t.Errorf("%v came back as %v", m, box.Type())
+		}
+		if !reflect.DeepEqual(box.Mapper, s.Mapper.Mapper) {
+			t.Errorf("%v came back as %+v, want %+v", m, box.Mapper, s.Mapper.Mapper)
+		}
+	}
+
+	var box mapperBox
+	if err := json.Unmarshal([]byte(`{"Type":99,"State":{}}`), &box); err == nil {
+		t.Error("unknown mapper type didn't give an error")
+	}
+}
+
+func TestMapperBanks(t *testing.T) {
+	type bankCheck struct {
+		addr uint16
+		want byte
+	}
+	tests := []struct {
+		name     string
+		mapper   MapperType
+		rom      []byte
+		writes   [][2]uint16 // addr, val
+		ctrl     [][2]uint16
+		checks   []bankCheck
+		romBanks []bankCheck // romBankForAddr, in 16KB banks
+	}{
+		{
+			name:   "msx",
+			mapper: MapperKoreanMSX,
+			rom:    bankROM(32, 0x2000),
+			writes: [][2]uint16{{0x0000, 5}, {0x0001, 6}, {0x0002, 7}, {0x0003, 8}},
+			checks: []bankCheck{
+				{0x0000, 0}, {0x2000, 1},
+				{0x4000, 7}, {0x6000, 8}, {0x8000, 5}, {0xa000, 6},
+			},
+			romBanks: []bankCheck{{0x4000, 3}, {0x8000, 2}},
+		},
+		{
+			name:   "nemesis",
+			mapper: MapperNemesis,
+			rom:    bankROM(32, 0x2000),
+			writes: [][2]uint16{{0x0000, 5}},
+			checks: []bankCheck{
+				{0x0000, 0x0f}, {0x2000, 1}, {0x4000, 0}, {0x8000, 5},
+			},
+		},
+		{
+			name:   "4 pak",
+			mapper: Mapper4PAK,
+			rom:    bankROM(64, 0x4000),
+			writes: [][2]uint16{{0x3ffe, 0x12}, {0x7fff, 0x03}, {0xbfff, 0x04}},
+			checks: []bankCheck{
+				{0x0000, 0x12}, {0x4000, 0x03}, {0x8000, 0x14},
+			},
+			romBanks: []bankCheck{{0x0000, 0x12}, {0x8000, 0x14}},
+		},
+		{
+			name:   "4 pak reset",
+			mapper: Mapper4PAK,
+			rom:    bankROM(64, 0x4000),
+			checks: []bankCheck{
+				{0x0000, 0}, {0x4000, 1}, {0x8000, 2},
+			},
+		},
+		{
+			name:   "janggun",
+			mapper: MapperJanggun,
+			rom:    bankROM(32, 0x2000),
+			writes: [][2]uint16{{0x6000, 9}},
+			ctrl:   [][2]uint16{{0xffff, 0x43}},
+			checks: []bankCheck{
+				{0x0000, 0}, {0x2000, 1},
+				{0x4000, 2}, {0x6000, 9},
+				{0x8000, reverseBits(6)}, {0xa000, reverseBits(7)},
+			},
+			romBanks: []bankCheck{{0x4000, 1}, {0x8000, 3}},
+		},
+		{
+			name:   "janggun pairs",
+			mapper: MapperJanggun,
+			rom:    bankROM(32, 0x2000),
+			ctrl:   [][2]uint16{{0xfffe, 0x04}},
+			checks: []bankCheck{
+				{0x4000, 8}, {0x6000, 9}, {0x8000, 4}, {0xa000, 5},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newMapperTestStorage(tt.rom, tt.mapper)
+			for _, w := range tt.writes {
+				s.write(w[0], byte(w[1]))
+			}
+			for _, w := range tt.ctrl {
+				s.ctrlMapper(w[0], byte(w[1]))
+			}
+			for _, c := range tt.checks {
+				if got := s.read(c.addr); got != c.want {
+					t.Errorf("read(%04x) = %02x, want %02x", c.addr, got, c.want)
+				}
+			}
+			for _, c := range tt.romBanks {
+				if got := s.Mapper.romBankForAddr(s, c.addr); got != int(c.want) {
+					t.Errorf("romBankForAddr(%04x) = %d, want %d", c.addr, got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestConvertSnap1To2(t *testing.T) {
+	oldStorage := func(codemasters, std bool) map[string]interface{} {
+		return map[string]interface{}{
+			"IsCodemastersMapper": codemasters,
+			"IsStdMapper":         std,
+			"CartRAMPagedIn":      true,
+			"PageRAMBank":         1.0,
+			"Page0Bank":           0.0,
+			"Page1Bank":           3.0,
+			"Page2Bank":           5.0,
+		}
+	}
+	state := map[string]interface{}{
+		"Mem": map[string]interface{}{
+			"BIOSStorage": oldStorage(false, false),
+			"CartStorage": oldStorage(true, false),
+			"NullStorage": oldStorage(false, true),
+		},
+	}
+	if err := convertSnap1To2(state); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(state["Mem"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m mem
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		s         *storage
+		mapper    MapperType
+		detecting bool
+	}{
+		{"bios", &m.BIOSStorage, MapperSega, true},
+		{"cart", &m.CartStorage, MapperCodemasters, false},
+		{"null", &m.NullStorage, MapperSega, false},
+	}
+	for _, tt := range tests {
+		if got := tt.s.Mapper.Type(); got != tt.mapper {
+			t.Errorf("%s: mapper is %v, want %v", tt.name, got, tt.mapper)
+		}
+		if tt.s.DetectingMapper != tt.detecting {
+			t.Errorf("%s: DetectingMapper is %v, want %v", tt.name, tt.s.DetectingMapper, tt.detecting)
+		}
+		if tt.s.CartRAMUsed != 32*1024 {
+			t.Errorf("%s: CartRAMUsed is %d, want all of it", tt.name, tt.s.CartRAMUsed)
+		}
+	}
+	if cm := m.CartStorage.Mapper.Mapper.(*codemastersMapper); cm.Banks != [3]uint32{0, 3, 5} {
+		t.Errorf("codemasters banks are %v, want [0 3 5]", cm.Banks)
+	}
+	if sm := m.NullStorage.Mapper.Mapper.(*segaMapper); sm.Banks != [3]uint32{0, 3, 5} || !sm.CartRAMPagedIn || sm.PageRAMBank != 1 {
+		t.Errorf("sega mapper came out as %+v", sm)
+	}
+}
+
+// testdata/snapshot-v1.gz was made by the version 1 code running
+// this rom for 1000 steps, which left bank 3 in slot 1, bank 5
+// in slot 2 and a5 at c000
+func snapshotV1ROM() []byte {
+	rom := bankROM(8, 0x4000)
+	copy(rom, []byte{
+		0x3e, 0x05, // ld a,5
+		0x32, 0xff, 0xff, // ld ($ffff),a
+		0x3e, 0x03, // ld a,3
+		0x32, 0xfe, 0xff, // ld ($fffe),a
+		0x3e, 0xa5, // ld a,$a5
+		0x32, 0x00, 0xc0, // ld ($c000),a
+		0x18, 0xfe, // jr $
+	})
+	return rom
+}
+
+func TestLoadSnapshotV1(t *testing.T) {
+	snapBytes, err := ioutil.ReadFile("testdata/snapshot-v1.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu := NewEmulatorSMS(snapshotV1ROM(), nil, false).(*emuState)
+	loaded, err := emu.LoadSnapshot(snapBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newEmu := loaded.(*emuState)
+
+	s := &newEmu.Mem.CartStorage
+	if s.Mapper.Type() != MapperSega || s.DetectingMapper {
+		t.Fatalf("cart mapper is %v (detecting: %v), want a known sega mapper", s.Mapper.Type(), s.DetectingMapper)
+	}
+	for _, c := range []struct {
+		addr uint16
+		want byte
+	}{{0x4000, 3}, {0x8000, 5}, {0xc000, 0xa5}} {
+		if got := newEmu.read(c.addr); got != c.want {
+			t.Errorf("read(%04x) = %02x, want %02x", c.addr, got, c.want)
+		}
+	}
+	if newEmu.CPU.PC != 0x000f {
+		t.Errorf("PC is %04x, want 000f", newEmu.CPU.PC)
+	}
+	for port, want := range []ControllerType{ControllerJoypad, ControllerJoypad} {
+		if got := newEmu.Ports[port].Type(); got != want {
+			t.Errorf("port %d has a %v, want a %v", port+1, got, want)
+		}
+	}
+
+	// and it still runs, and survives a round trip at the current version
+	for i := 0; i < 100; i++ {
+		if err := newEmu.StepErr(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	again, err := newEmu.LoadSnapshot(newEmu.MakeSnapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := again.(*emuState).read(0x8000); got != 5 {
+		t.Errorf("after a round trip, read(8000) = %02x, want 05", got)
+	}
+}
+
+func TestROMWritesInSnapshots(t *testing.T) {
+	cart := bankROM(8, 0x4000)
+	emu := NewEmulatorSMSWithOptions(cart, nil, Options{Mapper: MapperSega}).(*emuState)
+	emu.write(0xfffc, 0x80) // rom write enable
+	before := emu.MakeSnapshot()
+
+	emu.write(0x4123, 0x77)
+	written := emu.MakeSnapshot()
+	emu.write(0x4123, 0x88)
+	emu.write(0x0500, 0x99)
+
+	if cart[0x4123] != 1 || cart[0x0500] != 0 {
+		t.Fatal("writes reached the caller's cart")
+	}
+	for _, tt := range []struct {
+		name       string
+		snap       []byte
+		at4123     byte
+		at0500     byte
+		numWritten int
+	}{
+		{"before", before, 1, 0, 0},
+		{"written", written, 0x77, 0, 1},
+	} {
+		loaded, err := emu.LoadSnapshot(tt.snap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newEmu := loaded.(*emuState)
+		if got := newEmu.read(0x4123); got != tt.at4123 {
+			t.Errorf("%s: read(4123) = %02x, want %02x", tt.name, got, tt.at4123)
+		}
+		if got := newEmu.read(0x0500); got != tt.at0500 {
+			t.Errorf("%s: read(0500) = %02x, want %02x", tt.name, got, tt.at0500)
+		}
+		if got := len(newEmu.Mem.CartStorage.ROMWrites); got != tt.numWritten {
+			t.Errorf("%s: %d rom writes, want %d", tt.name, got, tt.numWritten)
+		}
+
+		// and writing after the load doesn't touch the session it came from
+		newEmu.write(0x4124, 0x55)
+		if emu.read(0x4124) != 1 {
+			t.Fatalf("%s: a write after loading reached the old session", tt.name)
+		}
+	}
+	if cart[0x4123] != 1 || cart[0x4124] != 1 {
+		t.Fatal("writes reached the caller's cart")
+	}
+}
@@ -4,18 +4,27 @@ import "fmt"
 
 type storage struct {
 	rom             []byte
+	loadedROM       []byte // rom as loaded, before any ROMWrites
 	CartRAM         [32 * 1024]byte
 	CartRAMModified bool
 
-	IsCodemastersMapper bool
-	IsStdMapper         bool
+	// CartRAMSize is how much of CartRAM the cart really
+	// has, if known. Otherwise CartRAMUsed tracks how much
+	// the game has asked for.
+	CartRAMSize int
+	CartRAMUsed int
 
-	CartRAMPagedIn bool
-	PageRAMBank    uint32
+	romIsCopy bool
 
-	Page0Bank uint32
-	Page1Bank uint32
-	Page2Bank uint32
+	// ROMWrites holds what a write-enabled cart has written
+	// to its rom, by offset, so snapshots can put it back
+	ROMWrites map[uint32]byte
+
+	Mapper mapperBox
+
+	// DetectingMapper is set until the cart's first mapper
+	// write tells us whether it's Sega or Codemasters
+	DetectingMapper bool
 }
 
 type mem struct {
@@ -25,6 +34,9 @@ type mem struct {
 	BIOSStorage storage
 	CartStorage storage
 	NullStorage storage
+
+	// GGBIOSEnabled maps the GG's 1KB boot rom over 0x0000-0x03ff
+	GGBIOSEnabled bool
 }
 
 func (m *mem) marshallSelectedMem() int {
@@ -66,113 +78,139 @@ func (m *mem) init(cart, bios []byte) {
 }
 
 func (s *storage) init(rom []byte) {
+	s.setROM(rom)
+	s.setMapperType(MapperAuto)
+}
+
+// setROM points s at the rom as loaded, then redoes
+// any ROMWrites on top (e.g. ones from a snapshot)
+func (s *storage) setROM(rom []byte) {
+	s.loadedROM = rom
 	s.rom = rom
-	s.Page0Bank = s.wrapROMBankNum(0)
-	s.Page1Bank = s.wrapROMBankNum(1)
-	s.Page2Bank = s.wrapROMBankNum(2)
+	s.romIsCopy = false
+	for offset, val := range s.ROMWrites {
+		s.writeROM(offset, val)
+	}
 }
 
-func (s *storage) setPagingControlReg(b byte) {
-	s.CartRAMPagedIn = b&8 > 0
-	s.PageRAMBank = uint32((b & 4) >> 2)
-	// if b != 0x80 {
-	// 	fmt.Printf("PageCtrl: 0x%02x\n", b)
-	// 	fmt.Printf("\tRAM Paged In: %v\n", s.CartRAMPagedIn)
-	// 	fmt.Printf("\tRAM Bank: %v\n", s.PageRAMBank)
-	// }
-	assert(b&0x10 == 0, "cart RAM over internal RAM mode not yet implemented")
+// setMapperType picks a mapper, or starts guessing for MapperAuto
+func (s *storage) setMapperType(m MapperType) {
+	s.DetectingMapper = m == MapperAuto
+	s.Mapper = mapperBox{newMapper(m)}
+	s.Mapper.reset(s)
 }
 
-func (s *storage) wrapROMBankNum(bankNum byte) uint32 {
-	// should always be a power of two - 1
-	if len(s.rom) <= 16*1024 {
-		return 0
+// resetMapper puts the mapper back to how it powers on,
+// keeping its type (even if that was auto-detected)
+func (s *storage) resetMapper() {
+	s.Mapper = mapperBox{newMapper(s.Mapper.Type())}
+	s.Mapper.reset(s)
+}
+
+// useCartRAM notes the game wants at least size bytes of cart ram
+func (s *storage) useCartRAM(size int) {
+	if size > s.CartRAMUsed {
+		s.CartRAMUsed = size
+	}
+}
+
+func (s *storage) writeCartRAM(offset uint32, val byte) {
+	s.CartRAM[offset] = val
+	s.CartRAMModified = true
+}
+
+// cartRAMLen is how much cart ram there is, as far as we know
+func (s *storage) cartRAMLen() int {
+	size := s.CartRAMUsed
+	if s.CartRAMSize > 0 {
+		size = s.CartRAMSize
+	}
+	if size > len(s.CartRAM) {
+		size = len(s.CartRAM)
+	}
+	return size
+}
+
+// writeROM is for write-enabled (dev) carts. The rom
+// is copied first so the caller's cart isn't touched.
+func (s *storage) writeROM(offset uint32, val byte) {
+	if !s.romIsCopy {
+		s.rom = append([]byte(nil), s.rom...)
+		s.romIsCopy = true
 	}
-	maxBankNum := len(s.rom)/(16*1024) - 1
-	return uint32(int(bankNum) % (maxBankNum + 1))
+	offset %= uint32(len(s.rom))
+	s.rom[offset] = val
+	if s.ROMWrites == nil {
+		s.ROMWrites = map[uint32]byte{}
+	}
+	s.ROMWrites[offset] = val
 }
 
 func (s *storage) read(addr uint16) byte {
-	var val byte
-	if !s.IsCodemastersMapper && addr < 0x400 {
-		val = s.rom[addr]
-	} else if addr < 0x4000 {
-		bank := s.Page0Bank
-		computedAddr := bank*0x4000 + uint32(addr)
-		//fmt.Println("ROM BANK", bank, "addr", addr, "computed", computedAddr)
-		val = s.rom[computedAddr]
-	} else if addr < 0x8000 {
-		bank := s.Page1Bank
-		computedAddr := bank*0x4000 + uint32(addr-0x4000)
-		//fmt.Println("ROM BANK", bank, "addr", addr, "computed", computedAddr)
-		val = s.rom[computedAddr]
-	} else if addr < 0xc000 {
-		if s.CartRAMPagedIn {
-			bank := s.PageRAMBank
-			computedAddr := bank*0x4000 + uint32(addr-0x8000)
-			//fmt.Println("CART RAM READ BANK", bank, "addr", addr, "computed", computedAddr)
-			val = s.CartRAM[computedAddr]
-		} else {
-			bank := s.Page2Bank
-			computedAddr := bank*0x4000 + uint32(addr-0x8000)
-			//fmt.Println("ROM BANK", bank, "addr", addr, "computed", computedAddr)
-			val = s.rom[computedAddr]
-		}
-	} else {
+	if addr >= 0xc000 {
 		errOut(fmt.Sprintf("storage.read: passed non-rom addr 0x%04x", addr))
 	}
-	return val
+	return s.Mapper.read(s, addr)
+}
+
+// readUnmapped reads from a rom with no mapper, as on the SG-1000
+func (s *storage) readUnmapped(addr uint16) byte {
+	if int(addr) < len(s.rom) {
+		return s.rom[addr]
+	}
+	return 0xff
 }
 
 func (s *storage) write(addr uint16, val byte) {
-	if s.IsStdMapper {
-		if addr < 0xc000 {
-			if s.CartRAMPagedIn {
-				bank := s.PageRAMBank
-				computedAddr := bank*0x4000 + uint32(addr-0x8000)
-				s.CartRAM[computedAddr] = val
-				s.CartRAMModified = true
-				//fmt.Println("CART RAM WRITE BANK", bank, "addr", addr, "computed", computedAddr, "val", val)
-			}
-		}
-	} else {
-		if addr == 0x0000 {
-			s.IsCodemastersMapper = true
-			s.Page0Bank = s.wrapROMBankNum(val)
-		} else if addr == 0x4000 {
-			s.IsCodemastersMapper = true
-			s.Page1Bank = s.wrapROMBankNum(val)
-		} else if addr == 0x8000 {
-			s.IsCodemastersMapper = true
-			s.Page2Bank = s.wrapROMBankNum(val)
-		}
+	if s.DetectingMapper && (addr == 0x0000 || addr == 0x4000 || addr == 0x8000) {
+		// only codemasters carts write their bank regs here
+		s.setMapperType(MapperCodemasters)
 	}
+	s.Mapper.write(s, addr, val)
 }
 
 func (s *storage) ctrlMapper(addr uint16, val byte) {
-	if !s.IsCodemastersMapper {
-		s.IsStdMapper = true
-		if addr == 0xfffc {
-			s.setPagingControlReg(val)
-		} else if addr == 0xfffd {
-			s.Page0Bank = s.wrapROMBankNum(val)
-			//fmt.Println("set bank0:", s.Page0Bank)
-		} else if addr == 0xfffe {
-			s.Page1Bank = s.wrapROMBankNum(val)
-			//fmt.Println("set bank1:", s.Page1Bank)
-		} else if addr == 0xffff {
-			s.Page2Bank = s.wrapROMBankNum(val)
-			//fmt.Println("set bank2:", s.Page2Bank)
-		}
+	s.DetectingMapper = false
+	s.Mapper.ctrlWrite(s, addr, val)
+}
+
+// romBankForAddr returns the cart rom bank mapped at addr, or -1
+// if addr isn't mapped to cart rom
+func (m *mem) romBankForAddr(addr uint16) int {
+	s := m.selectedMem
+	if s != &m.CartStorage || addr >= 0xc000 || (addr < 0x400 && m.GGBIOSEnabled) {
+		return -1
 	}
+	return s.Mapper.romBankForAddr(s, addr)
 }
 
 func (emu *emuState) read(addr uint16) byte {
+	val := emu.peek(addr)
+	if emu.dbg != nil {
+		emu.dbg.onAccess(BreakMemRead, addr, val)
+	}
+	return val
+}
+
+// peek reads mem without triggering any debugger watchpoints
+func (emu *emuState) peek(addr uint16) byte {
 	m := &emu.Mem
 
 	var val byte
-	if addr < 0xc000 {
+	if emu.IsSG1000 {
+		if addr < 0xc000 {
+			val = m.CartStorage.readUnmapped(addr)
+		} else {
+			val = m.RAM[addr&emu.sgRAMMask()]
+		}
+	} else if addr < 0x400 && m.GGBIOSEnabled {
+		val = m.BIOSStorage.romAt(uint32(addr))
+	} else if addr < 0xc000 {
 		val = m.selectedMem.read(addr)
+	} else if offset, ok := m.selectedMem.Mapper.systemRAMOverlay(); ok {
+		val = m.selectedMem.CartRAM[offset+uint32(addr&0x3fff)]
+	} else if emu.RAMDisabled {
+		val = 0xff
 	} else if addr < 0xe000 {
 		val = m.RAM[addr-0xc000]
 	} else {
@@ -183,8 +221,30 @@ func (emu *emuState) read(addr uint16) byte {
 
 func (emu *emuState) write(addr uint16, val byte) {
 	m := &emu.Mem
+	if emu.dbg != nil {
+		emu.dbg.onAccess(BreakMemWrite, addr, val)
+	}
+	if emu.IsSG1000 {
+		// no mapper, just mirrored ram
+		if addr >= 0xc000 {
+			m.RAM[addr&emu.sgRAMMask()] = val
+		}
+		return
+	}
+	if addr >= 0xfff8 && addr <= 0xfffb && !emu.IsGameGear {
+		emu.Glasses.write(val)
+	}
 	if addr < 0xc000 {
 		m.selectedMem.write(addr, val)
+	} else if offset, ok := m.selectedMem.Mapper.systemRAMOverlay(); ok {
+		m.selectedMem.writeCartRAM(offset+uint32(addr&0x3fff), val)
+		if addr >= 0xe000 {
+			m.selectedMem.ctrlMapper(addr, val)
+		}
+	} else if emu.RAMDisabled {
+		if addr >= 0xe000 {
+			m.selectedMem.ctrlMapper(addr, val)
+		}
 	} else if addr < 0xe000 {
 		m.RAM[addr-0xc000] = val
 	} else {
@@ -193,6 +253,15 @@ func (emu *emuState) write(addr uint16, val byte) {
 	}
 }
 
+// sgRAMMask gives the mirroring of the SG-1000's 1KB
+// (or the SC-3000's 2KB) of ram
+func (emu *emuState) sgRAMMask() uint16 {
+	if emu.IsSC3000 {
+		return 0x07ff
+	}
+	return 0x03ff
+}
+
 func (emu *emuState) in(addr uint16) byte {
 	addr &= 0xff // sms ignores upper byte
 	var val byte
@@ -202,8 +271,8 @@ func (emu *emuState) in(addr uint16) byte {
 			case 0:
 				val = byteFromBools(
 					!emu.Input.Joypad1.Start,
-					true,  // isExportedConsole
-					false, // isPALConsole
+					!emu.IsDomesticConsole,
+					emu.VDP.TVType == tvPAL,
 					false,
 					false,
 					false,
@@ -211,20 +280,22 @@ func (emu *emuState) in(addr uint16) byte {
 					false,
 				)
 			case 1:
-				return emu.GameGearExtDataReg
+				val = emu.readExtData()
 			case 2:
-				return emu.GameGearExtDirReg
+				val = emu.GameGearExtDirReg
 			case 3:
-				return emu.GameGearSerialSendReg
+				val = emu.GameGearSerialSendReg
 			case 4:
-				return 0xff
+				val = emu.readSerialRecv()
 			case 5:
-				return emu.GameGearSerialCtrlReg
+				val = emu.GameGearSerialCtrlReg
 			case 6:
-				return 0xff // stereo reg is write only (0 or ff?)
+				val = 0xff // stereo reg is write only (0 or ff?)
 			default:
-				return 0xff
+				val = 0xff
 			}
+		} else if emu.IsSG1000 {
+			val = 0xff // nothing here
 		} else {
 			// val = 0xff // right for SMS2, SMS has weird bus stuff
 			val = 0xff // 0 more compatible?, some games try to "read" from mem ctrl port?
@@ -251,8 +322,18 @@ func (emu *emuState) in(addr uint16) byte {
 			default:
 				val = 0xff
 			}
+		} else if emu.IsSC3000 {
+			val = emu.readPPI(addr)
+		} else if emu.IsSG1000 {
+			if addr&1 == 0 {
+				val = emu.readJoyReg0()
+			} else {
+				val = emu.readJoyReg1() | 0xf0
+			}
 		} else {
-			if emu.IoDisabled {
+			if emu.hasFM() && addr == 0xf2 {
+				val = emu.FMControlReg & 0x03 // FM detection
+			} else if emu.IoDisabled {
 				val = 0xff
 			} else if addr&1 == 0 {
 				val = emu.readJoyReg0()
@@ -263,21 +344,27 @@ func (emu *emuState) in(addr uint16) byte {
 	}
 	//fmt.Printf("IN: %04x, %02x\n", addr, val)
 	//fmt.Printf("got IN: 0x%02x = 0x%02x\n", addr, val)
+	if emu.dbg != nil {
+		emu.dbg.onAccess(BreakPortIn, addr, val)
+	}
 	return val
 }
 
 func (emu *emuState) out(addr uint16, val byte) {
 	addr &= 0xff // sms ignores upper byte
+	if emu.dbg != nil {
+		emu.dbg.onAccess(BreakPortOut, addr, val)
+	}
 	//fmt.Printf("got OUT: 0x%02x, 0x%02x\n", addr, val)
 	if addr < 0x40 {
 		if emu.IsGameGear && addr <= 6 {
 			switch addr {
 			case 1:
-				emu.GameGearExtDataReg = val
+				emu.writeExtData(val)
 			case 2:
-				emu.GameGearExtDirReg = val
+				emu.writeExtDir(val)
 			case 3:
-				emu.GameGearSerialSendReg = val
+				emu.writeSerialSend(val)
 			case 4:
 				// read only
 			case 5:
@@ -286,6 +373,8 @@ func (emu *emuState) out(addr uint16, val byte) {
 			case 6:
 				emu.SN76489.StereoMixerReg = val
 			}
+		} else if emu.IsSG1000 {
+			// nothing here
 		} else if addr&1 == 0 {
 			emu.setMemControlReg(val)
 		} else {
@@ -296,12 +385,24 @@ func (emu *emuState) out(addr uint16, val byte) {
 	} else if addr < 0xc0 {
 		if addr&1 == 0 {
 			//fmt.Printf("write data port 0x%02x\n", val)
-			emu.VDP.writeDataPort(val, emu.IsGameGear)
+			emu.VDP.writeDataPort(val)
 		} else {
 			//fmt.Printf("write control port 0x%02x\n", val)
 			emu.VDP.writeControlPort(val)
 		}
 	} else { // >= 0xc0
-		// NOP: writes == old SG-3000 keyboard ports that don't matter to sms
+		if emu.IsSC3000 {
+			emu.writePPI(addr, val)
+		} else if emu.hasFM() {
+			switch addr {
+			case 0xf0:
+				emu.YM2413.writeAddr(val)
+			case 0xf1:
+				emu.YM2413.writeData(val)
+			case 0xf2:
+				emu.FMControlReg = val & 0x03
+			}
+		}
+		// NOP otherwise: the sms ignores the old SC-3000 keyboard ports
 	}
 }
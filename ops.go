@@ -1,6 +1,10 @@
 package segmago
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/theinternetftw/segmago/disasm"
+)
 
 func (z *z80) setOp8(cycles uint32, instLen uint16, reg *uint8, val uint8, flags uint32) {
 	z.RunCycles(cycles)
@@ -1400,8 +1404,8 @@ func (z *z80) imeToString() string {
 func (z *z80) debugStatusLine() string {
 
 	outStr := fmt.Sprintf("Step:%08d, ", z.Steps) +
-		fmt.Sprintf("(*PC)[0:4]:%02x%02x%02x%02x, ", z.Read(z.PC), z.Read(z.PC+1), z.Read(z.PC+2), z.Read(z.PC+3)) +
-		fmt.Sprintf("(*SP):%04x, ", z.read16(z.SP)) +
+		fmt.Sprintf("(*PC)[0:4]:%02x%02x%02x%02x, ", z.peek(z.PC), z.peek(z.PC+1), z.peek(z.PC+2), z.peek(z.PC+3)) +
+		fmt.Sprintf("(*SP):%04x, ", z.peek16(z.SP)) +
 		fmt.Sprintf("[PC:%04x ", z.PC) +
 		fmt.Sprintf("SP:%04x ", z.SP) +
 		fmt.Sprintf("AF:%04x ", z.getAF()) +
@@ -1410,7 +1414,8 @@ func (z *z80) debugStatusLine() string {
 		fmt.Sprintf("HL:%04x ", z.getHL()) +
 		fmt.Sprintf("IX:%04x ", z.IX) +
 		fmt.Sprintf("IY:%04x ", z.IY) +
-		fmt.Sprintf("IME:%v ", z.imeToString())
+		fmt.Sprintf("IME:%v] ", z.imeToString()) +
+		disasm.Decode(z.peek, z.PC).Format(z.Labeler)
 
 	return outStr
 }
@@ -1640,7 +1645,12 @@ func xchg(a, b *byte) {
 }
 
 func (z *z80) Step() {
-	z.handleInterrupts()
+	// taking an interrupt counts as its own step, so
+	// the handler's first opcode can be seen (e.g. by
+	// the debugger) before it runs
+	if z.handleInterrupts() {
+		return
+	}
 
 	if z.IsHalted {
 		z.RunCycles(4)
@@ -3037,9 +3047,5 @@ func getDisplacedAddr(base uint16, disp byte) uint16 {
 }
 
 func (z *z80) Err(msg error) {
-	fmt.Println()
-	fmt.Println("z80.Err():", msg)
-	fmt.Println(z.debugStatusLine())
-	fmt.Println()
-	panic("z80.Err")
+	panic(emuErr(fmt.Sprint("z80.Err(): ", msg)))
 }
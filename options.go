@@ -0,0 +1,159 @@
+package segmago
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Options configures the console being emulated. The zero value
+// auto-detects everything from the ROM db and the cart header.
+type Options struct {
+	TV     TVStandard
+	Region Region
+	VDP    VDPVersion
+
+	Mapper      MapperType
+	GGSMSMode   bool
+	Peripherals Peripherals
+	CartRAMSize int
+
+	// Port1 and Port2 are the controllers plugged in. Auto
+	// puts whatever Peripherals asks for in port 1.
+	Port1 ControllerType
+	Port2 ControllerType
+
+	// Slot is where the cart is plugged in, which
+	// matters when booting through the BIOS
+	Slot CartSlot
+
+	// IgnoreROMDB skips the built-in ROM db (see LookupROM)
+	IgnoreROMDB bool
+
+	DevMode bool
+}
+
+// TVStandard picks NTSC or PAL timing
+type TVStandard int
+
+// Region picks a japanese (domestic) or export console
+type Region int
+
+// VDPVersion picks the SMS1 or SMS2 VDP
+type VDPVersion int
+
+// CartSlot picks which SMS slot the cart is in
+type CartSlot int
+
+const (
+	TVAuto TVStandard = iota
+	TVNTSC
+	TVPAL
+)
+
+const (
+	RegionAuto Region = iota
+	RegionJapan
+	RegionExport
+)
+
+const (
+	VDPAuto VDPVersion = iota
+	VDPSMS1
+	VDPSMS2
+)
+
+const (
+	SlotCartridge CartSlot = iota
+	SlotCard
+	SlotExpansion
+)
+
+// The String/Set methods let these be used with flag.Var
+
+var tvStandardNames = []string{"auto", "ntsc", "pal"}
+var regionNames = []string{"auto", "japan", "export"}
+var vdpVersionNames = []string{"auto", "sms1", "sms2"}
+var cartSlotNames = []string{"cart", "card", "expansion"}
+
+func (t TVStandard) String() string { return enumName(tvStandardNames, int(t)) }
+func (r Region) String() string     { return enumName(regionNames, int(r)) }
+func (v VDPVersion) String() string { return enumName(vdpVersionNames, int(v)) }
+func (c CartSlot) String() string   { return enumName(cartSlotNames, int(c)) }
+
+func (t *TVStandard) Set(s string) error { return setEnum(tvStandardNames, (*int)(t), s) }
+func (r *Region) Set(s string) error     { return setEnum(regionNames, (*int)(r), s) }
+func (v *VDPVersion) Set(s string) error { return setEnum(vdpVersionNames, (*int)(v), s) }
+func (c *CartSlot) Set(s string) error   { return setEnum(cartSlotNames, (*int)(c), s) }
+
+func enumName(names []string, i int) string {
+	if i < 0 || i >= len(names) {
+		return fmt.Sprint("unknown(", i, ")")
+	}
+	return names[i]
+}
+
+func setEnum(names []string, dst *int, s string) error {
+	for i, name := range names {
+		if strings.EqualFold(s, name) {
+			*dst = i
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of: %s", strings.Join(names, ", "))
+}
+
+// withROMProfile fills in anything left on auto that the
+// ROM db knows about
+func (o Options) withROMProfile(cart []byte) Options {
+	if o.IgnoreROMDB {
+		return o
+	}
+	profile, ok := LookupROM(cart)
+	if !ok {
+		return o
+	}
+	if o.DevMode {
+		fmt.Println("found in rom db:", profile.Name)
+	}
+	if o.TV == TVAuto {
+		o.TV = profile.TV
+	}
+	if o.Region == RegionAuto {
+		o.Region = profile.Region
+	}
+	if o.Mapper == MapperAuto {
+		o.Mapper = profile.Mapper
+	}
+	if o.Peripherals == 0 {
+		o.Peripherals = profile.Peripherals
+	}
+	if o.CartRAMSize == 0 {
+		o.CartRAMSize = profile.CartRAMSize
+	}
+	o.GGSMSMode = o.GGSMSMode || profile.GGSMSMode
+	return o
+}
+
+// resolve fills in anything left on auto, using the region
+// code in the cart header (if there is one)
+func (o Options) resolve(cart CartInfo) Options {
+	if o.Region == RegionAuto {
+		o.Region = RegionExport
+		if cart.IsJapanese() {
+			o.Region = RegionJapan
+		}
+	}
+	if o.TV == TVAuto {
+		// the header can't tell us, and nearly everything runs on NTSC
+		o.TV = TVNTSC
+	}
+	if o.VDP == VDPAuto {
+		// japanese SMSs never got the SMS2 VDP
+		if o.Region == RegionJapan {
+			o.VDP = VDPSMS1
+		} else {
+			o.VDP = VDPSMS2
+		}
+	}
+	return o
+}
@@ -0,0 +1,62 @@
+package segmago
+
+// lightPhaser is the SMS light gun. Its trigger is TL
+// (button 1), and its light sensor pulls TH low, which also
+// latches the H counter so the game can tell where it was aimed.
+type lightPhaser struct {
+	// SeesLight is set for the line after one that
+	// was bright near where the phaser is aimed
+	SeesLight bool
+	LitLine   uint16
+}
+
+// how close (in pixels) the beam has to get to the aim
+// point for the sensor to see it, and how bright it must be
+const phaserRadius = 6
+const phaserMinBrightness = 0x180
+
+func (p *lightPhaser) Type() ControllerType           { return ControllerPhaser }
+func (p *lightPhaser) setTH(emu *emuState, high bool) {}
+
+func (p *lightPhaser) read(emu *emuState, port int, pad *Joypad) byte {
+	th := !(p.SeesLight && emu.VDP.ScreenY == p.LitLine)
+	return byteFromBools(false, th, true, !pad.Fire, true, true, true, true)
+}
+
+// onScanline runs after the VDP draws each line
+func (emu *emuState) onScanline(y uint16) {
+	for port := range emu.Ports {
+		if p, ok := emu.Ports[port].portDevice.(*lightPhaser); ok {
+			p.scanline(emu, port, y)
+		}
+	}
+	if emu.Glasses.Active {
+		emu.Glasses.scanline(&emu.VDP, y)
+	}
+}
+
+func (p *lightPhaser) scanline(emu *emuState, port int, y uint16) {
+	p.SeesLight = false
+
+	aimX, aimY := emu.Input.PhaserX, emu.Input.PhaserY
+	if aimX < 0 || aimX >= 256 || aimY < 0 || aimY >= int(emu.VDP.ModeHeight) {
+		return
+	}
+	if abs(int(y)-aimY) > phaserRadius || !emu.VDP.brightNear(aimX, y, phaserRadius) {
+		return
+	}
+
+	p.SeesLight = true
+	p.LitLine = y + 1
+	if _, isOutput := emu.thOutput(port); !isOutput {
+		// TH going low latches the H counter
+		emu.VDP.HCounter = byte(aimX >> 1)
+	}
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
@@ -0,0 +1,310 @@
+package segmago
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ControllerType picks what's plugged into a controller port
+type ControllerType int
+
+const (
+	ControllerAuto ControllerType = iota
+	ControllerJoypad
+	ControllerPhaser
+	ControllerPaddle
+	ControllerSportsPad
+	ControllerMD3
+	ControllerMD6
+	ControllerNone
+)
+
+var controllerTypeNames = []string{"auto", "joypad", "phaser", "paddle", "sportspad", "md3", "md6", "none"}
+
+func (c ControllerType) String() string      { return enumName(controllerTypeNames, int(c)) }
+func (c *ControllerType) Set(s string) error { return setEnum(controllerTypeNames, (*int)(c), s) }
+
+// portDevice is something plugged into a controller port.
+// Like Mapper, it only holds its own state (for snapshots),
+// and gets the emuState passed in to see the rest.
+type portDevice interface {
+	Type() ControllerType
+
+	// read gives the port's pins, 1 for high: bits 0-5
+	// are up, down, left, right, TL and TR, bit 6 is TH.
+	// Reading either joypad reg reads both ports, so
+	// read mustn't change anything.
+	read(emu *emuState, port int, pad *Joypad) byte
+
+	// setTH sees the console change the TH pin
+	setTH(emu *emuState, high bool)
+}
+
+func newPortDevice(c ControllerType) portDevice {
+	switch c {
+	case ControllerPhaser:
+		return &lightPhaser{}
+	case ControllerPaddle:
+		return &paddle{}
+	case ControllerSportsPad:
+		return &sportsPad{}
+	case ControllerMD3:
+		return &mdPad{}
+	case ControllerMD6:
+		return &mdPad{SixButton: true}
+	case ControllerNone:
+		return &noDevice{}
+	default:
+		return &joypad{}
+	}
+}
+
+// portBox lets a portDevice go through json, like mapperBox
+type portBox struct {
+	portDevice
+}
+
+type portBoxJSON struct {
+	Type  ControllerType
+	State json.RawMessage
+}
+
+func (b portBox) MarshalJSON() ([]byte, error) {
+	state, err := json.Marshal(b.portDevice)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(portBoxJSON{Type: b.portDevice.Type(), State: state})
+}
+
+func (b *portBox) UnmarshalJSON(data []byte) error {
+	var boxed portBoxJSON
+	if err := json.Unmarshal(data, &boxed); err != nil {
+		return err
+	}
+	b.portDevice = newPortDevice(boxed.Type)
+	if b.portDevice.Type() != boxed.Type {
+		return fmt.Errorf("unknown controller type %d", boxed.Type)
+	}
+	return json.Unmarshal(boxed.State, b.portDevice)
+}
+
+// controllerFor resolves ControllerAuto, using the
+// peripherals the game wants (which all go in port 1)
+func controllerFor(c ControllerType, port int, peripherals Peripherals) ControllerType {
+	if c != ControllerAuto {
+		return c
+	}
+	if port == 0 {
+		switch {
+		case peripherals&PeripheralLightPhaser != 0:
+			return ControllerPhaser
+		case peripherals&PeripheralPaddle != 0:
+			return ControllerPaddle
+		case peripherals&PeripheralSportsPad != 0:
+			return ControllerSportsPad
+		}
+	}
+	return ControllerJoypad
+}
+
+func (emu *emuState) plugIn(port int, c ControllerType) {
+	emu.Ports[port] = portBox{newPortDevice(c)}
+}
+
+// Controller says what's plugged into port 0 or 1
+func (emu *emuState) Controller(port int) ControllerType {
+	return emu.Ports[port].Type()
+}
+
+func (emu *emuState) portInput(port int) *Joypad {
+	if port == 0 {
+		return &emu.Input.Joypad1
+	}
+	return &emu.Input.Joypad2
+}
+
+// readPort reads a port's pins. TH reads back what the
+// console is driving when it's an output, except on
+// japanese consoles, which always read it as low.
+func (emu *emuState) readPort(port int) byte {
+	val := emu.Ports[port].read(emu, port, emu.portInput(port))
+	if thOut, isOutput := emu.thOutput(port); isOutput {
+		val &^= 0x40
+		if thOut && !emu.IsDomesticConsole {
+			val |= 0x40
+		}
+	}
+	return val
+}
+
+// thOutput gives the TH level the console is driving, if it is
+func (emu *emuState) thOutput(port int) (high bool, isOutput bool) {
+	if port == 0 {
+		return emu.THAOutput, emu.THAInOutputMode
+	}
+	return emu.THBOutput, emu.THBInOutputMode
+}
+
+// thLevel is the TH pin as the device sees it: pulled
+// high unless the console drives it low
+func (emu *emuState) thLevel(port int) bool {
+	high, isOutput := emu.thOutput(port)
+	return high || !isOutput
+}
+
+// joypad is the standard 2 button pad
+type joypad struct{}
+
+func (j *joypad) Type() ControllerType           { return ControllerJoypad }
+func (j *joypad) setTH(emu *emuState, high bool) {}
+
+func (j *joypad) read(emu *emuState, port int, pad *Joypad) byte {
+	return byteFromBools(false, true, !pad.B, !pad.A, !pad.Right, !pad.Left, !pad.Down, !pad.Up)
+}
+
+// noDevice is an empty port, with every pin pulled up
+type noDevice struct{}
+
+func (n *noDevice) Type() ControllerType                           { return ControllerNone }
+func (n *noDevice) setTH(emu *emuState, high bool)                 {}
+func (n *noDevice) read(emu *emuState, port int, pad *Joypad) byte { return 0x7f }
+
+// paddle is the HPD-200, which sends its 8-bit knob position a
+// nibble at a time on the direction pins, with TR saying which
+// nibble it is. The japanese one flips nibbles by itself, off a
+// free-running ~8kHz clock, the export one (which never really
+// shipped) follows TH instead.
+type paddle struct{}
+
+const paddleClockHz = 8000
+
+func (p *paddle) Type() ControllerType           { return ControllerPaddle }
+func (p *paddle) setTH(emu *emuState, high bool) {}
+
+func (p *paddle) read(emu *emuState, port int, pad *Joypad) byte {
+	var highNibble bool
+	if emu.IsDomesticConsole {
+		halfPeriod := uint32(emu.clocksPerSecond() / paddleClockHz / 2)
+		highNibble = emu.Cycles/halfPeriod&1 != 0
+	} else {
+		highNibble = emu.thLevel(port)
+	}
+	nibble := pad.Paddle & 0x0f
+	if highNibble {
+		nibble = pad.Paddle >> 4
+	}
+	return byteFromBools(false, true, highNibble, !(pad.A || pad.Fire), false, false, false, false) | nibble
+}
+
+// sportsPad is the Sports Pad trackball. TH idles high. From
+// there, each TH edge moves on to the next nibble of its X and Y
+// movement: low gives X's high nibble, high X's low one, low Y's
+// high one and high (back to idle) Y's low one. The movement is
+// latched as TH first leaves idle, so all four nibbles match.
+type sportsPad struct {
+	// Nibble is 0 at idle, then 1-3 for X high, X low and Y high
+	Nibble int
+
+	// MoveX and MoveY add up movement since the last latch
+	MoveX, MoveY int
+	LatchX       int8
+	LatchY       int8
+}
+
+func (s *sportsPad) Type() ControllerType { return ControllerSportsPad }
+
+func (s *sportsPad) setTH(emu *emuState, high bool) {
+	if s.Nibble == 0 {
+		if high {
+			return // already idle
+		}
+		s.LatchX, s.LatchY = clampInt8(s.MoveX), clampInt8(s.MoveY)
+		s.MoveX, s.MoveY = 0, 0
+	}
+	s.Nibble = (s.Nibble + 1) & 3
+}
+
+// addMovement is called with each new Input
+func (s *sportsPad) addMovement(pad *Joypad) {
+	s.MoveX += pad.TrackballX
+	s.MoveY += pad.TrackballY
+}
+
+func (s *sportsPad) read(emu *emuState, port int, pad *Joypad) byte {
+	var nibble byte
+	switch s.Nibble {
+	case 1:
+		nibble = byte(s.LatchX) >> 4
+	case 2:
+		nibble = byte(s.LatchX) & 0x0f
+	case 3:
+		nibble = byte(s.LatchY) >> 4
+	case 0:
+		nibble = byte(s.LatchY) & 0x0f
+	}
+	return byteFromBools(false, true, !pad.B, !(pad.A || pad.Fire), false, false, false, false) | nibble
+}
+
+func clampInt8(i int) int8 {
+	if i > 127 {
+		return 127
+	}
+	if i < -128 {
+		return -128
+	}
+	return int8(i)
+}
+
+// mdPad is a Mega Drive pad. TH picks which half of the buttons
+// show up. The 6 button pad counts TH pulses: on the third one it
+// sends an id and then its extra buttons, until it's left alone
+// for a while and starts over.
+type mdPad struct {
+	SixButton bool
+
+	Pulses      int
+	LastTHCycle uint32
+}
+
+// how long the 6 button pad waits before it starts over (about 1.5ms)
+const mdPadResetCycles = 5400
+
+func (m *mdPad) Type() ControllerType {
+	if m.SixButton {
+		return ControllerMD6
+	}
+	return ControllerMD3
+}
+
+func (m *mdPad) setTH(emu *emuState, high bool) {
+	if emu.Cycles-m.LastTHCycle > mdPadResetCycles {
+		m.Pulses = 0
+	}
+	m.LastTHCycle = emu.Cycles
+	if !high {
+		m.Pulses++
+	}
+}
+
+func (m *mdPad) read(emu *emuState, port int, pad *Joypad) byte {
+	pulses := m.Pulses
+	if emu.Cycles-m.LastTHCycle > mdPadResetCycles {
+		pulses = 0
+	}
+	th := emu.thLevel(port)
+	if m.SixButton && pulses == 3 {
+		if th {
+			return byteFromBools(false, true, !pad.C, !pad.B, !pad.Mode, !pad.X, !pad.Y, !pad.Z)
+		}
+		// the id: all the directions "pressed"
+		return byteFromBools(false, false, !pad.Start, !pad.A, false, false, false, false)
+	}
+	if m.SixButton && pulses == 4 && !th {
+		return byteFromBools(false, false, !pad.Start, !pad.A, true, true, true, true)
+	}
+	if th {
+		return byteFromBools(false, true, !pad.C, !pad.B, !pad.Right, !pad.Left, !pad.Down, !pad.Up)
+	}
+	return byteFromBools(false, false, !pad.Start, !pad.A, false, false, !pad.Down, !pad.Up)
+}
@@ -0,0 +1,66 @@
+package segmago
+
+import "testing"
+
+func newPortTestEmu(t *testing.T, region Region, port1 ControllerType) *emuState {
+	rom := make([]byte, 0x8000)
+	emu := NewEmulatorSMSWithOptions(rom, nil, Options{Region: region, Port1: port1}).(*emuState)
+	if emu.Ports[0].Type() != port1 {
+		t.Fatalf("port 1 has a %v, want a %v", emu.Ports[0].Type(), port1)
+	}
+	return emu
+}
+
+// port 0x3f values driving port 1's TH, everything else an input
+const (
+	ioCtrlTHALow  = 0x0d
+	ioCtrlTHAHigh = 0x2d
+)
+
+func TestSportsPadNibbleOrder(t *testing.T) {
+	emu := newPortTestEmu(t, RegionExport, ControllerSportsPad)
+	emu.out(0x3f, ioCtrlTHAHigh)
+	emu.SetInput(Input{Joypad1: Joypad{TrackballX: 0x12, TrackballY: -3}})
+
+	for round := 0; round < 2; round++ {
+		want := []byte{0x1, 0x2, 0xf, 0xd}
+		if round == 1 {
+			// nothing moved since the last latch
+			want = []byte{0, 0, 0, 0}
+		}
+		for i, ctrl := range []byte{ioCtrlTHALow, ioCtrlTHAHigh, ioCtrlTHALow, ioCtrlTHAHigh} {
+			emu.out(0x3f, ctrl)
+			if got := emu.in(0xdc) & 0x0f; got != want[i] {
+				t.Fatalf("round %d, nibble %d: got %x, want %x", round, i, got, want[i])
+			}
+		}
+	}
+}
+
+func TestPaddleReadsDontFlipNibbles(t *testing.T) {
+	emu := newPortTestEmu(t, RegionJapan, ControllerPaddle)
+	emu.SetInput(Input{Joypad1: Joypad{Paddle: 0xa5}})
+
+	first := emu.in(0xdc)
+	emu.in(0xdd)
+	emu.in(0xdd)
+	if again := emu.in(0xdc); again != first {
+		t.Fatalf("reads of 0xdd changed 0xdc from %02x to %02x", first, again)
+	}
+
+	// the nibble flips with the paddle's own clock
+	seen := map[byte]bool{}
+	for i := 0; i < 4; i++ {
+		val := emu.in(0xdc)
+		tr := val&0x20 != 0
+		nibble := val & 0x0f
+		if tr && nibble != 0xa || !tr && nibble != 0x5 {
+			t.Fatalf("read %02x: TR doesn't match the nibble", val)
+		}
+		seen[nibble] = true
+		emu.Cycles += uint32(emu.clocksPerSecond() / paddleClockHz / 2)
+	}
+	if !seen[0xa] || !seen[0x5] {
+		t.Fatal("paddle never flipped nibbles")
+	}
+}
@@ -0,0 +1,178 @@
+package segmago
+
+import (
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+// ROMProfile is the known hardware setup for a specific ROM dump.
+// Zero values mean "nothing special", i.e. auto-detect as usual.
+type ROMProfile struct {
+	Name string
+
+	Mapper MapperType
+	Region Region
+	TV     TVStandard
+
+	// GGSMSMode marks GG carts that are really SMS games,
+	// which run the GG in its SMS compatibility mode
+	GGSMSMode bool
+
+	Peripherals Peripherals
+
+	// CartRAMSize is in bytes
+	CartRAMSize int
+}
+
+// MapperType picks the cart's bank switching hardware
+type MapperType int
+
+const (
+	MapperAuto MapperType = iota
+	MapperSega
+	MapperCodemasters
+	MapperKorean
+	MapperKoreanMSX
+	Mapper4PAK
+	MapperJanggun
+	MapperNemesis
+	MapperSegaEEPROM
+)
+
+var mapperTypeNames = []string{"auto", "sega", "codemasters", "korean", "msx", "4pak", "janggun", "nemesis", "eeprom"}
+
+func (m MapperType) String() string      { return enumName(mapperTypeNames, int(m)) }
+func (m *MapperType) Set(s string) error { return setEnum(mapperTypeNames, (*int)(m), s) }
+
+// Peripherals is a set of controller port extras a game needs
+type Peripherals uint
+
+const (
+	PeripheralLightPhaser Peripherals = 1 << iota
+	PeripheralPaddle
+	PeripheralSportsPad
+	PeripheralGlasses3D
+
+	// PeripheralsNone says "none" rather than "auto", for overriding the db
+	PeripheralsNone Peripherals = 1 << 31
+)
+
+var peripheralNames = []string{"phaser", "paddle", "sportspad", "glasses"}
+
+func (p Peripherals) String() string {
+	names := []string{}
+	for i, name := range peripheralNames {
+		if p&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		if p&PeripheralsNone != 0 {
+			return "none"
+		}
+		return "auto"
+	}
+	return strings.Join(names, ",")
+}
+
+// Set takes a comma separated list, for use with flag.Var
+func (p *Peripherals) Set(s string) error {
+	*p = 0
+	for _, field := range strings.Split(s, ",") {
+		field = strings.ToLower(strings.TrimSpace(field))
+		if field == "none" {
+			*p |= PeripheralsNone
+			continue
+		}
+		found := false
+		for i, name := range peripheralNames {
+			if field == name {
+				*p |= 1 << uint(i)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown peripheral %q (want none or some of: %s)",
+				field, strings.Join(peripheralNames, ", "))
+		}
+	}
+	return nil
+}
+
+// romDBEntry matches on the CRC32 of the ROM (minus any copier header)
+type romDBEntry struct {
+	CRC32   uint32
+	Profile ROMProfile
+}
+
+var romDB = []romDBEntry{
+
+	// Codemasters carts use their own mapper and PAL timing
+	{CRC32: 0x29822980, Profile: ROMProfile{Name: "Cosmic Spacehead", Mapper: MapperCodemasters, TV: TVPAL}},
+	{CRC32: 0xb9664ae1, Profile: ROMProfile{Name: "Fantastic Dizzy", Mapper: MapperCodemasters, TV: TVPAL}},
+	{CRC32: 0xa577ce46, Profile: ROMProfile{Name: "Micro Machines", Mapper: MapperCodemasters, TV: TVPAL}},
+	{CRC32: 0x8813514b, Profile: ROMProfile{Name: "Excellent Dizzy Collection, The (Proto)", Mapper: MapperCodemasters, TV: TVPAL}},
+	{CRC32: 0xaa140c9c, Profile: ROMProfile{Name: "Excellent Dizzy Collection, The (GG, Proto)", Mapper: MapperCodemasters, GGSMSMode: true}},
+	{CRC32: 0x5e53c7f7, Profile: ROMProfile{Name: "Ernie Els Golf", Mapper: MapperCodemasters, CartRAMSize: 8 * 1024}},
+
+	// korean carts
+	{CRC32: 0x89b79e77, Profile: ROMProfile{Name: "Dodgeball King", Mapper: MapperKorean}},
+	{CRC32: 0x929222c4, Profile: ROMProfile{Name: "Jang Pung II", Mapper: MapperKorean}},
+	{CRC32: 0x97d03541, Profile: ROMProfile{Name: "Sangokushi 3", Mapper: MapperKorean}},
+	{CRC32: 0x06965ed9, Profile: ROMProfile{Name: "F-1 Spirit: The Way to Formula-1", Mapper: MapperKoreanMSX}},
+	{CRC32: 0x77efe84a, Profile: ROMProfile{Name: "Knightmare II: The Maze of Galious", Mapper: MapperKoreanMSX}},
+	{CRC32: 0x0a77fa5e, Profile: ROMProfile{Name: "Nemesis", Mapper: MapperNemesis}},
+	{CRC32: 0xa67f2a5c, Profile: ROMProfile{Name: "4 PAK All Action", Mapper: Mapper4PAK}},
+
+	// GG carts that save to a serial eeprom
+	{CRC32: 0x36ebcd6d, Profile: ROMProfile{Name: "Majors Pro Baseball, The", Mapper: MapperSegaEEPROM}},
+	{CRC32: 0x3d8d0dd6, Profile: ROMProfile{Name: "World Series Baseball", Mapper: MapperSegaEEPROM}},
+	{CRC32: 0xbb38cfd7, Profile: ROMProfile{Name: "World Series Baseball (v1.1)", Mapper: MapperSegaEEPROM}},
+	{CRC32: 0x578a8a38, Profile: ROMProfile{Name: "World Series Baseball '95", Mapper: MapperSegaEEPROM}},
+
+	// 3-D glasses
+	{CRC32: 0x6bd5c2bf, Profile: ROMProfile{Name: "Space Harrier 3-D", Peripherals: PeripheralGlasses3D}},
+	{CRC32: 0x8ecd201c, Profile: ROMProfile{Name: "Blade Eagle 3-D", Peripherals: PeripheralGlasses3D}},
+	{CRC32: 0x31b8040b, Profile: ROMProfile{Name: "Maze Hunter 3-D", Peripherals: PeripheralGlasses3D}},
+	{CRC32: 0xabd48ad2, Profile: ROMProfile{Name: "Poseidon Wars 3-D", Peripherals: PeripheralGlasses3D}},
+	{CRC32: 0xa3ef13cb, Profile: ROMProfile{Name: "Zaxxon 3-D", Peripherals: PeripheralGlasses3D}},
+	{CRC32: 0xd6f43dda, Profile: ROMProfile{Name: "Out Run 3-D", Peripherals: PeripheralGlasses3D}},
+	{CRC32: 0x871562b0, Profile: ROMProfile{Name: "Missile Defense 3-D", Peripherals: PeripheralGlasses3D | PeripheralLightPhaser}},
+
+	// light phaser
+	{CRC32: 0x861b6e79, Profile: ROMProfile{Name: "Assault City (Light Phaser)", Peripherals: PeripheralLightPhaser}},
+	{CRC32: 0x5fc74d2a, Profile: ROMProfile{Name: "Gangster Town", Peripherals: PeripheralLightPhaser}},
+	{CRC32: 0xe8ea842c, Profile: ROMProfile{Name: "Marksman Shooting / Trap Shooting", Peripherals: PeripheralLightPhaser}},
+	{CRC32: 0xe8215c2e, Profile: ROMProfile{Name: "Marksman Shooting / Trap Shooting / Safari Hunt", Peripherals: PeripheralLightPhaser}},
+	{CRC32: 0x205caae8, Profile: ROMProfile{Name: "Operation Wolf", Peripherals: PeripheralLightPhaser}},
+	{CRC32: 0xda5a7013, Profile: ROMProfile{Name: "Rambo III", Peripherals: PeripheralLightPhaser}},
+	{CRC32: 0x79ac8e7f, Profile: ROMProfile{Name: "Rescue Mission", Peripherals: PeripheralLightPhaser}},
+	{CRC32: 0x4b051022, Profile: ROMProfile{Name: "Shooting Gallery", Peripherals: PeripheralLightPhaser}},
+	{CRC32: 0xa908cff5, Profile: ROMProfile{Name: "Space Gun", Peripherals: PeripheralLightPhaser}},
+	{CRC32: 0x5359762d, Profile: ROMProfile{Name: "Wanted", Peripherals: PeripheralLightPhaser}},
+	{CRC32: 0x0ca95637, Profile: ROMProfile{Name: "Laser Ghost", Peripherals: PeripheralLightPhaser}},
+
+	// paddle (a japanese accessory, hence the region)
+	{CRC32: 0xf9dbb533, Profile: ROMProfile{Name: "Alex Kidd BMX Trial", Region: RegionJapan, Peripherals: PeripheralPaddle}},
+	{CRC32: 0xa6fa42d0, Profile: ROMProfile{Name: "Galactic Protector", Region: RegionJapan, Peripherals: PeripheralPaddle}},
+	{CRC32: 0x29bc7fad, Profile: ROMProfile{Name: "Megumi Rescue", Region: RegionJapan, Peripherals: PeripheralPaddle}},
+	{CRC32: 0x315917d4, Profile: ROMProfile{Name: "Woody Pop", Region: RegionJapan, Peripherals: PeripheralPaddle}},
+
+	// sports pad
+	{CRC32: 0x0cb7e21f, Profile: ROMProfile{Name: "Great Ice Hockey", Peripherals: PeripheralSportsPad}},
+	{CRC32: 0xe42e4998, Profile: ROMProfile{Name: "Sports Pad Football", Peripherals: PeripheralSportsPad}},
+	{CRC32: 0x41c948bf, Profile: ROMProfile{Name: "Sports Pad Soccer", Region: RegionJapan, Peripherals: PeripheralSportsPad}},
+}
+
+// LookupROM finds a ROM dump in the built-in db
+func LookupROM(rom []byte) (ROMProfile, bool) {
+	rom = stripCopierHeader(rom)
+	crc := crc32.ChecksumIEEE(rom)
+	for _, entry := range romDB {
+		if entry.CRC32 == crc {
+			return entry.Profile, true
+		}
+	}
+	return ROMProfile{}, false
+}
@@ -0,0 +1,129 @@
+package segmago
+
+// Input.Keys indexes for SC-3000 keys that have no ascii char
+const (
+	KeyUp = 0x80 + iota
+	KeyDown
+	KeyLeft
+	KeyRight
+	KeyShift
+	KeyCtrl
+	KeyFunc
+	KeyGraph
+	KeyEngDiers
+	KeyHomeClr
+	KeyInsDel
+	KeyBreak
+	KeyPi
+	KeyYen
+)
+
+// sc3000KeyMatrix maps a key to its row (selected by PPI port C)
+// and its bit (0-7 for port A, 8-11 for port B). Host chars are
+// mapped by position on a US keyboard, shifted or not.
+var sc3000KeyMatrix = map[int][2]int{
+	'1': {0, 0}, '!': {0, 0},
+	'2': {1, 0}, '@': {1, 0},
+	'3': {2, 0}, '#': {2, 0},
+	'4': {3, 0}, '$': {3, 0},
+	'5': {4, 0}, '%': {4, 0},
+	'6': {5, 0}, '^': {5, 0},
+	'7': {6, 0}, '&': {6, 0},
+	'8': {0, 8}, '*': {0, 8},
+	'9': {1, 8}, '(': {1, 8},
+	'0': {2, 8}, ')': {2, 8},
+	'-': {3, 8}, '_': {3, 8},
+	'=': {4, 8}, '+': {4, 8}, // ^ on the SC-3000
+	'\\': {5, 8}, '|': {5, 8}, KeyYen: {5, 8},
+	KeyBreak: {6, 8}, '\x1b': {6, 8},
+
+	'q': {0, 1}, 'w': {1, 1}, 'e': {2, 1}, 'r': {3, 1}, 't': {4, 1}, 'y': {5, 1}, 'u': {6, 1},
+	'a': {0, 2}, 's': {1, 2}, 'd': {2, 2}, 'f': {3, 2}, 'g': {4, 2}, 'h': {5, 2}, 'j': {6, 2},
+	'z': {0, 3}, 'x': {1, 3}, 'c': {2, 3}, 'v': {3, 3}, 'b': {4, 3}, 'n': {5, 3}, 'm': {6, 3},
+	'k': {0, 6}, 'l': {1, 6},
+	'i': {0, 7}, 'o': {1, 7}, 'p': {2, 7},
+
+	KeyEngDiers: {0, 4},
+	' ':         {1, 4},
+	KeyHomeClr:  {2, 4},
+	KeyInsDel:   {3, 4}, '\b': {3, 4}, '\x7f': {3, 4},
+
+	',': {0, 5}, '<': {0, 5},
+	'.': {1, 5}, '>': {1, 5},
+	'/': {2, 5}, '?': {2, 5},
+	KeyPi:    {3, 5},
+	KeyDown:  {4, 5},
+	KeyLeft:  {5, 5},
+	KeyRight: {6, 5},
+
+	';': {2, 6}, ':': {2, 6},
+	'\'': {3, 6}, '"': {3, 6}, // : on the SC-3000
+	']': {4, 6}, '}': {4, 6},
+	'\n':  {5, 6},
+	KeyUp: {6, 6},
+
+	'`': {3, 7}, '~': {3, 7}, // @ on the SC-3000
+	'[': {4, 7}, '{': {4, 7},
+
+	KeyFunc:  {5, 11},
+	KeyGraph: {6, 9},
+	KeyCtrl:  {6, 10},
+	KeyShift: {6, 11},
+}
+
+// readKeyboardRow returns the 12 active-low key bits for
+// a row, with port A in the low byte
+func (emu *emuState) readKeyboardRow(row byte) uint16 {
+	if row == 7 {
+		// the joypads live on the last row
+		return uint16(emu.readJoyReg0()) | uint16(emu.readJoyReg1()&0x0f)<<8
+	}
+	bits := uint16(0x0fff)
+	for key, pos := range sc3000KeyMatrix {
+		down := emu.Input.Keys[key]
+		if key >= 'a' && key <= 'z' {
+			down = down || emu.Input.Keys[key-'a'+'A']
+		}
+		if down && pos[0] == int(row) {
+			bits &^= 1 << uint(pos[1])
+		}
+	}
+	return bits
+}
+
+// readPPI handles the SC-3000's 8255 PPI (ports 0xdc-0xdf, mirrored)
+func (emu *emuState) readPPI(addr uint16) byte {
+	row := emu.PPIPortC & 0x07
+	switch addr & 3 {
+	case 0:
+		return byte(emu.readKeyboardRow(row))
+	case 1:
+		// top nibble is cassette/printer lines, idle high
+		return 0xf0 | byte(emu.readKeyboardRow(row)>>8)
+	case 2:
+		return emu.PPIPortC
+	default:
+		return 0xff // control reg is write only
+	}
+}
+
+func (emu *emuState) writePPI(addr uint16, val byte) {
+	switch addr & 3 {
+	case 2:
+		emu.PPIPortC = val
+	case 3:
+		if val&0x80 != 0 {
+			// mode set: the SC-3000 always uses
+			// mode 0 with A and B in, C out
+			emu.PPIPortC = 0
+		} else {
+			// port C bit set/reset
+			bit := (val >> 1) & 7
+			if val&1 != 0 {
+				emu.PPIPortC |= 1 << bit
+			} else {
+				emu.PPIPortC &^= 1 << bit
+			}
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package segmago
+
+import "testing"
+
+func TestSG1000Options(t *testing.T) {
+	cart := make([]byte, 0x8000)
+	for name, emu := range map[string]Emulator{
+		"sg-1000": NewEmulatorSG1000WithOptions(cart, Options{TV: TVPAL}),
+		"sc-3000": NewEmulatorSC3000WithOptions(cart, Options{TV: TVPAL}),
+	} {
+		if !emu.IsPAL() {
+			t.Errorf("%s ignored -tv pal", name)
+		}
+		emu.HardReset()
+		if !emu.IsPAL() {
+			t.Errorf("%s forgot -tv pal on a hard reset", name)
+		}
+	}
+}
+
+func TestSC3000AtKeyIsntDebugToggle(t *testing.T) {
+	defer func() { showDebugStatusLine = false }()
+
+	emu := NewEmulatorSC3000(make([]byte, 0x8000), false)
+	input := Input{}
+	input.Keys['`'] = true
+	emu.SetInput(input)
+	emu.Step()
+	if showDebugStatusLine {
+		t.Fatal("typing @ on the SC-3000 turned on the debug status line")
+	}
+}
@@ -1,9 +1,12 @@
 package segmago
 
 import (
-	"bytes"
 	"fmt"
-	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/theinternetftw/segmago/disasm"
 )
 
 type emuState struct {
@@ -15,6 +18,15 @@ type emuState struct {
 	VDP     vdp
 	SN76489 sn76489
 
+	// Ports are the two controller ports
+	Ports [2]portBox
+
+	Glasses glasses3D
+
+	// the FM unit, only present on domestic (japanese) consoles
+	YM2413       ym2413
+	FMControlReg byte
+
 	ResetPressed bool
 
 	THAOutput bool
@@ -29,16 +41,51 @@ type emuState struct {
 
 	IsDomesticConsole bool
 
-	IoDisabled bool
+	// MemControlReg is port 0x3e, which picks what's
+	// on the bus: the BIOS, one of the slots, or nothing
+	MemControlReg byte
+	CartSlot      CartSlot
+	IoDisabled    bool
+	RAMDisabled   bool
 
 	IsGameGear            bool
 	GameGearExtDataReg    byte
 	GameGearExtDirReg     byte
 	GameGearSerialSendReg byte
 	GameGearSerialCtrlReg byte
+	GameGearSerialRecvReg byte
+
+	// the EXT port's link cable (see link.go)
+	GameGearRemoteLowPins  byte
+	GameGearSentLowPins    byte
+	GameGearSerialTXCycles uint32
+	link                   LinkTransport
+
+	// IsGGSMSMode is a GG running an SMS game, which
+	// looks like an SMS apart from the BIOS, the colors,
+	// and Start being the pause button
+	IsGGSMSMode bool
+
+	PauseWasPressed bool
+
+	// the SC-3000 is an SG-1000 with a keyboard,
+	// so IsSG1000 is set for both
+	IsSG1000 bool
+	IsSC3000 bool
+	PPIPortC byte
 
 	Cycles uint32
 
+	LastFault *EmuFault
+
+	symbols *disasm.Symbols
+	dbg     *Debugger
+
+	// powerOn makes a brand new emuState, for HardReset
+	powerOn func() *emuState
+
+	channels *AudioChannels
+
 	devMode bool
 }
 
@@ -51,28 +98,99 @@ func (emu *emuState) devPrintln(args ...interface{}) {
 	}
 }
 
+// the port 0x3e bits that enable each slot (0 is enabled)
+var cartSlotEnableBits = [...]byte{
+	SlotCartridge: 0x40,
+	SlotCard:      0x20,
+	SlotExpansion: 0x80,
+}
+
+// memControlRegBooted is what the BIOS leaves in port 0x3e
+// when it boots a cart in the given slot
+func memControlRegBooted(slot CartSlot) byte {
+	return 0xeb &^ cartSlotEnableBits[slot]
+}
+
 func (emu *emuState) setMemControlReg(val byte) {
-	if emu.IsGameGear {
-		// TODO: support enabling the tiny bios in the first k?
+	emu.MemControlReg = val
+	m := &emu.Mem
+	hasBIOS := len(m.BIOSStorage.rom) > 0
+
+	if emu.IsGameGear || emu.IsGGSMSMode {
+		// only the boot rom bit matters, the
+		// cart is always there underneath it
+		m.GGBIOSEnabled = hasBIOS && val&0x08 == 0
+		return
+	}
+
+	cartOn := val&cartSlotEnableBits[emu.CartSlot] == 0
+	biosOn := hasBIOS && val&0x08 == 0
+	if cartOn && biosOn {
+		emu.devPrintln("bus conflict between bios and", emu.CartSlot, "slot, using", emu.CartSlot)
+	}
+	if cartOn {
+		emu.devPrintln("set to cart storage")
+		m.selectedMem = &m.CartStorage
+	} else if biosOn {
+		emu.devPrintln("set to bios storage")
+		m.selectedMem = &m.BIOSStorage
 	} else {
-		if val&0x40 == 0 {
-			emu.devPrintln("set to cart storage")
-			emu.Mem.selectedMem = &emu.Mem.CartStorage
-		} else if val&0x08 == 0 {
-			emu.devPrintln("set to bios storage")
-			emu.Mem.selectedMem = &emu.Mem.BIOSStorage
-		} else {
-			emu.devPrintln("set to null storage")
-			emu.Mem.selectedMem = &emu.Mem.NullStorage
-		}
+		emu.devPrintln("set to null storage")
+		m.selectedMem = &m.NullStorage
+	}
 
-		if val&0x04 == 0 {
-			emu.IoDisabled = false
-			emu.devPrintln("IO Enabled")
-		} else {
-			emu.IoDisabled = true
-			emu.devPrintln("IO Disabled")
-		}
+	emu.RAMDisabled = val&0x10 != 0
+	emu.IoDisabled = val&0x04 != 0
+	emu.devPrintln("RAM disabled:", emu.RAMDisabled, "IO disabled:", emu.IoDisabled)
+}
+
+// resetMemControlReg puts port 0x3e back to
+// how the console (or the bios) powers on
+func (emu *emuState) resetMemControlReg() {
+	if len(emu.Mem.BIOSStorage.rom) > 0 {
+		// the bios starts with just itself enabled
+		emu.setMemControlReg(0xe3)
+	} else {
+		emu.setMemControlReg(memControlRegBooted(emu.CartSlot))
+	}
+}
+
+// softReset is the reset line: the cpu and the cart
+// mappers start over, but all the ram stays as it was
+func (emu *emuState) softReset() {
+	emu.CPU.reset()
+	if len(emu.Mem.BIOSStorage.rom) == 0 {
+		emu.CPU.SP = 0xdfec // as the bios would leave it
+	}
+	emu.Mem.BIOSStorage.resetMapper()
+	emu.Mem.CartStorage.resetMapper()
+	emu.resetMemControlReg()
+}
+
+// hardReset is a power cycle. Only the cart's ram survives.
+func (emu *emuState) hardReset() {
+	fresh := emu.powerOn()
+
+	fresh.Mem.CartStorage.CartRAM = emu.Mem.CartStorage.CartRAM
+	fresh.Mem.CartStorage.CartRAMUsed = emu.Mem.CartStorage.CartRAMUsed
+
+	selectedMem := fresh.Mem.marshallSelectedMem()
+	dbg, symbols, devMode, link := emu.dbg, emu.symbols, emu.devMode, emu.link
+	sampleRate, channels := emu.SN76489.sampleRate, emu.channels
+
+	*emu = *fresh
+	emu.Mem.unmarshallSelectedMem(selectedMem)
+	emu.channels = channels
+	emu.initCallbacks()
+
+	emu.devMode = devMode
+	emu.SetLink(link)
+	emu.SetSampleRate(sampleRate)
+	if symbols != nil {
+		emu.SetSymbols(symbols)
+	}
+	if dbg != nil {
+		dbg.attach(emu)
 	}
 }
 
@@ -83,6 +201,8 @@ func (emu *emuState) setIOControlReg(val byte) {
 	var THBOutputTry, TRBOutputTry bool
 	var THAOutputTry, TRAOutputTry bool
 
+	oldTH := [2]bool{emu.thLevel(0), emu.thLevel(1)}
+
 	boolsFromByte(val,
 		&THBOutputTry,
 		&TRBOutputTry,
@@ -94,6 +214,12 @@ func (emu *emuState) setIOControlReg(val byte) {
 		&TRAInInputMode,
 	)
 
+	// direction and level change together
+	emu.THBInOutputMode = !THBInInputMode
+	emu.TRBInOutputMode = !TRBInInputMode
+	emu.THAInOutputMode = !THAInInputMode
+	emu.TRAInOutputMode = !TRAInInputMode
+
 	if emu.THBInOutputMode {
 		emu.THBOutput = THBOutputTry
 		if emu.THBOutput {
@@ -113,42 +239,69 @@ func (emu *emuState) setIOControlReg(val byte) {
 		emu.TRAOutput = TRAOutputTry
 	}
 
-	emu.THBInOutputMode = !THBInInputMode
-	emu.TRBInOutputMode = !TRBInInputMode
-	emu.THAInOutputMode = !THAInInputMode
-	emu.TRAInOutputMode = !TRAInInputMode
+	for port := range emu.Ports {
+		if th := emu.thLevel(port); th != oldTH[port] {
+			emu.Ports[port].setTH(emu, th)
+		}
+	}
 }
 
-func newState(cart, bios []byte, devMode bool) *emuState {
+func newState(cart, bios []byte, opts Options) *emuState {
+
+	devMode := opts.DevMode
 
 	// strip a header that is only sometimes seen...
-	if len(cart)&0x3fff == 512 {
+	if stripped := stripCopierHeader(cart); len(stripped) != len(cart) {
 		if devMode {
 			fmt.Println("found added header, stripping...")
 		}
-		cart = cart[512:]
+		cart = stripped
 	}
 
 	state := emuState{}
 
 	state.Mem.init(cart, bios)
 
-	state.CPU.Read = state.read
-	state.CPU.Write = state.write
-	state.CPU.In = state.in
-	state.CPU.Out = state.out
-	state.CPU.RunCycles = state.runCycles
+	state.channels = newAudioChannels()
+	state.initCallbacks()
+
+	cartInfo, err := ParseCartHeader(cart)
+	if err != nil {
+		fmt.Println("info: no cart hdr found")
+	} else if devMode {
+		fmt.Printf("cart hdr: product %d v%d, %s, checksum ok: %v\n",
+			cartInfo.ProductCode, cartInfo.Version, cartInfo.RegionName(), cartInfo.ChecksumOK)
+	}
+
+	opts = opts.withROMProfile(cart).resolve(cartInfo)
+	state.IsDomesticConsole = opts.Region == RegionJapan
+	state.plugIn(0, controllerFor(opts.Port1, 0, opts.Peripherals))
+	state.plugIn(1, controllerFor(opts.Port2, 1, opts.Peripherals))
+	state.Glasses.connected = opts.Peripherals&PeripheralGlasses3D != 0
+	state.Mem.CartStorage.setMapperType(opts.Mapper)
+	if opts.CartRAMSize > 0 {
+		state.Mem.CartStorage.CartRAMSize = opts.CartRAMSize
+	}
 
-	checkCart(cart)
+	state.CartSlot = opts.Slot
+	state.resetMemControlReg()
 
-	state.Mem.RAM[0] = 0xab
+	// the bios leaves its last port 0x3e write here
+	state.Mem.RAM[0] = memControlRegBooted(opts.Slot)
 	for i := 1; i < len(state.Mem.RAM); i++ {
 		state.Mem.RAM[i] = 0xff
 	}
-	state.CPU.SP = 0xdfec
+	state.CPU.SP = 0xdfec // as the bios would leave it
+
+	tv := tvNTSC
+	if opts.TV == TVPAL {
+		tv = tvPAL
+	}
+	state.VDP.init(tv)
+	state.VDP.IsSMS1 = opts.VDP == VDPSMS1
 
-	state.SN76489.init()
-	state.VDP.init(tvNTSC)
+	state.SN76489.init(state.clocksPerSecond())
+	state.YM2413.init()
 
 	state.GameGearExtDataReg = 0x7f
 	state.GameGearExtDirReg = 0xff
@@ -159,22 +312,52 @@ func newState(cart, bios []byte, devMode bool) *emuState {
 	return &state
 }
 
-func checkCart(cart []byte) {
-	hdrLocs := []int{0x1ff0, 0x3ff0, 0x7ff0}
-	hdrStart := 0
-	for _, addr := range hdrLocs {
-		if len(cart) < addr+8 {
-			continue
-		}
-		magic := cart[addr : addr+8]
-		if bytes.Equal(magic, []byte("TMR SEGA")) {
-			hdrStart = addr
-			break
-		}
+// initCallbacks hooks up everything that isn't saved in a snapshot
+func (emu *emuState) initCallbacks() {
+	emu.CPU.Read = emu.read
+	emu.CPU.Write = emu.write
+	emu.CPU.In = emu.in
+	emu.CPU.Out = emu.out
+	emu.CPU.Peek = emu.peek
+	emu.CPU.RunCycles = emu.runCycles
+	emu.VDP.regWriteHook = emu.onVDPRegWrite
+	emu.VDP.scanlineHook = emu.onScanline
+	emu.SN76489.mixer = emu.mixFM
+	emu.SN76489.channels = emu.channels
+	emu.YM2413.channels = emu.channels
+	emu.channels.hasFM = emu.hasFM
+}
+
+// hasFM says if the YM2413 is there. It comes
+// built into the japanese SMS, so it's tied to that.
+func (emu *emuState) hasFM() bool {
+	return emu.IsDomesticConsole && !emu.IsGameGear && !emu.IsGGSMSMode && !emu.IsSG1000
+}
+
+// mixFM mixes in the YM2413 according to the
+// audio control reg (port 0xf2): bit 0 turns on
+// FM, and a value of 1 mutes the PSG
+func (emu *emuState) mixFM(left, right float32) (float32, float32) {
+	if !emu.hasFM() {
+		return left, right
 	}
-	if hdrStart == 0 {
-		fmt.Println("info: no cart hdr found")
+	fm := emu.YM2413.takeSample() * fmMixLevel
+	switch emu.FMControlReg & 0x03 {
+	case 1:
+		return fm, fm
+	case 3:
+		return left + fm, right + fm
+	default:
+		return left, right
+	}
+}
+
+// clocksPerSecond is the cpu clock, which also drives the sound chips
+func (emu *emuState) clocksPerSecond() int {
+	if emu.VDP.TVType == tvPAL {
+		return palClocksPerSecond
 	}
+	return ntscClocksPerSecond
 }
 
 func (emu *emuState) runCycles(numCycles uint32) {
@@ -182,6 +365,12 @@ func (emu *emuState) runCycles(numCycles uint32) {
 		emu.Cycles++
 		emu.VDP.runCycle()
 		emu.SN76489.runCycle()
+		if emu.hasFM() {
+			emu.YM2413.runCycle()
+		}
+	}
+	if emu.IsGameGear {
+		emu.runLink(numCycles)
 	}
 
 	emu.CPU.IRQ = (emu.VDP.LineInterruptEnable && emu.VDP.LineInterruptPending) ||
@@ -195,6 +384,17 @@ type Input struct {
 
 	Joypad1 Joypad
 	Joypad2 Joypad
+
+	// PhaserX and PhaserY are where the light phaser
+	// is aimed, in framebuffer pixels (Joypad1.Fire is
+	// its trigger). Off screen (e.g. -1) never sees light.
+	PhaserX, PhaserY int
+
+	// the console's own buttons. Pause triggers
+	// an NMI when pressed, Reset is just read by
+	// the game (see SoftReset for the reset line)
+	Pause bool
+	Reset bool
 }
 
 // Joypad contains gamepad state
@@ -205,60 +405,45 @@ type Joypad struct {
 	Right bool
 	A     bool
 	B     bool
-	Fire  bool // for lightgun
-	Start bool // for Game Gear
+	Start bool // for Game Gear (and Mega Drive pads)
+
+	// Fire is the light phaser's trigger. It also
+	// presses button 1 on the paddle and Sports Pad.
+	Fire bool
+
+	// the rest of the Mega Drive pad's buttons
+	C, X, Y, Z, Mode bool
+
+	// Paddle is the paddle's knob, 0-255
+	Paddle byte
+
+	// TrackballX and TrackballY are how far the Sports Pad's
+	// ball moved since the last Input (right/down is positive)
+	TrackballX, TrackballY int
 }
 
 func (emu *emuState) readJoyReg0() byte {
-	return byteFromBools(
-		!emu.Input.Joypad2.Down,
-		!emu.Input.Joypad2.Up,
-		!emu.Input.Joypad1.B,
-		!emu.Input.Joypad1.A,
-		!emu.Input.Joypad1.Right,
-		!emu.Input.Joypad1.Left,
-		!emu.Input.Joypad1.Down,
-		!emu.Input.Joypad1.Up,
-	)
+	return emu.readPort(0)&0x3f | emu.readPort(1)<<6
 }
 func (emu *emuState) readJoyReg1() byte {
-
-	thB := !emu.Input.Joypad2.Fire
-	thA := !emu.Input.Joypad1.Fire
-
-	// TODO: both export and domestic console differences
-	// (this is export mode, domestic returns 0x00)
-	if emu.THBInOutputMode {
-		if emu.IsDomesticConsole {
-			thB = false
-		} else { // export
-			thB = emu.THBOutput
-		}
-	}
-	if emu.THAInOutputMode {
-		if emu.IsDomesticConsole {
-			thB = false
-		} else { // export
-			thA = emu.THAOutput
-		}
-	}
-
+	portA, portB := emu.readPort(0), emu.readPort(1)
 	return byteFromBools(
-		thB,
-		thA,
+		portB&0x40 != 0, // TH
+		portA&0x40 != 0, // TH
 		true,
 		!emu.ResetPressed,
-		!emu.Input.Joypad2.B,
-		!emu.Input.Joypad2.A,
-		!emu.Input.Joypad2.Right,
-		!emu.Input.Joypad2.Left,
+		portB&0x20 != 0, // TR
+		portB&0x10 != 0, // TL
+		portB&0x08 != 0, // right
+		portB&0x04 != 0, // left
 	)
 }
 
 var showDebugStatusLine = false
 
 func (emu *emuState) step() {
-	if emu.Input.Keys['`'] {
+	// the SC-3000 needs ` for its @ key
+	if emu.Input.Keys['`'] && !emu.IsSC3000 {
 		showDebugStatusLine = !showDebugStatusLine
 	}
 	if showDebugStatusLine {
@@ -267,26 +452,61 @@ func (emu *emuState) step() {
 	emu.CPU.Step()
 }
 
+// stepErr runs step, turning any emulated-hardware
+// error into a fault that halts the emulator. Runtime
+// errors halt it too, but are marked as our own bugs.
+func (emu *emuState) stepErr() (err error) {
+	if emu.LastFault != nil {
+		return emu.LastFault
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case emuErr:
+				emu.LastFault = emu.makeFault(e.Error())
+			case runtime.Error:
+				emu.LastFault = emu.makeFault(e.Error())
+				emu.LastFault.Internal = true
+				emu.LastFault.Stack = string(debug.Stack())
+			default:
+				panic(r)
+			}
+			emu.devPrintln(emu.LastFault)
+			err = emu.LastFault
+		}
+	}()
+	if emu.dbg != nil {
+		if !emu.dbg.beforeStep() {
+			return nil
+		}
+		emu.step()
+		emu.dbg.afterStep()
+	} else {
+		emu.step()
+	}
+	return nil
+}
+
+// NOTE: the helpers below panic with an emuErr, which
+// stepErr recovers into an EmuFault. Don't call them
+// from outside of a step.
+
 func errOut(v ...interface{}) {
-	fmt.Println(v...)
-	os.Exit(1)
+	panic(emuErr(strings.TrimSuffix(fmt.Sprintln(v...), "\n")))
 }
 
 func fatalErr(v ...interface{}) {
-	fmt.Println(v...)
-	panic("fatalErr()")
+	panic(emuErr(strings.TrimSuffix(fmt.Sprintln(v...), "\n")))
 }
 
 func assert(test bool, msg string) {
 	if !test {
-		fmt.Println(msg)
-		os.Exit(1)
+		panic(emuErr(msg))
 	}
 }
 
 func dieIf(err error) {
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		panic(emuErr(err.Error()))
 	}
 }
@@ -1,10 +1,14 @@
 package segmago
 
+import "math"
+
 const (
-	amountToStore    = 16 * 512 * 4 // must be power of 2
-	samplesPerSecond = 44100
+	amountToStore = 16 * 512 * 4 // must be power of 2
+
+	defaultSampleRate = 44100
 
 	ntscClocksPerSecond = 3579545
+	palClocksPerSecond  = 3546893
 )
 
 type sn76489 struct {
@@ -14,20 +18,41 @@ type sn76489 struct {
 	LatchedSound   *sound
 	LatchIsForData bool
 
-	ClocksPerSample int32
+	// StereoMixerReg is the GG's port 0x06: bits 4-7 put
+	// channels 0-3 on the left, bits 0-3 on the right
+	StereoMixerReg byte
+
+	Clock int32
+
+	variant psgVariant
+
+	// output rate, set by the host
+	clocksPerSecond int
+	sampleRate      int
 
-	SumLeft        int32
-	SumRight       int32
-	SampleSumCount int32
+	// the blip buffers: time is in output samples (32.32
+	// fixed point), levels are what's in each buffer
+	time      uint64
+	timeStep  uint64
+	samplePos uint64
+	blips     [2]blipBuf
+	levels    [4][2]float32
 
 	lastOutputLeft           float32
 	lastOutputRight          float32
 	lastCorrectedOutputLeft  float32
 	lastCorrectedOutputRight float32
 
-	StereoMixerReg byte
+	// for muting and scopes
+	channels *AudioChannels
 
-	Clock int32
+	// mixer, if set, mixes other chips into each finished sample
+	mixer func(left, right float32) (float32, float32)
+
+	// while RunFrame is capturing, samples go straight into
+	// frameAudio, so a long frame can't fill up the buffer
+	capturing  bool
+	frameAudio []byte
 }
 
 const apuCircleBufSize = amountToStore
@@ -66,6 +91,26 @@ func (c *apuCircleBuf) mask(i uint32) uint32 { return i & (uint32(len(c.buf)) -
 func (c *apuCircleBuf) size() uint32         { return c.writeIndex - c.readIndex }
 func (c *apuCircleBuf) full() bool           { return c.size() == uint32(len(c.buf)) }
 
+// psgVariant is what differs between the SN76489s out there
+type psgVariant struct {
+	Feedback uint16 // the LFSR's taps for white noise
+	Width    uint   // the LFSR's length
+
+	Freq0Is400 bool // a 0 period is 0x400, not a held high output
+	Negate     bool // the output is inverted
+	XNOR       bool // white noise feeds back with xnor
+	NoStereo   bool // no GG stereo mixer
+
+	Divider int32 // clocks per channel tick
+}
+
+var (
+	// the PSG built into sega's VDPs
+	psgSega = psgVariant{Feedback: 0x0009, Width: 16, Divider: 16}
+	// the discrete TI chip, as in the SG-1000, SC-3000 and BBC Micro
+	psgSN76489AN = psgVariant{Feedback: 0x0003, Width: 15, Freq0Is400: true, Negate: true, Divider: 16}
+)
+
 type sound struct {
 	Volume  byte
 	Data    uint16
@@ -77,89 +122,194 @@ type sound struct {
 	LFSR       uint16
 }
 
-func (s *sn76489) init() {
+// volumeTable is the PSG's attenuation, 2dB a step, with 15 as off.
+// Each channel gets a quarter of the range.
+var volumeTable = func() [16]float32 {
+	var tbl [16]float32
+	for i := 0; i < 15; i++ {
+		tbl[i] = 0.25 * float32(math.Pow(10, -0.1*float64(i)))
+	}
+	return tbl
+}()
+
+func (s *sn76489) init(clocksPerSecond int) {
 	for i := range s.Sounds {
 		s.Sounds[i].Volume = 0x0f
 	}
 	s.Sounds[3].IsNoise = true
 	s.LatchedSound = &s.Sounds[0]
 
-	f := ntscClocksPerSecond / samplesPerSecond
-	s.ClocksPerSample = int32(f)
+	s.variant = psgSega
+	s.setRates(clocksPerSecond, defaultSampleRate)
 
 	s.StereoMixerReg = 0xff
 }
 
+// setRates sets the chip's clock and the output's sample rate
+func (s *sn76489) setRates(clocksPerSecond, sampleRate int) {
+	if sampleRate <= 0 {
+		sampleRate = defaultSampleRate
+	}
+	s.clocksPerSecond = clocksPerSecond
+	s.sampleRate = sampleRate
+	s.timeStep = uint64(sampleRate) * uint64(s.variant.Divider) << 32 / uint64(clocksPerSecond)
+}
+
+func (s *sn76489) setVariant(v psgVariant) {
+	s.variant = v
+	s.Clock = 0
+	for i := range s.Sounds {
+		s.Sounds[i].LFSR = s.lfsrReset()
+	}
+	s.setRates(s.clocksPerSecond, s.sampleRate)
+}
+
+func (s *sn76489) lfsrReset() uint16 {
+	return 1 << (s.variant.Width - 1)
+}
+
+// period gives the counter reload for a tone value
+func (s *sn76489) period(data uint16) uint16 {
+	if data == 0 && s.variant.Freq0Is400 {
+		return 0x400
+	}
+	return data
+}
+
 func (s *sn76489) readSoundBuffer(toFill []byte) {
 	if int(s.buffer.size()) < len(toFill) {
 		//fmt.Println("audSize:", s.buffer.size(), "len(toFill)", len(toFill))
 	}
 	for int(s.buffer.size()) < len(toFill) {
 		// stretch sound to fill buffer to avoid click
-		s.genSample()
+		s.clock()
 	}
 	s.buffer.read(toFill)
 }
 
-func (s *sn76489) genSample() {
+func (s *sn76489) clock() {
 	if s.Clock == 0 {
-		for i := range s.Sounds {
-			s.runSoundCycle(&s.Sounds[i])
-		}
+		s.tick()
+	}
+	s.Clock++
+	if s.Clock >= s.variant.Divider {
+		s.Clock = 0
+	}
+}
 
-		for i := range s.Sounds {
-			sound := &s.Sounds[i]
-			sample := int32(sound.Output * (15 - sound.Volume))
-			if s.StereoMixerReg>>uint32(i)&1 > 0 {
-				s.SumLeft += sample
+// tick runs the channels, adding any change in their
+// output to the blip buffers at this exact time, then
+// finishes any samples nothing else can land on
+func (s *sn76489) tick() {
+	for i := range s.Sounds {
+		s.runSoundCycle(&s.Sounds[i])
+	}
+
+	pos, phase := s.time>>32, int(s.time>>(32-blipPhaseBits))&(blipPhases-1)
+	for i := range s.Sounds {
+		sound := &s.Sounds[i]
+		level := float32(0)
+		if (sound.Output != 0) != s.variant.Negate && s.channels.Heard(i) {
+			level = volumeTable[sound.Volume]
+		}
+		for side := 0; side < 2; side++ {
+			// left is the high nibble
+			on := s.StereoMixerReg>>uint(4*(1-side)+i)&1 != 0 || s.variant.NoStereo
+			sideLevel := float32(0)
+			if on {
+				sideLevel = level
 			}
-			if s.StereoMixerReg>>uint32(4+i)&1 > 0 {
-				s.SumRight += sample
+			if delta := sideLevel - s.levels[i][side]; delta != 0 {
+				s.blips[side].addDelta(pos, phase, delta)
+				s.levels[i][side] = sideLevel
 			}
 		}
+	}
 
-		s.SampleSumCount++
-		if s.SampleSumCount >= s.ClocksPerSample>>4 {
-
-			outLeft := float32(s.SumLeft)
-			outLeft /= 15.0 * float32(s.SampleSumCount*4) // 15 vol levels
-
-			outRight := float32(s.SumRight)
-			outRight /= 15.0 * float32(s.SampleSumCount*4) // 15 vol levels
-
-			s.SumLeft = 0
-			s.SumRight = 0
-			s.SampleSumCount = 0
-
-			// dc blocker to center waveform
-			correctedOutputLeft := outLeft - s.lastOutputLeft + 0.995*s.lastCorrectedOutputLeft
-			s.lastCorrectedOutputLeft = correctedOutputLeft
-			s.lastOutputLeft = outLeft
-			outLeft = correctedOutputLeft
-
-			// dc blocker to center waveform
-			correctedOutputRight := outRight - s.lastOutputRight + 0.995*s.lastCorrectedOutputRight
-			s.lastCorrectedOutputRight = correctedOutputRight
-			s.lastOutputRight = outRight
-			outRight = correctedOutputRight
-
-			sampleLeft := int16(outLeft * 32767.0)
-			sampleRight := int16(outRight * 32767.0)
-			s.buffer.write([]byte{
-				byte(sampleLeft & 0xff), byte(sampleLeft >> 8),
-				byte(sampleRight & 0xff), byte(sampleRight >> 8),
-			})
+	s.time += s.timeStep
+	for s.samplePos < s.time>>32 {
+		left := s.blips[0].take(s.samplePos)
+		right := s.blips[1].take(s.samplePos)
+		s.samplePos++
+		s.emitSample(left, right)
+		s.tapScopes()
+	}
+}
+
+func (s *sn76489) tapScopes() {
+	if s.channels == nil {
+		return
+	}
+	for i := range s.Sounds {
+		// volumeTable tops out at a quarter
+		val := 4 * volumeTable[s.Sounds[i].Volume]
+		if s.Sounds[i].Output == 0 {
+			val = -val
 		}
+		s.channels.tap(i, val)
+	}
+}
+
+func (s *sn76489) emitSample(outLeft, outRight float32) {
+	// dc blocker to center waveform
+	correctedOutputLeft := outLeft - s.lastOutputLeft + 0.995*s.lastCorrectedOutputLeft
+	s.lastCorrectedOutputLeft = correctedOutputLeft
+	s.lastOutputLeft = outLeft
+	outLeft = correctedOutputLeft
+
+	// dc blocker to center waveform
+	correctedOutputRight := outRight - s.lastOutputRight + 0.995*s.lastCorrectedOutputRight
+	s.lastCorrectedOutputRight = correctedOutputRight
+	s.lastOutputRight = outRight
+	outRight = correctedOutputRight
+
+	if s.mixer != nil {
+		outLeft, outRight = s.mixer(outLeft, outRight)
+	}
+	outLeft, outRight = clampSample(outLeft), clampSample(outRight)
+
+	sampleLeft := int16(outLeft * 32767.0)
+	sampleRight := int16(outRight * 32767.0)
+	sample := []byte{
+		byte(sampleLeft & 0xff), byte(sampleLeft >> 8),
+		byte(sampleRight & 0xff), byte(sampleRight >> 8),
+	}
+	if s.capturing {
+		s.frameAudio = append(s.frameAudio, sample...)
+	} else {
+		s.buffer.write(sample)
+	}
+}
+
+// startCapture sends samples to frameAudio until stopCapture
+func (s *sn76489) startCapture() {
+	s.capturing = true
+	s.frameAudio = make([]byte, 0, s.sampleRate/50*4)
+}
+
+func (s *sn76489) stopCapture() []byte {
+	s.capturing = false
+	audio := s.frameAudio
+	s.frameAudio = nil
+	return audio
+}
+
+func clampSample(f float32) float32 {
+	if f > 1 {
+		return 1
+	}
+	if f < -1 {
+		return -1
 	}
-	s.Clock = (s.Clock + 1) & 0x0f
+	return f
 }
 
 var newBufFull = false
 
 func (s *sn76489) runCycle() {
 
-	if !s.buffer.full() {
-		s.genSample()
+	if s.capturing || !s.buffer.full() {
+		s.clock()
 		newBufFull = true
 	} else if newBufFull {
 		//fmt.Println("sn buf full!")
@@ -167,35 +317,95 @@ func (s *sn76489) runCycle() {
 	}
 }
 
+// A blipBuf turns steps in a channel's output into band-limited
+// steps, so tones above the output's nyquist don't alias. Each
+// step adds a windowed sinc (at one of blipPhases sub-sample
+// offsets) to the ring, and the output is the running sum.
+const (
+	blipTaps      = 16
+	blipPhaseBits = 6
+	blipPhases    = 1 << blipPhaseBits
+	blipRingSize  = 64 // power of 2, more than blipTaps
+	blipCutoff    = 0.45
+)
+
+type blipBuf struct {
+	ring  [blipRingSize]float32
+	level float32
+}
+
+var blipKernel = func() [blipPhases][blipTaps]float32 {
+	var kernel [blipPhases][blipTaps]float32
+	for p := range kernel {
+		sum := 0.0
+		vals := [blipTaps]float64{}
+		for i := range vals {
+			// distance from the step, centered in the taps
+			d := float64(i) - (blipTaps/2 - 1) - float64(p)/blipPhases
+			x := 2 * blipCutoff * d
+			sinc := 1.0
+			if x != 0 {
+				sinc = math.Sin(math.Pi*x) / (math.Pi * x)
+			}
+			w := d / (blipTaps / 2)
+			blackman := 0.42 + 0.5*math.Cos(math.Pi*w) + 0.08*math.Cos(2*math.Pi*w)
+			vals[i] = sinc * blackman
+			sum += vals[i]
+		}
+		for i := range vals {
+			kernel[p][i] = float32(vals[i] / sum)
+		}
+	}
+	return kernel
+}()
+
+func (b *blipBuf) addDelta(pos uint64, phase int, delta float32) {
+	k := &blipKernel[phase]
+	for i := range k {
+		b.ring[(pos+uint64(i))&(blipRingSize-1)] += delta * k[i]
+	}
+}
+
+// take finishes the sample at pos
+func (b *blipBuf) take(pos uint64) float32 {
+	i := pos & (blipRingSize - 1)
+	b.level += b.ring[i]
+	b.ring[i] = 0
+	return b.level
+}
+
 func (s *sn76489) runSoundCycle(snd *sound) {
 	if snd.IsNoise {
 		snd.Counter--
 		if snd.Counter == 0 {
 			tbl := []uint16{
-				0x10, 0x20, 0x40, s.Sounds[2].Data,
+				0x10, 0x20, 0x40, s.period(s.Sounds[2].Data),
 			}
 			snd.Counter = tbl[snd.Data&3]
 			snd.NoiseClock = !snd.NoiseClock
 			if snd.NoiseClock {
 				snd.Output = byte(snd.LFSR & 1)
-				// TODO: LFSR variants (e.g. bbc micro has 15-bit LFSR, taps bits 0 and 1)
 				var newBit uint16
 				if snd.Data&0x04 > 0 {
-					newBit = ((snd.LFSR & 1) ^ (snd.LFSR >> 3)) & 1
+					newBit = parity16(snd.LFSR & s.variant.Feedback)
+					if s.variant.XNOR {
+						newBit ^= 1
+					}
 				} else {
 					newBit = snd.LFSR & 1
 				}
 				snd.LFSR >>= 1
-				snd.LFSR |= newBit << 15
+				snd.LFSR |= newBit << (s.variant.Width - 1)
 			}
 		}
 	} else {
 		snd.Counter--
 		if snd.Counter == 0 {
-			snd.Counter = snd.Data
+			snd.Counter = s.period(snd.Data)
 			snd.Output ^= 1
 		}
-		if snd.Data == 0 || snd.Data == 1 {
+		if (snd.Data == 0 || snd.Data == 1) && !s.variant.Freq0Is400 {
+			// sega's PSG holds these high, which games use for samples
 			snd.Output = 1
 		}
 	}
@@ -209,7 +419,7 @@ func (s *sn76489) sendByte(b byte) {
 		if s.LatchIsForData {
 			s.Sounds[i].Data &^= 0x0f
 			s.Sounds[i].Data |= uint16(b & 0x0f)
-			s.Sounds[i].LFSR = 0x8000
+			s.Sounds[i].LFSR = s.lfsrReset()
 		} else {
 			s.Sounds[i].Volume &^= 0x0f
 			s.Sounds[i].Volume |= b & 0x0f
@@ -221,7 +431,7 @@ func (s *sn76489) sendByte(b byte) {
 			if latch.IsNoise {
 				latch.Data &^= 0x0f
 				latch.Data |= uint16(b & 0x0f)
-				latch.LFSR = 0x8000
+				latch.LFSR = s.lfsrReset()
 			} else {
 				latch.Data &^= 0x3f0
 				latch.Data |= uint16(b&0x3f) << 4
@@ -232,3 +442,11 @@ func (s *sn76489) sendByte(b byte) {
 		}
 	}
 }
+
+func parity16(v uint16) uint16 {
+	v ^= v >> 8
+	v ^= v >> 4
+	v ^= v >> 2
+	v ^= v >> 1
+	return v & 1
+}
@@ -9,7 +9,7 @@ import (
 	"io/ioutil"
 )
 
-const currentSnapshotVersion = 1
+const currentSnapshotVersion = 4
 
 const infoString = "segmago snapshot"
 
@@ -51,17 +51,25 @@ func (emu *emuState) convertLatestSnapshot(snap *snapshot) (*emuState, error) {
 
 	newState.Mem.unmarshallSelectedMem(snap.SelectedMem)
 
-	newState.Mem.CartStorage.rom = emu.Mem.CartStorage.rom
-	newState.Mem.BIOSStorage.rom = emu.Mem.BIOSStorage.rom
-	newState.Mem.NullStorage.rom = emu.Mem.NullStorage.rom
+	newState.Mem.CartStorage.setROM(emu.Mem.CartStorage.loadedROM)
+	newState.Mem.BIOSStorage.setROM(emu.Mem.BIOSStorage.loadedROM)
+	newState.Mem.NullStorage.setROM(emu.Mem.NullStorage.loadedROM)
+	newState.Glasses.connected = emu.Glasses.connected
 
-	newState.CPU.Write = newState.write
-	newState.CPU.Read = newState.read
-	newState.CPU.In = newState.in
-	newState.CPU.Out = newState.out
-	newState.CPU.RunCycles = newState.runCycles
+	newState.channels = emu.channels
+	newState.initCallbacks()
 
 	newState.devMode = emu.devMode
+	newState.powerOn = emu.powerOn
+	newState.SN76489.variant = emu.SN76489.variant
+	newState.SN76489.setRates(newState.clocksPerSecond(), emu.SN76489.sampleRate)
+	newState.SetLink(emu.link)
+	if emu.symbols != nil {
+		newState.SetSymbols(emu.symbols)
+	}
+	if emu.dbg != nil {
+		emu.dbg.attach(&newState)
+	}
 
 	return &newState, nil
 }
@@ -73,6 +81,88 @@ var snapshotConverters = map[int]func(map[string]interface{}) error{
 	// Converters should look like this (including comment):
 	// added 2017-XX-XX
 	// 1: convertSnap0To1,
+
+	// added 2026-10-18
+	2: convertSnap1To2,
+
+	// added 2026-10-18
+	3: convertSnap2To3,
+
+	// added 2026-10-18
+	4: convertSnap3To4,
+}
+
+// convertSnap1To2 moves the mapper fields in each storage
+// into the Mapper, which now knows its own type
+func convertSnap1To2(state map[string]interface{}) error {
+	mem, ok := state["Mem"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("no Mem in snapshot")
+	}
+	for _, name := range []string{"BIOSStorage", "CartStorage", "NullStorage"} {
+		s, ok := mem[name].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("no %s in snapshot", name)
+		}
+		banks := []interface{}{s["Page0Bank"], s["Page1Bank"], s["Page2Bank"]}
+		isCodemasters, _ := s["IsCodemastersMapper"].(bool)
+		isStd, _ := s["IsStdMapper"].(bool)
+		if isCodemasters {
+			s["Mapper"] = map[string]interface{}{
+				"Type":  MapperCodemasters,
+				"State": map[string]interface{}{"Banks": banks},
+			}
+		} else {
+			s["Mapper"] = map[string]interface{}{
+				"Type": MapperSega,
+				"State": map[string]interface{}{
+					"Banks":          banks,
+					"CartRAMPagedIn": s["CartRAMPagedIn"],
+					"PageRAMBank":    s["PageRAMBank"],
+				},
+			}
+		}
+		s["DetectingMapper"] = !isCodemasters && !isStd
+		// all of cart ram used to be saved
+		s["CartRAMUsed"] = 32 * 1024
+		for _, old := range []string{"IsCodemastersMapper", "IsStdMapper", "CartRAMPagedIn", "PageRAMBank", "Page0Bank", "Page1Bank", "Page2Bank"} {
+			delete(s, old)
+		}
+	}
+	return nil
+}
+
+// convertSnap2To3 sets the VDP's IsGameGear, which used
+// to wait for the first CRAM write
+func convertSnap2To3(state map[string]interface{}) error {
+	vdp, ok := state["VDP"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("no VDP in snapshot")
+	}
+	vdp["IsGameGear"] = state["IsGameGear"]
+	return nil
+}
+
+// convertSnap3To4 plugs in the controllers, which
+// used to be hardwired (apart from the phaser)
+func convertSnap3To4(state map[string]interface{}) error {
+	port1, port2 := ControllerJoypad, ControllerJoypad
+	if phaser, ok := state["Phaser"].(map[string]interface{}); ok {
+		if connected, _ := phaser["Connected"].(bool); connected {
+			port1 = ControllerPhaser
+		}
+	}
+	isGG, _ := state["IsGameGear"].(bool)
+	isGGSMS, _ := state["IsGGSMSMode"].(bool)
+	if isGG || isGGSMS {
+		port2 = ControllerNone
+	}
+	state["Ports"] = []interface{}{
+		map[string]interface{}{"Type": port1, "State": map[string]interface{}{}},
+		map[string]interface{}{"Type": port2, "State": map[string]interface{}{}},
+	}
+	delete(state, "Phaser")
+	return nil
 }
 
 func (emu *emuState) convertOldSnapshot(snap *snapshot) (*emuState, error) {
@@ -83,8 +173,8 @@ func (emu *emuState) convertOldSnapshot(snap *snapshot) (*emuState, error) {
 	}
 
 	for i := snap.Version; i < currentSnapshotVersion; i++ {
-		if converterFn, ok := snapshotConverters[snap.Version]; !ok {
-			return nil, fmt.Errorf("unknown snapshot version: %v", snap.Version)
+		if converterFn, ok := snapshotConverters[i+1]; !ok {
+			return nil, fmt.Errorf("unknown snapshot version: %v", i)
 		} else if err := converterFn(state); err != nil {
 			return nil, fmt.Errorf("error converting snapshot version %v: %v", i, err)
 		}
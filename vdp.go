@@ -38,6 +38,7 @@ type vdp struct {
 	ScrollY uint16
 
 	SMSBackdropCplane byte
+	TMS9918TextColor  byte
 
 	SpriteList [9]sprite // extra is used for overflow check
 	NumSprites byte
@@ -50,6 +51,7 @@ type vdp struct {
 	FrameInterruptPending bool
 	SpriteOverflow        bool
 	SpriteCollision       bool
+	FifthSpriteNum        byte
 
 	DisableVertScrollForRightSide bool
 	DisableHorizScrollForTop      bool
@@ -82,16 +84,26 @@ type vdp struct {
 
 	IsGameGear bool
 
+	// IsGGSMSMode is a GG running an SMS game: SMS
+	// style CRAM, but the colors go through the GG's lcd
+	IsGGSMSMode bool
+
+	// the SMS1 VDP lacks the 224/240 line modes
+	// and has the name table mask quirk
+	IsSMS1 bool
+
 	CPUClock byte
+
+	regWriteHook func(regNum, val byte)
+	scanlineHook func(y uint16)
 }
 
-func (v *vdp) writeDataPort(val byte, isGameGear bool) {
+func (v *vdp) writeDataPort(val byte) {
 	switch v.CodeReg {
 	case 0, 1, 2:
 		v.VRAM[v.AddrReg] = val
 	case 3:
-		if isGameGear {
-			v.IsGameGear = true
+		if v.IsGameGear {
 			if v.AddrReg&1 == 0 {
 				v.GGColorLatch = val
 			} else {
@@ -207,6 +219,21 @@ func (v *vdp) drawColor(x, y uint16, r, g, b byte) {
 	v.framebuffer[base+3] = 0xff
 }
 
+// brightNear says if line y has a bright pixel within r of x
+func (v *vdp) brightNear(x int, y uint16, r int) bool {
+	for px := x - r; px <= x+r; px++ {
+		if px < 0 || px >= 256 {
+			continue
+		}
+		base := int(y)*256*4 + px*4
+		fb := v.framebuffer[base : base+3]
+		if int(fb[0])+int(fb[1])+int(fb[2]) >= phaserMinBrightness {
+			return true
+		}
+	}
+	return false
+}
+
 type nameTableEntry struct {
 	patternNum    uint16
 	hFlip         bool
@@ -224,6 +251,11 @@ func (v *vdp) getNameTableEntry(tileX, tileY uint16) nameTableEntry {
 	}
 
 	addr := baseAddr + ((tileY << 6) | tileX<<1)
+	if v.IsSMS1 && v.SMSNameTableMaskBit == 0 {
+		// reg 2 bit 0 gets ANDed with addr bit 10,
+		// so the bottom of the screen mirrors the top
+		addr &^= 0x0400
+	}
 	rawEntry := uint16(v.VRAM[addr]) | uint16(v.VRAM[addr+1])<<8
 
 	return nameTableEntry{
@@ -250,6 +282,9 @@ func (v *vdp) getPatternCplanes(patternNum, x, y uint16) byte {
 }
 
 func (v *vdp) getRGB(vdpCol byte) (byte, byte, byte) {
+	if v.IsGGSMSMode {
+		return v.ggGetRGB(ggColorFromSMS(vdpCol))
+	}
 	r := (vdpCol & 3) << 6
 	g := (vdpCol >> 2 & 3) << 6
 	b := (vdpCol >> 4 & 3) << 6
@@ -263,6 +298,15 @@ func (v *vdp) ggGetRGB(ggCol uint16) (byte, byte, byte) {
 	return r, g, b
 }
 
+// ggColorFromSMS is the GG's fixed conversion of SMS
+// colors in SMS mode, each 2 bits stretched to 4
+func ggColorFromSMS(smsCol byte) uint16 {
+	r := uint16(smsCol&3) * 5
+	g := uint16(smsCol>>2&3) * 5
+	b := uint16(smsCol>>4&3) * 5
+	return b<<8 | g<<4 | r
+}
+
 type sprite struct {
 	X, Y       uint16
 	PatternNum uint16
@@ -337,6 +381,11 @@ func (v *vdp) getSpriteCplanes(sp sprite, x, y uint16) byte {
 
 func (v *vdp) renderScanline(y uint16) {
 
+	if !v.RegM4 {
+		v.renderLegacyScanline(y)
+		return
+	}
+
 	scrollY := v.ScrollY
 	scrollX := v.ScrollX
 
@@ -495,6 +544,9 @@ func (v *vdp) runCycle() {
 
 			if v.ScreenY < v.ModeHeight {
 				v.renderScanline(v.ScreenY)
+				if v.scanlineHook != nil {
+					v.scanlineHook(v.ScreenY)
+				}
 			}
 
 			v.ScreenX = 0
@@ -526,9 +578,14 @@ func (v *vdp) runCycle() {
 }
 
 func (v *vdp) updateMode() {
-	assert(v.RegM4, "Non mode4-based modes are not implemented")
+	if !v.RegM4 {
+		v.ModeHeight = 192 // TMS9918 modes are always 192 lines
+		return
+	}
 	m3, m2, m1 := v.RegM3, v.RegM2, v.RegM1
-	if !m3 && !m2 && !m1 {
+	if v.IsSMS1 {
+		v.ModeHeight = 192
+	} else if !m3 && !m2 && !m1 {
 		v.ModeHeight = 192 // normal Mode 4
 	} else if !m3 && m2 && m1 {
 		v.ModeHeight = 224
@@ -537,7 +594,11 @@ func (v *vdp) updateMode() {
 	} else if m3 && !m2 && !m1 {
 		v.ModeHeight = 192 // normal Mode 4
 	} else if m3 && m2 && !m1 {
-		v.ModeHeight = 240 // TODO: set PAL?
+		if v.TVType == tvPAL {
+			v.ModeHeight = 240
+		} else {
+			v.ModeHeight = 192 // no room for 240 lines in an NTSC frame
+		}
 	} else if m3 && m2 && m1 {
 		v.ModeHeight = 192 // normal Mode 4
 	} else {
@@ -578,13 +639,10 @@ func (v *vdp) setReg(regNum byte, val byte) {
 	case 2:
 		v.TMS9918NameTableAddr = uint16(val & 0x0f)
 		v.SMSNameTableAddr = uint16((val>>1)&0x07) << 11
-		v.SMSNameTableMaskBit = uint16(val & 1) // TODO use?
+		v.SMSNameTableMaskBit = uint16(val & 1) // see getNameTableEntry
 
 	case 3:
-		// FIXME: noting here in case I want to implement sg-1000 mode
-		// that i'm unsure on the masking/shifting in this and the other
-		// tms99918-only tables.
-
+		// TMS9918 table regs are kept raw, see vdpLegacy.go
 		v.TMS9918ColortableAddr = uint16(val)
 
 	case 4:
@@ -603,6 +661,7 @@ func (v *vdp) setReg(regNum byte, val byte) {
 
 	case 7:
 		v.SMSBackdropCplane = val & 0x0f
+		v.TMS9918TextColor = val >> 4
 
 	case 8:
 		v.ScrollX = uint16(val)
@@ -630,7 +689,11 @@ func (v *vdp) writeControlPort(val byte) {
 			v.BufferReg = v.VRAM[v.AddrReg]
 			v.AddrReg++
 		case 2:
-			v.setReg(byte(v.AddrReg>>8&0x0f), byte(v.AddrReg))
+			regNum, regVal := byte(v.AddrReg>>8&0x0f), byte(v.AddrReg)
+			if v.regWriteHook != nil {
+				v.regWriteHook(regNum, regVal)
+			}
+			v.setReg(regNum, regVal)
 		}
 	}
 }
@@ -646,6 +709,9 @@ func (v *vdp) readControlPort() byte {
 		false,
 		false,
 	)
+	if !v.RegM4 {
+		val |= v.FifthSpriteNum & 0x1f
+	}
 	v.OnSecondControlByte = false
 	v.LineInterruptPending = false
 	v.FrameInterruptPending = false
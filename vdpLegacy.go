@@ -0,0 +1,290 @@
+package segmago
+
+// The TMS9918 modes the SMS VDP inherited from the SG-1000.
+// Unlike mode 4, these use a fixed palette, 1bpp patterns
+// with per-8-pixel colors, and 4 mono sprites per line.
+
+type legacyMode int
+
+const (
+	legacyGraphics1 legacyMode = iota
+	legacyGraphics2
+	legacyText
+	legacyMulticolor
+)
+
+// initTMS9918 starts in Graphics I mode, for
+// systems that don't have a mode 4 bios
+func (v *vdp) initTMS9918() {
+	v.RegM4 = false
+	v.RegM2 = false
+	v.LineInterruptEnable = false
+	v.updateMode()
+}
+
+func (v *vdp) getLegacyMode() legacyMode {
+	switch {
+	case v.RegM1:
+		return legacyText
+	case v.RegM2:
+		return legacyGraphics2
+	case v.RegM3:
+		return legacyMulticolor
+	default:
+		return legacyGraphics1
+	}
+}
+
+// rgb for each of the 16 TMS9918 colors (0 is transparent)
+var tmsPalette = [16][3]byte{
+	{0, 0, 0},
+	{0, 0, 0},
+	{33, 200, 66},
+	{94, 220, 120},
+	{84, 85, 237},
+	{125, 118, 252},
+	{212, 82, 77},
+	{66, 235, 245},
+	{252, 85, 84},
+	{255, 121, 120},
+	{212, 193, 84},
+	{230, 206, 128},
+	{33, 176, 59},
+	{201, 91, 186},
+	{204, 204, 204},
+	{255, 255, 255},
+}
+
+// NOTE: the TMS9918 table fields hold the raw reg bits,
+// the addrs are worked out here.
+
+func (v *vdp) tmsNameTableAddr() uint16 {
+	return v.TMS9918NameTableAddr << 10
+}
+func (v *vdp) tmsPatternTableAddr() uint16 {
+	return (v.TMS9918TileAddr & 0x07) << 11
+}
+func (v *vdp) tmsColorTableAddr() uint16 {
+	return v.TMS9918ColortableAddr << 6
+}
+func (v *vdp) tmsSpriteAttrTableAddr() uint16 {
+	return v.TMS9918SpriteAttrTableAddr << 7
+}
+func (v *vdp) tmsSpritePatternTableAddr() uint16 {
+	return v.TMS9918SpriteTileTableAddr << 11
+}
+
+// getLegacyBGColors returns the color indexes for the
+// background at line y, with 0 meaning backdrop
+func (v *vdp) getLegacyBGColors(y uint16) [256]byte {
+	colors := [256]byte{}
+
+	tileY := y / 8
+	row := y & 7
+	nameBase := v.tmsNameTableAddr()
+
+	switch v.getLegacyMode() {
+
+	case legacyGraphics1:
+		patBase := v.tmsPatternTableAddr()
+		colBase := v.tmsColorTableAddr()
+		for tileX := uint16(0); tileX < 32; tileX++ {
+			name := uint16(v.VRAM[nameBase+tileY*32+tileX])
+			pattern := v.VRAM[patBase+name*8+row]
+			color := v.VRAM[colBase+name/8]
+			v.drawLegacyPatternLine(colors[:], tileX*8, pattern, color)
+		}
+
+	case legacyGraphics2:
+		// reg 3 and 4's low bits act as masks on the table index
+		patBase := (v.TMS9918TileAddr & 0x04) << 11
+		patMask := (v.TMS9918TileAddr&0x03)<<8 | 0xff
+		colBase := (v.TMS9918ColortableAddr & 0x80) << 6
+		colMask := (v.TMS9918ColortableAddr&0x7f)<<3 | 0x07
+		third := tileY / 8
+		for tileX := uint16(0); tileX < 32; tileX++ {
+			idx := third<<8 | uint16(v.VRAM[nameBase+tileY*32+tileX])
+			pattern := v.VRAM[patBase+(idx&patMask)*8+row]
+			color := v.VRAM[colBase+(idx&colMask)*8+row]
+			v.drawLegacyPatternLine(colors[:], tileX*8, pattern, color)
+		}
+
+	case legacyText:
+		// 40 6px columns, with an 8px border on each side
+		patBase := v.tmsPatternTableAddr()
+		fg, bg := v.TMS9918TextColor, v.SMSBackdropCplane
+		for tileX := uint16(0); tileX < 40; tileX++ {
+			name := uint16(v.VRAM[nameBase+tileY*40+tileX])
+			pattern := v.VRAM[patBase+name*8+row]
+			for i := uint16(0); i < 6; i++ {
+				if pattern&(0x80>>i) != 0 {
+					colors[8+tileX*6+i] = fg
+				} else {
+					colors[8+tileX*6+i] = bg
+				}
+			}
+		}
+
+	case legacyMulticolor:
+		// each pattern byte is two 4x4 blocks of color
+		patBase := v.tmsPatternTableAddr()
+		for tileX := uint16(0); tileX < 32; tileX++ {
+			name := uint16(v.VRAM[nameBase+tileY*32+tileX])
+			color := v.VRAM[patBase+name*8+(tileY&3)*2+row/4]
+			for i := uint16(0); i < 8; i++ {
+				if i < 4 {
+					colors[tileX*8+i] = color >> 4
+				} else {
+					colors[tileX*8+i] = color & 0x0f
+				}
+			}
+		}
+	}
+
+	return colors
+}
+
+func (v *vdp) drawLegacyPatternLine(colors []byte, x uint16, pattern, color byte) {
+	fg, bg := color>>4, color&0x0f
+	for i := uint16(0); i < 8; i++ {
+		if pattern&(0x80>>i) != 0 {
+			colors[x+i] = fg
+		} else {
+			colors[x+i] = bg
+		}
+	}
+}
+
+type legacySprite struct {
+	X, Y       int
+	PatternNum uint16
+	Color      byte
+}
+
+// parseLegacySpritesForLine finds the (up to 4) sprites on line y,
+// setting the 5th sprite flag if there's more
+func (v *vdp) parseLegacySpritesForLine(y uint16) []legacySprite {
+	base := v.tmsSpriteAttrTableAddr()
+
+	size := 8
+	if v.LargeSprites {
+		size = 16
+	}
+	height := size
+	if v.StretchedSprites {
+		height *= 2
+	}
+
+	sprites := []legacySprite{}
+	i := uint16(0)
+	for ; i < 32; i++ {
+		attr := v.VRAM[base+i*4:]
+		if attr[0] == 0xd0 {
+			break
+		}
+		spriteY := int(attr[0]) + 1
+		if spriteY > 0xe0 {
+			spriteY -= 256 // partially off the top
+		}
+		if int(y) < spriteY || int(y) >= spriteY+height {
+			continue
+		}
+		if len(sprites) == 4 {
+			if !v.SpriteOverflow {
+				v.SpriteOverflow = true
+				v.FifthSpriteNum = byte(i)
+			}
+			return sprites
+		}
+		spriteX := int(attr[1])
+		if attr[3]&0x80 != 0 {
+			spriteX -= 32 // early clock
+		}
+		patternNum := uint16(attr[2])
+		if size == 16 {
+			patternNum &^= 3
+		}
+		sprites = append(sprites, legacySprite{
+			X:          spriteX,
+			Y:          spriteY,
+			PatternNum: patternNum,
+			Color:      attr[3] & 0x0f,
+		})
+	}
+	if !v.SpriteOverflow {
+		if i == 32 {
+			i = 31
+		}
+		v.FifthSpriteNum = byte(i)
+	}
+	return sprites
+}
+
+// getLegacySpritePixel returns if the sprite's pattern is set at x, y
+func (v *vdp) getLegacySpritePixel(sp legacySprite, x, y int) bool {
+	col, row := x-sp.X, y-sp.Y
+	if v.StretchedSprites {
+		col, row = col/2, row/2
+	}
+	size := 8
+	if v.LargeSprites {
+		size = 16
+	}
+	if col < 0 || col >= size {
+		return false
+	}
+	// 16px sprites are 4 patterns, left column first
+	addr := v.tmsSpritePatternTableAddr() + sp.PatternNum*8 + uint16(row)
+	if col >= 8 {
+		addr += 16
+		col -= 8
+	}
+	return v.VRAM[addr]&(0x80>>uint(col)) != 0
+}
+
+func (v *vdp) renderLegacyScanline(y uint16) {
+
+	// mode 4's sprite list isn't used here, so
+	// don't let it go stale if the mode switches back
+	v.NumSprites = 0
+
+	colors := [256]byte{}
+	if v.DisplayEnable {
+		colors = v.getLegacyBGColors(y)
+
+		if v.getLegacyMode() != legacyText {
+			sprites := v.parseLegacySpritesForLine(y)
+			spriteSeen := [256]bool{}
+			spriteColors := [256]byte{}
+			for _, sp := range sprites {
+				for x := sp.X; x < sp.X+32; x++ {
+					if x < 0 || x >= 256 || !v.getLegacySpritePixel(sp, x, int(y)) {
+						continue
+					}
+					if spriteSeen[x] {
+						v.SpriteCollision = true
+					}
+					spriteSeen[x] = true
+					// color 0 is see-through, even to other sprites
+					if spriteColors[x] == 0 {
+						spriteColors[x] = sp.Color
+					}
+				}
+			}
+			for x := range colors {
+				if spriteColors[x] != 0 {
+					colors[x] = spriteColors[x]
+				}
+			}
+		}
+	}
+
+	for x := uint16(0); x < 256; x++ {
+		color := colors[x]
+		if color == 0 {
+			color = v.SMSBackdropCplane
+		}
+		rgb := tmsPalette[color]
+		v.drawColor(x, y, rgb[0], rgb[1], rgb[2])
+	}
+}
@@ -7,12 +7,14 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
 	"time"
+
+	"github.com/theinternetftw/segmago/disasm"
 )
 
 type vgmPlayer struct {
 	SN76489 sn76489
+	YM2413  ym2413
 
 	Hdr vgmHeader
 	GD3 gd3
@@ -34,28 +36,43 @@ type vgmPlayer struct {
 	Paused         bool
 	PauseStartTime time.Time
 
+	channels        *AudioChannels
+	selectedChannel int
+
 	DbgTerminal dbgTerminal
 	DbgScreen   [256 * 240 * 4]byte
 
 	LastFlipCycles uint64
 	Cycles         uint64
 
+	LastFault *EmuFault
+
 	devMode bool
 }
 
 func (vp *vgmPlayer) InDevMode() bool   { return vp.devMode }
 func (vp *vgmPlayer) SetDevMode(b bool) { vp.devMode = b }
 
-func (vp *vgmPlayer) IsPAL() bool           { return false }
+func (vp *vgmPlayer) IsPAL() bool           { return !vp.Hdr.isNTSC() }
 func (vp *vgmPlayer) GetCartRAM() []byte    { return nil }
 func (vp *vgmPlayer) CartRAMModified() bool { return false }
 func (vp *vgmPlayer) SetCartRAM(ram []byte) error {
 	return fmt.Errorf("saves not implemented for VGMs")
 }
-func (vp *vgmPlayer) MakeSnapshot() []byte { return nil }
+func (vp *vgmPlayer) MakeSnapshot() []byte                    { return nil }
+func (vp *vgmPlayer) SetSymbols(syms *disasm.Symbols)         {}
+func (vp *vgmPlayer) Glasses3DFrames() ([]byte, []byte, bool) { return nil, nil, false }
+func (vp *vgmPlayer) SetLink(link LinkTransport)              {}
+func (vp *vgmPlayer) Controller(port int) ControllerType      { return ControllerNone }
+func (vp *vgmPlayer) Debugger() *Debugger                     { return nil }
+func (vp *vgmPlayer) AttachedDebugger() *Debugger             { return nil }
 func (vp *vgmPlayer) LoadSnapshot(snapBytes []byte) (Emulator, error) {
 	return nil, fmt.Errorf("snapshots not implemented for VGMs")
 }
+func (vp *vgmPlayer) AudioChannels() *AudioChannels { return vp.channels }
+func (vp *vgmPlayer) SetSampleRate(samplesPerSecond int) {
+	vp.SN76489.setRates(vp.Hdr.clocksPerSecond(), samplesPerSecond)
+}
 
 type vgmHeader struct {
 	Magic [4]byte
@@ -140,7 +157,47 @@ func parseGd3(bytes []byte) (gd3, error) {
 }
 
 func (hdr *vgmHeader) isNTSC() bool {
-	return true
+	return hdr.TVRate != 50
+}
+
+// vgm waits are in samples at this rate, whatever we play at
+const vgmSamplesPerSecond = 44100
+
+// clocksPerSecond gives the PSG's clock, or failing that
+// the console clock the vgm was logged at
+func (hdr *vgmHeader) clocksPerSecond() int {
+	// the top bits are flags for dual chips and such
+	if clock := hdr.SNClock & 0x3fffffff; clock != 0 {
+		return int(clock)
+	}
+	if hdr.isNTSC() {
+		return ntscClocksPerSecond
+	}
+	return palClocksPerSecond
+}
+
+// psgVariant gives the PSG the vgm was logged from. Before
+// 1.10 (and when left as 0) it's the one sega used.
+func (hdr *vgmHeader) psgVariant() psgVariant {
+	v := psgSega
+	if hdr.Version >= 0x110 {
+		if hdr.SNFeedback != 0 {
+			v.Feedback = hdr.SNFeedback
+		}
+		if hdr.SNShiftRegWidth != 0 {
+			v.Width = uint(hdr.SNShiftRegWidth)
+		}
+	}
+	if hdr.Version >= 0x151 {
+		v.Freq0Is400 = hdr.SNFlags&0x01 != 0
+		v.Negate = hdr.SNFlags&0x02 != 0
+		v.NoStereo = hdr.SNFlags&0x04 != 0
+		if hdr.SNFlags&0x08 != 0 {
+			v.Divider = 2 // no /8 divider
+		}
+		v.XNOR = hdr.SNFlags&0x10 != 0
+	}
+	return v
 }
 
 func parseVgm(vgm []byte) (vgmHeader, []byte, error) {
@@ -216,7 +273,14 @@ func NewVgmPlayer(vgm []byte, devMode bool) Emulator {
 			}
 		}
 	}
-	vp.SN76489.init()
+	vp.SN76489.init(vp.Hdr.clocksPerSecond())
+	vp.SN76489.setVariant(vp.Hdr.psgVariant())
+	vp.YM2413.init()
+	vp.SN76489.mixer = vp.mixFM
+	vp.channels = newAudioChannels()
+	vp.SN76489.channels = vp.channels
+	vp.YM2413.channels = vp.channels
+	vp.channels.hasFM = vp.hasFM
 
 	vp.DbgTerminal = dbgTerminal{w: 256, h: 240, screen: vp.DbgScreen[:]}
 
@@ -265,6 +329,33 @@ func (vp *vgmPlayer) updateScreen() {
 	} else {
 		vp.DbgTerminal.newline()
 	}
+
+	vp.DbgTerminal.newline()
+	for ch := 0; ch < vp.channels.Len(); ch++ {
+		cursor, state := " ", ""
+		if ch == vp.selectedChannel {
+			cursor = ">"
+		}
+		if vp.channels.Soloed(ch) {
+			state = "S"
+		} else if vp.channels.Muted(ch) {
+			state = "M"
+		}
+		bright := byte(0xff)
+		if !vp.channels.Heard(ch) {
+			bright = 0x60
+		}
+		y := vp.DbgTerminal.y
+		vp.DbgTerminal.writeString(fmt.Sprintf("%s%-7s%s\n", cursor, AudioChannelName(ch), state))
+		vp.DbgTerminal.plotScope(11*8, y, 160, 7, vp.channels.Scope(ch), bright)
+	}
+	vp.DbgTerminal.newline()
+	vp.DbgTerminal.writeString("up/down, a: mute, b: solo\n")
+}
+
+// hasFM says if the tune uses the FM chip
+func (vp *vgmPlayer) hasFM() bool {
+	return vp.Hdr.YM2413Clock != 0
 }
 
 var lastInput time.Time
@@ -293,6 +384,13 @@ func (vp *vgmPlayer) togglePause() {
 	vp.updateScreen()
 }
 
+// either reset just restarts the song
+func (vp *vgmPlayer) SoftReset() { vp.HardReset() }
+func (vp *vgmPlayer) HardReset() {
+	vp.initTune(vp.CurrentSong)
+	vp.updateScreen()
+}
+
 func (vp *vgmPlayer) SetInput(input Input) {
 	now := time.Now()
 	if now.Sub(lastInput).Seconds() > 0.20 {
@@ -304,25 +402,43 @@ func (vp *vgmPlayer) SetInput(input Input) {
 			vp.nextSong()
 			lastInput = now
 		}
-		if input.Joypad1.Start {
+		if input.Joypad1.Start || input.Pause {
 			vp.togglePause()
 			lastInput = now
 		}
+
+		ch := vp.selectedChannel
+		switch {
+		case input.Joypad1.Up:
+			vp.selectedChannel = (ch + vp.channels.Len() - 1) % vp.channels.Len()
+		case input.Joypad1.Down:
+			vp.selectedChannel = (ch + 1) % vp.channels.Len()
+		case input.Joypad1.A:
+			vp.channels.SetMute(ch, !vp.channels.Muted(ch))
+		case input.Joypad1.B:
+			vp.channels.SetSolo(ch, !vp.channels.Soloed(ch))
+		default:
+			return
+		}
+		lastInput = now
+		vp.updateScreen()
 	}
 }
 
 var lastScreenUpdate time.Time
 
 func (vp *vgmPlayer) getCmdStreamByte() byte {
+	if vp.CmdPC >= uint32(len(vp.CmdStream)) {
+		// treat running off the end like an end-of-data cmd
+		return 0x66
+	}
 	b := vp.CmdStream[vp.CmdPC]
 	vp.CmdPC++
 	return b
 }
 func (vp *vgmPlayer) getCmdStreamWord() uint16 {
-	lo := vp.CmdStream[vp.CmdPC]
-	vp.CmdPC++
-	hi := vp.CmdStream[vp.CmdPC]
-	vp.CmdPC++
+	lo := vp.getCmdStreamByte()
+	hi := vp.getCmdStreamByte()
 	return uint16(lo) | uint16(hi)<<8
 }
 func (vp *vgmPlayer) stepCmd() {
@@ -334,6 +450,11 @@ func (vp *vgmPlayer) stepCmd() {
 	case 0x50:
 		arg := vp.getCmdStreamByte()
 		vp.SN76489.sendByte(arg)
+	case 0x51:
+		reg := vp.getCmdStreamByte()
+		val := vp.getCmdStreamByte()
+		vp.YM2413.writeAddr(reg)
+		vp.YM2413.writeData(val)
 	case 0x61:
 		arg := vp.getCmdStreamWord()
 		vp.SamplesToWait = arg
@@ -350,12 +471,28 @@ func (vp *vgmPlayer) stepCmd() {
 	case 0x66:
 		vp.PlaybackComplete = true
 	default:
-		fmt.Printf("unknown cmd 0x%02x\n", cmd)
-		os.Exit(1)
+		vp.LastFault = &EmuFault{
+			Msg: fmt.Sprintf("unknown vgm cmd 0x%02x at 0x%08x", cmd, vp.CmdPC-1),
+		}
+	}
+}
+
+func (vp *vgmPlayer) Fault() error {
+	if vp.LastFault == nil {
+		return nil
 	}
+	return vp.LastFault
+}
+
+func (vp *vgmPlayer) StepErr() error {
+	vp.Step()
+	return vp.Fault()
 }
 
 func (vp *vgmPlayer) Step() {
+	if vp.LastFault != nil {
+		return
+	}
 	if !vp.Paused {
 
 		now := time.Now()
@@ -384,18 +521,34 @@ func (vp *vgmPlayer) Step() {
 
 		if vp.SamplesToWait == 0 {
 			vp.stepCmd()
-			vp.SN76489.runCycle()
-			vp.Cycles++
+			vp.runCycle()
 		} else {
-			for i := int32(0); i < vp.SN76489.ClocksPerSample; i++ {
-				vp.SN76489.runCycle()
-				vp.Cycles++
+			clocksPerWait := vp.Hdr.clocksPerSecond() / vgmSamplesPerSecond
+			for i := 0; i < clocksPerWait; i++ {
+				vp.runCycle()
 			}
 			vp.SamplesToWait--
 		}
 	}
 }
 
+// NOTE: assumes the YM2413 shares the PSG's clock, as it does on the SMS
+func (vp *vgmPlayer) runCycle() {
+	vp.SN76489.runCycle()
+	if vp.Hdr.YM2413Clock != 0 {
+		vp.YM2413.runCycle()
+	}
+	vp.Cycles++
+}
+
+func (vp *vgmPlayer) mixFM(left, right float32) (float32, float32) {
+	if vp.Hdr.YM2413Clock == 0 {
+		return left, right
+	}
+	fm := vp.YM2413.takeSample() * fmMixLevel
+	return left + fm, right + fm
+}
+
 func (vp *vgmPlayer) ReadSoundBuffer(toFill []byte) {
 	if vp.Paused {
 		for i := range toFill {
@@ -415,7 +568,10 @@ func (vp *vgmPlayer) Framebuffer() []byte {
 }
 
 func (vp *vgmPlayer) FlipRequested() bool {
-	const cyclesPerFrame = 3579545 / 60
+	cyclesPerFrame := uint64(vp.Hdr.clocksPerSecond() / 60)
+	if !vp.Hdr.isNTSC() {
+		cyclesPerFrame = uint64(vp.Hdr.clocksPerSecond() / 50)
+	}
 	if vp.Cycles-vp.LastFlipCycles >= cyclesPerFrame {
 		vp.LastFlipCycles = vp.Cycles
 		return true
@@ -0,0 +1,468 @@
+package segmago
+
+import "math"
+
+// ym2413 is the OPLL, the FM chip in the Mark III FM unit and the
+// Japanese SMS. It's clocked with the cpu, making a sample every
+// 72 clocks, and those samples get mixed into the sn76489's output.
+type ym2413 struct {
+	RegAddr byte
+	Regs    [0x40]byte
+
+	Channels [9]fmChannel
+
+	Divider   byte
+	EGCounter uint32
+	LFOCount  uint32
+	Noise     uint32
+
+	SampleSum   float32
+	SampleCount int32
+	LastSample  float32
+
+	// for muting and scopes
+	channels   *AudioChannels
+	channelOut [9]float32
+}
+
+type fmChannel struct {
+	// modulator, carrier
+	Slots [2]fmSlot
+}
+
+type fmSlot struct {
+	Phase   uint32
+	Env     int32 // 0 is loudest, fmEnvMax is silent
+	EGState byte
+	KeyOn   bool
+
+	// last two outputs, for modulator feedback
+	Output [2]float32
+}
+
+const (
+	egAttack = iota
+	egDecay
+	egSustain
+	egRelease
+	egOff
+)
+
+const (
+	fmClocksPerSample = 72
+	fmEnvMax          = 127 // in 0.375dB steps
+	fmPhaseBits       = 19
+	fmPhaseMask       = 1<<fmPhaseBits - 1
+	fmSineBits        = 10
+	fmSineLen         = 1 << fmSineBits
+	fmAttenLen        = 512
+
+	// a lone full-volume FM ch sits a bit louder than a PSG ch
+	fmMixLevel = 0.2
+)
+
+// the built-in instruments (1-15) and rhythm sounds (16-18),
+// same layout as the custom instrument in regs 0-7
+var ym2413Patches = [19][8]byte{
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, // user
+	{0x71, 0x61, 0x1e, 0x17, 0xd0, 0x78, 0x00, 0x17}, // violin
+	{0x13, 0x41, 0x1a, 0x0d, 0xd8, 0xf7, 0x23, 0x13}, // guitar
+	{0x13, 0x01, 0x99, 0x00, 0xf2, 0xc4, 0x21, 0x23}, // piano
+	{0x11, 0x61, 0x0e, 0x07, 0x8d, 0x64, 0x70, 0x27}, // flute
+	{0x32, 0x21, 0x1e, 0x06, 0xe1, 0x76, 0x01, 0x28}, // clarinet
+	{0x31, 0x22, 0x16, 0x05, 0xe0, 0x71, 0x00, 0x18}, // oboe
+	{0x21, 0x61, 0x1d, 0x07, 0x82, 0x81, 0x11, 0x07}, // trumpet
+	{0x33, 0x21, 0x2d, 0x13, 0xb0, 0x70, 0x00, 0x07}, // organ
+	{0x61, 0x61, 0x1b, 0x06, 0x64, 0x65, 0x10, 0x17}, // horn
+	{0x41, 0x61, 0x0b, 0x18, 0x85, 0xf0, 0x81, 0x07}, // synthesizer
+	{0x33, 0x01, 0x83, 0x11, 0xea, 0xef, 0x10, 0x04}, // harpsichord
+	{0x17, 0xc1, 0x24, 0x07, 0xf8, 0xf8, 0x22, 0x12}, // vibraphone
+	{0x61, 0x50, 0x0c, 0x05, 0xd2, 0xf5, 0x40, 0x42}, // synth bass
+	{0x01, 0x01, 0x55, 0x03, 0xe9, 0x90, 0x03, 0x02}, // acoustic bass
+	{0x41, 0x41, 0x89, 0x03, 0xf1, 0xe4, 0xc0, 0x13}, // electric guitar
+	{0x01, 0x01, 0x18, 0x0f, 0xdf, 0xf8, 0x6a, 0x6d}, // bass drum
+	{0x01, 0x01, 0x00, 0x00, 0xc8, 0xd8, 0xa7, 0x68}, // hi-hat / snare
+	{0x05, 0x01, 0x00, 0x00, 0xf8, 0xaa, 0x59, 0x55}, // tom / top cymbal
+}
+
+// multiplier, doubled so 1/2 fits
+var fmMulTable = [16]uint32{1, 2, 4, 6, 8, 10, 12, 14, 16, 18, 20, 20, 24, 24, 30, 30}
+
+// key scale level at 6dB/oct for block 7, by top 4 bits of fnum
+var fmKSLTable = [16]int32{0, 24, 32, 37, 40, 43, 45, 47, 48, 50, 51, 52, 53, 54, 55, 56}
+
+var fmEGIncPattern = [4][8]byte{
+	{0, 1, 0, 1, 0, 1, 0, 1},
+	{0, 1, 0, 1, 1, 1, 0, 1},
+	{0, 1, 1, 1, 0, 1, 1, 1},
+	{0, 1, 1, 1, 1, 1, 1, 1},
+}
+
+var fmPMTable = [8]int32{0, 1, 2, 1, 0, -1, -2, -1}
+
+var fmSineTable [fmSineLen]float32
+var fmAttenTable [fmAttenLen]float32
+
+func init() {
+	for i := range fmSineTable {
+		fmSineTable[i] = float32(math.Sin(2 * math.Pi * float64(i) / fmSineLen))
+	}
+	for i := range fmAttenTable {
+		fmAttenTable[i] = float32(math.Pow(10, -float64(i)*0.375/20))
+	}
+}
+
+func (y *ym2413) init() {
+	y.Noise = 1
+	for i := range y.Channels {
+		for j := range y.Channels[i].Slots {
+			y.Channels[i].Slots[j].Env = fmEnvMax
+			y.Channels[i].Slots[j].EGState = egOff
+		}
+	}
+}
+
+func (y *ym2413) writeAddr(val byte) {
+	y.RegAddr = val & 0x3f
+}
+
+func (y *ym2413) writeData(val byte) {
+	y.Regs[y.RegAddr] = val
+	if y.RegAddr == 0x0e || (y.RegAddr >= 0x20 && y.RegAddr <= 0x28) {
+		y.updateKeys()
+	}
+}
+
+func (y *ym2413) rhythmMode() bool { return y.Regs[0x0e]&0x20 != 0 }
+
+func (y *ym2413) fnum(ch int) uint32 {
+	return uint32(y.Regs[0x10+ch]) | uint32(y.Regs[0x20+ch]&1)<<8
+}
+func (y *ym2413) block(ch int) uint32 { return uint32(y.Regs[0x20+ch]>>1) & 7 }
+func (y *ym2413) sustain(ch int) bool { return y.Regs[0x20+ch]&0x20 != 0 }
+
+func (y *ym2413) patch(ch int) *[8]byte {
+	if y.rhythmMode() && ch >= 6 {
+		return &ym2413Patches[16+ch-6]
+	}
+	inst := y.Regs[0x30+ch] >> 4
+	if inst == 0 {
+		return (*[8]byte)(y.Regs[:8])
+	}
+	return &ym2413Patches[inst]
+}
+
+// the rhythm key bits for each slot of chs 6-8
+var fmRhythmKeyBits = [3][2]byte{
+	{0x10, 0x10}, // bass drum
+	{0x01, 0x08}, // hi-hat, snare
+	{0x04, 0x02}, // tom, top cymbal
+}
+
+func (y *ym2413) updateKeys() {
+	for ch := range y.Channels {
+		chKey := y.Regs[0x20+ch]&0x10 != 0
+		for s := range y.Channels[ch].Slots {
+			key := chKey
+			if y.rhythmMode() && ch >= 6 {
+				key = key || y.Regs[0x0e]&fmRhythmKeyBits[ch-6][s] != 0
+			}
+			sl := &y.Channels[ch].Slots[s]
+			if key && !sl.KeyOn {
+				sl.EGState = egAttack
+				sl.Phase = 0
+			} else if !key && sl.KeyOn {
+				sl.EGState = egRelease
+			}
+			sl.KeyOn = key
+		}
+	}
+}
+
+func (y *ym2413) runCycle() {
+	y.Divider++
+	if y.Divider >= fmClocksPerSample {
+		y.Divider = 0
+		y.genSample()
+	}
+}
+
+// takeSample returns the average output since the last call
+func (y *ym2413) takeSample() float32 {
+	for ch, chOut := range y.channelOut {
+		y.channels.tap(NumPSGChannels+ch, clampSample(chOut))
+	}
+	if y.SampleCount > 0 {
+		y.LastSample = y.SampleSum / float32(y.SampleCount)
+		y.SampleSum = 0
+		y.SampleCount = 0
+	}
+	return y.LastSample
+}
+
+func (y *ym2413) genSample() {
+	y.EGCounter++
+	y.LFOCount++
+
+	if y.Noise&1 != 0 {
+		y.Noise ^= 0x800302
+	}
+	y.Noise >>= 1
+
+	for ch := range y.Channels {
+		for s := range y.Channels[ch].Slots {
+			y.runEnvelope(ch, s)
+			y.runPhase(ch, s)
+		}
+	}
+
+	numMelodic := 9
+	if y.rhythmMode() {
+		numMelodic = 6
+		y.calcRhythm(y.channelOut[6:])
+	}
+	for ch := 0; ch < numMelodic; ch++ {
+		y.channelOut[ch] = y.calcMelodic(ch)
+	}
+
+	out := float32(0)
+	for ch, chOut := range y.channelOut {
+		if y.channels.Heard(NumPSGChannels + ch) {
+			out += chOut
+		}
+	}
+
+	y.SampleSum += out
+	y.SampleCount++
+}
+
+func (y *ym2413) egSteps(rate uint32) int32 {
+	if rate < 4 {
+		return 0
+	}
+	hi, lo := rate>>2, rate&3
+	if hi < 13 {
+		shift := 13 - hi
+		if y.EGCounter&(1<<shift-1) != 0 {
+			return 0
+		}
+		return int32(fmEGIncPattern[lo][(y.EGCounter>>shift)&7])
+	}
+	return 1 << (hi - 13)
+}
+
+func (y *ym2413) runEnvelope(ch, s int) {
+	sl := &y.Channels[ch].Slots[s]
+	p := y.patch(ch)
+
+	ksr := y.block(ch)<<1 | y.fnum(ch)>>8
+	if p[s]&0x10 == 0 {
+		ksr >>= 2
+	}
+	calcRate := func(r byte) uint32 {
+		if r == 0 {
+			return 0
+		}
+		rate := uint32(r)*4 + ksr
+		if rate > 63 {
+			rate = 63
+		}
+		return rate
+	}
+
+	ar, dr := p[4+s]>>4, p[4+s]&0x0f
+	sl2, rr := p[6+s]>>4, p[6+s]&0x0f
+	sustained := p[s]&0x20 != 0
+
+	switch sl.EGState {
+	case egAttack:
+		rate := calcRate(ar)
+		if rate >= 60 {
+			sl.Env = 0
+		} else {
+			for n := y.egSteps(rate); n > 0; n-- {
+				sl.Env -= sl.Env>>3 + 1
+			}
+		}
+		if sl.Env <= 0 {
+			sl.Env = 0
+			sl.EGState = egDecay
+		}
+	case egDecay:
+		sl.Env += y.egSteps(calcRate(dr))
+		if sl.Env >= int32(sl2)*8 {
+			sl.EGState = egSustain
+		}
+	case egSustain:
+		if !sustained {
+			sl.Env += y.egSteps(calcRate(rr))
+		}
+	case egRelease:
+		var rate uint32
+		switch {
+		case y.sustain(ch):
+			rate = calcRate(5)
+		case sustained:
+			rate = calcRate(rr)
+		default:
+			rate = calcRate(7)
+		}
+		sl.Env += y.egSteps(rate)
+	case egOff:
+		sl.Env = fmEnvMax
+	}
+	if sl.Env >= fmEnvMax {
+		sl.Env = fmEnvMax
+		if sl.EGState == egRelease {
+			sl.EGState = egOff
+		}
+	}
+}
+
+func (y *ym2413) runPhase(ch, s int) {
+	sl := &y.Channels[ch].Slots[s]
+	p := y.patch(ch)
+
+	fnum := int32(y.fnum(ch))
+	if p[s]&0x40 != 0 {
+		// vibrato, about 6.4hz
+		fnum += (fnum >> 6) * fmPMTable[(y.LFOCount>>10)&7] >> 1
+	}
+	inc := uint32(fnum) * fmMulTable[p[s]&0x0f] << y.block(ch) >> 1
+	sl.Phase = (sl.Phase + inc) & fmPhaseMask
+}
+
+// slotGain returns the linear gain for a slot's total attenuation
+func (y *ym2413) slotGain(ch, s int) float32 {
+	sl := &y.Channels[ch].Slots[s]
+	p := y.patch(ch)
+
+	atten := sl.Env
+
+	var ksl byte
+	if s == 0 {
+		ksl = p[2] >> 6
+	} else {
+		ksl = p[3] >> 6
+	}
+	if ksl != 0 {
+		kslAtten := fmKSLTable[y.fnum(ch)>>5] - 16*int32(7-y.block(ch))
+		if kslAtten > 0 {
+			atten += kslAtten >> (3 - ksl)
+		}
+	}
+
+	rhythm := y.rhythmMode() && ch >= 6
+	switch {
+	case s == 1:
+		atten += int32(y.Regs[0x30+ch]&0x0f) * 8
+	case rhythm && ch >= 7:
+		// hi-hat and tom volumes live in the inst bits
+		atten += int32(y.Regs[0x30+ch]>>4) * 8
+	default:
+		atten += int32(p[2]&0x3f) * 2
+	}
+
+	if p[s]&0x80 != 0 {
+		// tremolo, about 3.7hz, 4.8dB deep
+		step := int32(y.LFOCount>>9) % 26
+		if step > 13 {
+			step = 26 - step
+		}
+		atten += step
+	}
+
+	if atten >= fmAttenLen {
+		return 0
+	}
+	return fmAttenTable[atten]
+}
+
+func (y *ym2413) wave(ch, s int, idx int32) float32 {
+	p := y.patch(ch)
+	rectified := p[3]&(0x08<<uint(s)) != 0
+	idx &= fmSineLen - 1
+	if rectified && idx >= fmSineLen/2 {
+		return 0
+	}
+	return fmSineTable[idx]
+}
+
+func (y *ym2413) phaseIdx(ch, s int) int32 {
+	return int32(y.Channels[ch].Slots[s].Phase >> (fmPhaseBits - fmSineBits))
+}
+
+// calcModulator runs the modulator (with feedback), returning its output
+func (y *ym2413) calcModulator(ch int) float32 {
+	mod := &y.Channels[ch].Slots[0]
+	fb := y.patch(ch)[3] & 7
+	fbIdx := int32(0)
+	if fb > 0 {
+		// full feedback swings the phase by +/- 4pi
+		fbIdx = int32((mod.Output[0]+mod.Output[1])*fmSineLen) >> (7 - fb)
+	}
+	out := y.wave(ch, 0, y.phaseIdx(ch, 0)+fbIdx) * y.slotGain(ch, 0)
+	mod.Output[1] = mod.Output[0]
+	mod.Output[0] = out
+	return out
+}
+
+func (y *ym2413) calcMelodic(ch int) float32 {
+	modOut := y.calcModulator(ch)
+	// a full-scale modulator swings the carrier by +/- 8pi
+	idx := y.phaseIdx(ch, 1) + int32(modOut*4*fmSineLen)
+	return y.wave(ch, 1, idx) * y.slotGain(ch, 1)
+}
+
+// calcRhythm fills out[0:3] with channels 6-8's outputs: the five
+// rhythm sounds, which play louder than the melodic chs. The
+// hi-hat, snare and cymbal are made from noise and phase bits
+// rather than sines.
+func (y *ym2413) calcRhythm(out []float32) {
+	// bass drum: a normal 2-op voice
+	out[0] = 2 * y.calcMelodic(6)
+
+	noise := y.Noise&1 != 0
+	hhPhase := y.phaseIdx(7, 0)
+	tcPhase := y.phaseIdx(8, 1)
+	res1 := (hhPhase>>2^hhPhase>>7)&1 != 0 || hhPhase>>3&1 != 0
+	res2 := (tcPhase>>3^tcPhase>>5)&1 != 0
+	if res2 {
+		res1 = true
+	}
+
+	// hi-hat
+	var idx int32
+	if res1 {
+		idx = 0x200 | 0xd0>>2
+		if noise {
+			idx = 0x200 | 0xd0
+		}
+	} else {
+		idx = 0xd0
+		if noise {
+			idx = 0xd0 >> 2
+		}
+	}
+	out[1] = 2 * fmSineTable[idx&(fmSineLen-1)] * y.slotGain(7, 0)
+
+	// snare
+	idx = 0x100
+	if hhPhase>>8&1 != 0 {
+		idx = 0x200
+	}
+	if noise {
+		idx ^= 0x100
+	}
+	out[1] += 2 * fmSineTable[idx] * y.slotGain(7, 1)
+
+	// tom: a lone sine
+	out[2] = 2 * y.wave(8, 0, y.phaseIdx(8, 0)) * y.slotGain(8, 0)
+
+	// top cymbal
+	idx = 0x100
+	if res1 {
+		idx = 0x300
+	}
+	out[2] += 2 * fmSineTable[idx] * y.slotGain(8, 1)
+}
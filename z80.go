@@ -34,6 +34,23 @@ type z80 struct {
 	Write     func(addr uint16, val byte) `json:"-"`
 	In        func(addr uint16) byte      `json:"-"`
 	Out       func(addr uint16, val byte) `json:"-"`
+
+	// Peek, if set, reads without side effects (e.g. watchpoints)
+	Peek func(addr uint16) byte `json:"-"`
+
+	// Labeler, if set, names addresses in debug output
+	Labeler func(addr uint16) (string, bool) `json:"-"`
+}
+
+func (z *z80) peek(addr uint16) byte {
+	if z.Peek != nil {
+		return z.Peek(addr)
+	}
+	return z.Read(addr)
+}
+
+func (z *z80) peek16(addr uint16) uint16 {
+	return uint16(z.peek(addr+1))<<8 | uint16(z.peek(addr))
 }
 
 func (z *z80) read16(addr uint16) uint16 {
@@ -47,17 +64,36 @@ func (z *z80) write16(addr uint16, val uint16) {
 	z.Write(addr+1, byte(val>>8))
 }
 
+// reset is what the /RESET line does, leaving
+// most of the regs as they were
+func (z *z80) reset() {
+	z.PC = 0
+	z.I, z.R = 0, 0
+	z.IsHalted = false
+	z.InterruptMode = 0
+	z.InterruptMasterEnable = false
+	z.InterruptSettingPreNMI = false
+	z.InterruptEnableNeedsDelay = false
+	z.IRQ = false
+	z.NMI = false
+}
+
 func (z *z80) interruptComplete() {
 	// TODO: signal to devices that interrupt is complete
 }
 
-func (z *z80) handleInterrupts() {
+// handleInterrupts returns true if an interrupt was taken
+func (z *z80) handleInterrupts() bool {
 	if z.NMI {
 		z.NMI = false
+		if z.IsHalted {
+			z.resumeFromHalt()
+		}
 		z.InterruptSettingPreNMI = z.InterruptMasterEnable
 		z.InterruptMasterEnable = false
 		z.pushOp16(11, 0, z.PC)
 		z.PC = 0x0066
+		return true
 	} else if z.IRQ {
 		if z.IsHalted {
 			z.resumeFromHalt()
@@ -76,8 +112,10 @@ func (z *z80) handleInterrupts() {
 				// Only valid for SMS2 and genesis!
 				z.PC = uint16(z.I)<<8 | 0xff
 			}
+			return true
 		}
 	}
+	return false
 }
 
 func (z *z80) getSignFlag() bool { return z.F&0x80 > 0 }